@@ -0,0 +1,396 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/dhcp"
+	"github.com/liloew/gvn/gvn"
+	"github.com/liloew/gvn/keystore"
+	"github.com/liloew/gvn/p2p"
+	"github.com/liloew/gvn/qos"
+	"github.com/liloew/gvn/route"
+	"github.com/liloew/gvn/tun"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigError describes an invalid config item and how to fix it
+type ConfigError struct {
+	Field   string
+	Message string
+	Hint    string
+}
+
+func (e ConfigError) Error() string {
+	if e.Hint == "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Field, e.Message, e.Hint)
+}
+
+var (
+	// the network id is a part of the protocol ids
+	NETWORK_PATTERN = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	configCmd       = &cobra.Command{
+		Use:   "config",
+		Short: "manage gvn config file",
+		Long:  `Manage the gvn.yaml file`,
+	}
+	validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "validate gvn config file",
+		Long:  `Validate the gvn.yaml file and check the subnets conflict with LAN and other peers`,
+		Run: func(cmd *cobra.Command, args []string) {
+			errs := validateConfig(viper.ConfigFileUsed())
+			if remote, _ := cmd.Flags().GetBool("remote"); remote && len(errs) == 0 {
+				errs = append(errs, validatePeers()...)
+			}
+			if len(errs) > 0 {
+				printConfigErrors(viper.ConfigFileUsed(), errs)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "Config file is valid: %s\n", viper.ConfigFileUsed())
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(validateCmd)
+	validateCmd.Flags().BoolP("remote", "r", false, "connect to server and check the subnets conflict with other peers")
+}
+
+func printConfigErrors(file string, errs []error) {
+	fmt.Fprintf(os.Stderr, "Config file is invalid: %s\n", file)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  - %s\n", err)
+	}
+}
+
+// validate the config file and return all the errors found
+func validateConfig(file string) []error {
+	errs := make([]error, 0)
+	buff, err := os.ReadFile(file)
+	if err != nil {
+		return append(errs, ConfigError{Field: "file", Message: err.Error(), Hint: "run gvn init to generate one"})
+	}
+	config := gvn.Config{}
+	if err := yaml.UnmarshalStrict(buff, &config); err != nil {
+		return append(errs, ConfigError{Field: "file", Message: err.Error(), Hint: "remove the unknown keys or fix the value types"})
+	}
+	if len(config.Networks) == 0 {
+		return validateNetwork(config)
+	}
+
+	// the top-level keys other than networks are not inherited by the networks
+	var keys yaml.MapSlice
+	yaml.Unmarshal(buff, &keys)
+	for _, key := range keys {
+		if key.Key != "networks" {
+			errs = append(errs, ConfigError{Field: fmt.Sprint(key.Key), Message: "ignored since networks listed", Hint: "move it into the networks"})
+		}
+	}
+	names, ports, devices := map[string]int{}, map[uint]int{}, map[string]int{}
+	for i, network := range config.Networks {
+		prefix := fmt.Sprintf("networks[%d].", i)
+		if network.Name == "" || !NETWORK_PATTERN.MatchString(network.Name) {
+			errs = append(errs, ConfigError{Field: prefix + "name", Message: fmt.Sprintf("invalid name %q", network.Name), Hint: "use letters, digits, dot, dash and underscore only, office for example"})
+		} else if j, ok := names[network.Name]; ok {
+			errs = append(errs, ConfigError{Field: prefix + "name", Message: fmt.Sprintf("%s is used by networks[%d] already", network.Name, j), Hint: "the names of the networks must be unique"})
+		} else {
+			names[network.Name] = i
+		}
+		if len(network.Networks) > 0 {
+			errs = append(errs, ConfigError{Field: prefix + "networks", Message: "nested networks", Hint: "list all the networks at the top level"})
+		}
+		if j, ok := ports[network.Port]; ok && network.Port != 0 {
+			errs = append(errs, ConfigError{Field: prefix + "port", Message: fmt.Sprintf("%d is used by networks[%d] already", network.Port, j), Hint: "each network listens on its own port"})
+		} else {
+			ports[network.Port] = i
+		}
+		if j, ok := devices[network.Dev.Name]; ok || network.Dev.Name == "" {
+			message := "missing"
+			if ok {
+				message = fmt.Sprintf("%s is used by networks[%d] already", network.Dev.Name, j)
+			}
+			errs = append(errs, ConfigError{Field: prefix + "dev.name", Message: message, Hint: "each network has its own TUN device, utun3 for example"})
+		} else {
+			devices[network.Dev.Name] = i
+		}
+		errs = append(errs, prefixErrors(prefix, validateNetwork(network))...)
+	}
+	return errs
+}
+
+// prefix the fields of the errors with the network they belong to
+func prefixErrors(prefix string, errs []error) []error {
+	for i, err := range errs {
+		if e, ok := err.(ConfigError); ok {
+			e.Field = prefix + e.Field
+			errs[i] = e
+		}
+	}
+	return errs
+}
+
+// validate the config of a network
+func validateNetwork(config gvn.Config) []error {
+	errs := make([]error, 0)
+	if _, err := peer.Decode(config.Id); err != nil {
+		errs = append(errs, ConfigError{Field: "id", Message: fmt.Sprintf("invalid peer id %q", config.Id), Hint: "run gvn init to generate a new identity"})
+	}
+	if config.KeyFile != "" && config.PriKey != "" {
+		errs = append(errs, ConfigError{Field: "priKey", Message: "both keyFile and priKey are set", Hint: "remove priKey and keep the key in keyFile only"})
+	} else if config.KeyFile != "" {
+		if err := keystore.CheckFile(resolvePath(config.KeyFile)); err != nil {
+			errs = append(errs, ConfigError{Field: "keyFile", Message: err.Error(), Hint: "run gvn keygen to generate one"})
+		}
+	} else if config.PriKey == "" {
+		errs = append(errs, ConfigError{Field: "keyFile", Message: "missing private key", Hint: "run gvn keygen and set keyFile"})
+	}
+	if config.Mode != gvn.MODECLIENT && config.Mode != gvn.MODESERVER {
+		errs = append(errs, ConfigError{Field: "mode", Message: fmt.Sprintf("unknown mode %d", config.Mode), Hint: "0 for client and 1 for server"})
+	}
+	if config.Port > 65535 || (config.Mode == gvn.MODESERVER && config.Port == 0) {
+		errs = append(errs, ConfigError{Field: "port", Message: fmt.Sprintf("invalid port %d", config.Port), Hint: "use a port between 1 and 65535, 6543 for example"})
+	}
+	if config.Version == "" {
+		errs = append(errs, ConfigError{Field: "version", Message: "missing", Hint: "all the nodes must use the same version, 1.0.0 for example"})
+	}
+	if config.Network != "" && !NETWORK_PATTERN.MatchString(config.Network) {
+		errs = append(errs, ConfigError{Field: "network", Message: fmt.Sprintf("invalid network id %q", config.Network), Hint: "use letters, digits, dot, dash and underscore only"})
+	}
+	if config.PskFile != "" {
+		if err := keystore.CheckFile(resolvePath(config.PskFile)); err != nil {
+			errs = append(errs, ConfigError{Field: "pskFile", Message: err.Error(), Hint: "run gvn key psk to generate one, or copy it from other nodes"})
+		} else if _, err := loadPSK(config); err != nil {
+			errs = append(errs, ConfigError{Field: "pskFile", Message: fmt.Sprintf("invalid pre-shared key: %s", err), Hint: "run gvn key psk to generate one"})
+		}
+	}
+	if config.Dev.Metric < 0 {
+		errs = append(errs, ConfigError{Field: "dev.metric", Message: fmt.Sprintf("invalid metric %d", config.Dev.Metric), Hint: "use 0 or a positive number, the lower is preferred"})
+	}
+	if config.Failback != "" && config.Failback != route.FailbackPreempt && config.Failback != route.FailbackSticky {
+		errs = append(errs, ConfigError{Field: "failback", Message: fmt.Sprintf("unknown failback %q", config.Failback), Hint: "use preempt or sticky"})
+	}
+	if config.Dev.Mtu != 0 && (config.Dev.Mtu < 576 || config.Dev.Mtu > p2p.MAX_MTU) {
+		errs = append(errs, ConfigError{Field: "dev.mtu", Message: fmt.Sprintf("invalid MTU %d", config.Dev.Mtu), Hint: fmt.Sprintf("use a MTU between 576 and %d, 1420 for example", p2p.MAX_MTU)})
+	}
+	if config.Dev.Tap && len(config.Dev.Subnets) > 0 {
+		errs = append(errs, ConfigError{Field: "dev.subnets", Message: "the subnets are not routed in TAP mode", Hint: "bridge the LAN with the TAP device instead, or disable dev.tap"})
+	}
+	if config.Dev.Tap && runtime.GOOS == "darwin" && !strings.HasPrefix(config.Dev.Name, "tap") {
+		errs = append(errs, ConfigError{Field: "dev.name", Message: fmt.Sprintf("invalid TAP device name %q", config.Dev.Name), Hint: "tuntaposx names the TAP devices tap0, tap1 and so on"})
+	}
+
+	var vipNet *net.IPNet
+	if config.Mode == gvn.MODESERVER {
+		if ip, network, err := net.ParseCIDR(config.Dev.Vip); err != nil || ip.To4() == nil {
+			errs = append(errs, ConfigError{Field: "dev.vip", Message: fmt.Sprintf("invalid IPv4 CIDR %q", config.Dev.Vip), Hint: "use the form 192.168.1.1/24"})
+		} else {
+			vipNet = network
+			if lan := tun.ConflictWithLAN(network, config.Dev.Name); lan != nil {
+				errs = append(errs, ConfigError{Field: "dev.vip", Message: fmt.Sprintf("%s overlaps with LAN %s", config.Dev.Vip, lan), Hint: "choose a VIP network unused by the local interfaces"})
+			}
+		}
+	} else {
+		if ma, err := multiaddr.NewMultiaddr(config.Server); err != nil {
+			errs = append(errs, ConfigError{Field: "server", Message: fmt.Sprintf("invalid multiaddr %q", config.Server), Hint: "use the form /ip4/1.2.3.4/tcp/6543/p2p/<server id>"})
+		} else if _, err := peer.AddrInfoFromP2pAddr(ma); err != nil {
+			errs = append(errs, ConfigError{Field: "server", Message: fmt.Sprintf("%q doesn't contain the server id", config.Server), Hint: "append /p2p/<server id> to the address"})
+		}
+	}
+
+	subnets := make([]*net.IPNet, 0)
+	for i, subnet := range config.Dev.Subnets {
+		field := fmt.Sprintf("dev.subnets[%d]", i)
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf("invalid CIDR %q", subnet), Hint: "use the form 10.30.20.0/24"})
+			continue
+		}
+		if network.String() != subnet {
+			errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf("%q is not a network address", subnet), Hint: fmt.Sprintf("use %s instead", network)})
+		}
+		if vipNet != nil && tun.Overlap(vipNet, network) {
+			errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf("%s overlaps with VIP network %s", subnet, vipNet), Hint: "remove the subnet or change dev.vip"})
+		}
+		for j, other := range subnets {
+			if tun.Overlap(other, network) {
+				errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf("%s overlaps with dev.subnets[%d] %s", subnet, j, other), Hint: "merge or remove one of them"})
+			}
+		}
+		subnets = append(subnets, network)
+	}
+
+	if config.Mode != gvn.MODESERVER && !config.Qos.Empty() {
+		errs = append(errs, ConfigError{Field: "qos", Message: "ignored in client mode", Hint: "configure the QoS policy on server, it's pushed to all nodes"})
+	}
+	for _, err := range config.Flood.Validate() {
+		e := err.(p2p.FieldError)
+		errs = append(errs, ConfigError{Field: e.Field, Message: e.Message, Hint: "use the IPv4 multicast groups like 224.0.0.251 or 239.0.0.0/8, rate is in packets per second"})
+	}
+	if config.Dev.Tap && !config.Flood.Empty() {
+		errs = append(errs, ConfigError{Field: "flood", Message: "ignored in TAP mode", Hint: "the broadcast and multicast frames are flooded by the switch in TAP mode"})
+	}
+	if config.Netstack.Enabled && config.Dev.Tap {
+		errs = append(errs, ConfigError{Field: "netstack", Message: "unsupported in TAP mode", Hint: "disable dev.tap, the userspace stack handles the IP packets only"})
+	}
+	if config.Netstack.Enabled && len(config.Dev.Subnets) > 0 {
+		errs = append(errs, ConfigError{Field: "dev.subnets", Message: "the subnets are not routed by the userspace stack", Hint: "advertise the subnets from a node running the TUN device"})
+	}
+	for _, listen := range []struct{ field, address string }{{"netstack.socks", config.Netstack.Socks}, {"netstack.http", config.Netstack.Http}} {
+		if listen.address == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(listen.address); err != nil {
+			errs = append(errs, ConfigError{Field: listen.field, Message: fmt.Sprintf("invalid listen address %q", listen.address), Hint: "use the form 127.0.0.1:1080"})
+		}
+	}
+	if !config.Netstack.Enabled && (config.Netstack.Socks != "" || config.Netstack.Http != "") {
+		errs = append(errs, ConfigError{Field: "netstack", Message: "ignored unless enabled", Hint: "set netstack.enabled to true"})
+	}
+	forwards := map[string]int{}
+	for i, rule := range config.Forwards {
+		field := fmt.Sprintf("forwards[%d]", i)
+		if err := rule.Validate(); err != nil {
+			errs = append(errs, ConfigError{Field: field, Message: err.Error(), Hint: "listen on a port of VIP like 5432 and forward to an address like 127.0.0.1:5432, the reverse ones listen on 127.0.0.1:15432 and forward to a VIP"})
+		} else if j, ok := forwards[rule.Key()]; ok {
+			errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf("%s is forwarded by forwards[%d] already", rule.Key(), j), Hint: "remove one of them"})
+		} else {
+			forwards[rule.Key()] = i
+		}
+	}
+	for _, err := range config.Qos.Validate() {
+		e := err.(qos.FieldError)
+		errs = append(errs, ConfigError{Field: e.Field, Message: e.Message, Hint: "rate is in kbit/s, priority is between 0 (highest) and 7"})
+	}
+	if config.Mode != gvn.MODESERVER && len(config.Quotas) > 0 {
+		errs = append(errs, ConfigError{Field: "quotas", Message: "ignored in client mode", Hint: "configure the quotas on server"})
+	}
+	for i, quota := range config.Quotas {
+		field := fmt.Sprintf("quotas[%d]", i)
+		if quota.Peer != "" {
+			if _, err := peer.Decode(quota.Peer); err != nil {
+				errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf("invalid peer id %q", quota.Peer), Hint: "leave peer empty for the default quota"})
+			}
+		}
+		if quota.Monthly == 0 {
+			errs = append(errs, ConfigError{Field: field, Message: "monthly must be greater than 0 MB", Hint: "remove the quota for unlimited traffic"})
+		}
+		if quota.Action != "" && quota.Action != dhcp.QUOTA_REFUSE && quota.Action != dhcp.QUOTA_THROTTLE {
+			errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf("unknown action %q", quota.Action), Hint: "use refuse or throttle"})
+		}
+	}
+	return errs
+}
+
+// fetch the subnets advertised by other peers of all the networks and check the conflicts with self
+func validatePeers() []error {
+	errs := make([]error, 0)
+	config := gvn.Config{}
+	if err := viper.Unmarshal(&config); err != nil {
+		return append(errs, ConfigError{Field: "file", Message: err.Error()})
+	}
+	if len(config.Networks) == 0 {
+		return validateNetworkPeers(config)
+	}
+	for i, network := range config.Networks {
+		errs = append(errs, prefixErrors(fmt.Sprintf("networks[%d].", i), validateNetworkPeers(network))...)
+	}
+	return errs
+}
+
+func validateNetworkPeers(config gvn.Config) []error {
+	errs := make([]error, 0)
+	if config.Mode == gvn.MODESERVER {
+		// server has all the leases itself
+		return errs
+	}
+	priKey, err := loadPrivateKey(config)
+	if err != nil {
+		return append(errs, ConfigError{Field: "keyFile", Message: err.Error(), Hint: "run gvn keygen to generate one"})
+	}
+	psk, err := loadPSK(config)
+	if err != nil {
+		return append(errs, ConfigError{Field: "pskFile", Message: err.Error(), Hint: "run gvn key psk to generate one"})
+	}
+	host, err := p2p.NewPeer(priKey, 0, psk)
+	if err != nil {
+		return append(errs, ConfigError{Field: "priKey", Message: "invalid private key", Hint: "run gvn init to generate a new identity"})
+	}
+	defer host.Close()
+	ma, _ := multiaddr.NewMultiaddr(config.Server)
+	addr, _ := peer.AddrInfoFromP2pAddr(ma)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := host.Connect(ctx, *addr); err != nil {
+		return append(errs, ConfigError{Field: "server", Message: fmt.Sprintf("connect to %s error: %s", config.Server, err), Hint: "check the server is running and reachable"})
+	}
+	zones := []string{p2p.RPC_PROTOCOL_ID, fmt.Sprintf("/rpc/%s", config.Version)}
+	var ress []dhcp.Response
+	req := dhcp.Request{Id: config.Id, Name: config.Dev.Name, Subnets: config.Dev.Subnets}
+	if err := dhcp.CallAny(ctx, host, zones, addr.ID, "DHCPService", "Clients", req, &ress); err != nil {
+		return append(errs, ConfigError{Field: "server", Message: fmt.Sprintf("request clients error: %s", err), Hint: "check the version is consistent with server"})
+	}
+	for i, subnet := range config.Dev.Subnets {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		for _, res := range ress {
+			if res.Id == config.Id {
+				continue
+			}
+			for _, other := range res.Subnets {
+				// the same subnet is advertised by the redundant routers
+				if _, otherNet, err := net.ParseCIDR(other); err == nil && tun.Overlap(network, otherNet) && otherNet.String() != network.String() {
+					errs = append(errs, ConfigError{Field: fmt.Sprintf("dev.subnets[%d]", i), Message: fmt.Sprintf("%s overlaps with %s advertised by %s (%s)", subnet, other, res.Name, res.Id), Hint: "advertise the same subnet for failover or split them"})
+				}
+			}
+		}
+	}
+	for _, res := range ress {
+		if res.Id == config.Id {
+			continue
+		}
+		for _, other := range res.Subnets {
+			if _, otherNet, err := net.ParseCIDR(other); err == nil {
+				if lan := tun.ConflictWithLAN(otherNet, config.Dev.Name); lan != nil {
+					errs = append(errs, ConfigError{Field: "peers", Message: fmt.Sprintf("%s advertised by %s (%s) overlaps with LAN %s", other, res.Name, res.Id, lan), Hint: "the route will be ignored, ask the peer to change its subnets"})
+				}
+			}
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"Peers":  len(ress),
+		"Errors": len(errs),
+	}).Debug("Validate peers")
+	return errs
+}
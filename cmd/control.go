@@ -0,0 +1,76 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/liloew/gvn/control"
+	"github.com/liloew/gvn/forward"
+	"github.com/liloew/gvn/gvn"
+	"github.com/liloew/gvn/route"
+	"github.com/sirupsen/logrus"
+)
+
+// the control socket is in the directory of the user in the temp dir, which is accessible by owner only
+func controlSocket() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gvn-%d", os.Getuid()), "gvn.sock")
+}
+
+// serveControl serves the commands to the running gvn through the control socket, the commands apply to the first
+// network unless named
+func serveControl(nodes []*gvn.Node) *control.Server {
+	server, err := control.Listen(controlSocket())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+			"File":  controlSocket(),
+		}).Error("Listen on control socket error, the commands to the running gvn are unavailable")
+		return nil
+	}
+	handleRoutes(server, func(name string) (*route.RouteTable, error) {
+		node, err := findNode(nodes, name)
+		if err != nil {
+			return nil, err
+		}
+		return node.Routes(), nil
+	})
+	handleForwards(server, func(name string) (*forward.Manager, error) {
+		node, err := findNode(nodes, name)
+		if err != nil {
+			return nil, err
+		}
+		if forwards := node.Forwards(); forwards != nil {
+			return forwards, nil
+		}
+		return nil, errors.New("the VIP is not assigned yet, is the network up?")
+	})
+	go server.Serve()
+	return server
+}
+
+// findNode returns the node of the network named name, the first one if name is empty
+func findNode(nodes []*gvn.Node, name string) (*gvn.Node, error) {
+	for _, node := range nodes {
+		if name == "" || node.Config().Name == name {
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %s", name)
+}
@@ -18,10 +18,14 @@ package cmd
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 
+	"github.com/liloew/gvn/gvn"
+	"github.com/liloew/gvn/keystore"
 	"github.com/sevlyar/go-daemon"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var daemonCmd = &cobra.Command{
@@ -47,6 +51,33 @@ var daemonCmd = &cobra.Command{
 			Umask:       027,
 			Args:        args,
 		}
+		if !daemon.WasReborn() {
+			// the daemon has no terminal to read the passphrase
+			config := gvn.Config{}
+			if err := viper.Unmarshal(&config); err == nil {
+				for _, network := range gvn.Networks(config) {
+					if data, err := readKey(network); err == nil && keystore.IsEncrypted(data) {
+						passphrase, err := currentPassphrase()
+						if err != nil {
+							logrus.WithFields(logrus.Fields{
+								"ERROR": err,
+							}).Fatal("Read passphrase error")
+						}
+						// the environment of the daemon is readable in /proc for its whole life, the pipe is drained
+						// and closed once read
+						pipe, err := passphrasePipe(passphrase)
+						if err != nil {
+							logrus.WithFields(logrus.Fields{
+								"ERROR": err,
+							}).Fatal("Pass passphrase to daemon error")
+						}
+						defer pipe.Close()
+						cntxt.Args = append(append([]string{}, os.Args...), "--passphrase-fd", strconv.Itoa(int(pipe.Fd())))
+						break
+					}
+				}
+			}
+		}
 		d, err := cntxt.Reborn()
 		if err != nil {
 			logrus.Fatal("Unable to run gvn as daemon" + err.Error())
@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// the pipe fd is moved at or above it, away from the fds go-daemon hands to the daemon process
+const PASSPHRASE_MIN_FD = 10
+
+// passphrasePipe returns the read end of a pipe holding the passphrase, its fd isn't close-on-exec so the daemon
+// process inherits it and reads the passphrase by --passphrase-fd. The caller closes it once the daemon started
+func passphrasePipe(passphrase []byte) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// far below the pipe capacity, so never blocks
+	_, err = w.Write(append(append([]byte{}, passphrase...), '\n'))
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+	// F_DUPFD leaves close-on-exec clear
+	fd, _, errno := syscall.Syscall(syscall.SYS_FCNTL, r.Fd(), syscall.F_DUPFD, PASSPHRASE_MIN_FD)
+	if errno != 0 {
+		return nil, errno
+	}
+	return os.NewFile(fd, "passphrase"), nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/liloew/gvn/control"
+	"github.com/liloew/gvn/forward"
+	"github.com/spf13/cobra"
+)
+
+// ForwardParams are the params of the forward methods of the control socket
+type ForwardParams struct {
+	forward.Rule
+	// the first network if empty
+	Network string `json:"network,omitempty"`
+}
+
+var (
+	forwardCmd = &cobra.Command{
+		Use:   "forward",
+		Short: "manage the port forwarding",
+		Long:  `Show and change the port forwarding between the overlay and the local services of the running gvn`,
+	}
+	forwardListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "list the forward rules",
+		Long:  `List the forward rules with the addresses listened on and the connections being forwarded`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var rules []forward.Status
+			callControl("forwards.list", ForwardParams{Network: routesNetwork(cmd)}, &rules)
+			printForwards(cmd, rules)
+		},
+	}
+	forwardAddCmd = &cobra.Command{
+		Use:   "add <listen> <target>",
+		Short: "add a forward rule",
+		Long: `Forward the connections to the port of VIP to the local or LAN target, or the connections to the local port to
+the VIP:port of a peer with --reverse, until gvn restarts`,
+		Example: `  gvn forward add 5432 127.0.0.1:5432
+  gvn forward add --proto udp 53 192.168.1.1:53
+  gvn forward add --reverse 15432 10.0.0.2:5432`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			callControl("forwards.add", forwardArgs(cmd, args[0], args[1]), nil)
+		},
+	}
+	forwardDelCmd = &cobra.Command{
+		Use:   "del <listen>",
+		Short: "delete a forward rule",
+		Long:  `Delete the forward rule listening on the port or address and close its connections`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			callControl("forwards.del", forwardArgs(cmd, args[0], ""), nil)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(forwardCmd)
+	forwardCmd.AddCommand(forwardListCmd, forwardAddCmd, forwardDelCmd)
+	forwardCmd.PersistentFlags().StringP("network", "n", "", "the network of the rules (default the first one)")
+	forwardListCmd.Flags().BoolP("json", "", false, "print the rules in json")
+	for _, cmd := range []*cobra.Command{forwardAddCmd, forwardDelCmd} {
+		cmd.Flags().StringP("proto", "p", forward.PROTO_TCP, "tcp or udp")
+		cmd.Flags().BoolP("reverse", "r", false, "listen on the local port and forward to the VIP:port of a peer")
+	}
+}
+
+func forwardArgs(cmd *cobra.Command, listen string, target string) ForwardParams {
+	proto, _ := cmd.Flags().GetString("proto")
+	reverse, _ := cmd.Flags().GetBool("reverse")
+	return ForwardParams{
+		Rule:    forward.Rule{Proto: proto, Listen: listen, Target: target, Reverse: reverse},
+		Network: routesNetwork(cmd),
+	}
+}
+
+func printForwards(cmd *cobra.Command, rules []forward.Status) {
+	if asJson, _ := cmd.Flags().GetBool("json"); asJson {
+		buff, _ := json.MarshalIndent(rules, "", "  ")
+		fmt.Println(string(buff))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTO\tLISTEN\tTARGET\tDIRECTION\tACTIVE")
+	for _, r := range rules {
+		direction := "inbound"
+		if r.Reverse {
+			direction = "reverse"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", r.Proto, r.Address, r.Target, direction, r.Active)
+	}
+	w.Flush()
+}
+
+// handleForwards serves the forward methods on the control socket, the rules are found by the network name
+func handleForwards(server *control.Server, managers func(name string) (*forward.Manager, error)) {
+	server.Handle("forwards.list", func(params json.RawMessage) (interface{}, error) {
+		_, forwards, err := forwardParams(params, managers)
+		if err != nil {
+			return nil, err
+		}
+		return forwards.Rules(), nil
+	})
+	server.Handle("forwards.add", func(params json.RawMessage) (interface{}, error) {
+		p, forwards, err := forwardParams(params, managers)
+		if err != nil {
+			return nil, err
+		}
+		return nil, forwards.Add(p.Rule)
+	})
+	server.Handle("forwards.del", func(params json.RawMessage) (interface{}, error) {
+		p, forwards, err := forwardParams(params, managers)
+		if err != nil {
+			return nil, err
+		}
+		return nil, forwards.Remove(p.Rule)
+	})
+}
+
+// the params and the rules of the network named by them
+func forwardParams(params json.RawMessage, managers func(name string) (*forward.Manager, error)) (ForwardParams, *forward.Manager, error) {
+	var p ForwardParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return p, nil, err
+		}
+	}
+	forwards, err := managers(p.Network)
+	return p, forwards, err
+}
@@ -21,39 +21,15 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/gvn"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v2"
 )
 
-type MODE uint
-
-const (
-	MODECLIENT MODE = iota
-	MODESERVER
-)
-
-type Device struct {
-	Name    string   `yaml:"name,omitempty"`
-	Vip     string   `yaml:"vip,omitempty"`
-	Mtu     uint     `yaml:"mtu,omitempty"`
-	Subnets []string `yaml:"subnets,omitempty"`
-}
-
-type Config struct {
-	Id      string `yaml:"id,omitempty"`
-	Port    uint   `yaml:"port,omitempty"`
-	Mode    MODE   `yaml:"mode,omitempty"`
-	Server  string `yaml:"server,omitempty"`
-	Dev     Device `yaml:"dev,omitempty"`
-	Version string `yaml:"version"`
-	PriKey  string `yaml:"priKey,omitempty"`
-	PubKey  string `yaml:"pubKey,omitempty"`
-}
-
 // initCmd represents the init command
 var (
 	initCmd = &cobra.Command{
@@ -69,7 +45,7 @@ var (
 					return
 				}
 			}
-			config := Config{}
+			config := gvn.Config{}
 			parseConfig(*cmd, &config)
 			if vip, err := yaml.Marshal(config); err == nil {
 				if _, err := os.Stat(filepath.Dir(viper.ConfigFileUsed())); err != nil {
@@ -102,30 +78,55 @@ func init() {
 	initCmd.Flags().StringP("devname", "", "", "the TUN device name, recommend using utun[\\d] for cross platform, utun3 for example")
 	initCmd.Flags().StringP("subnets", "", "", "the subnets traffice through this node")
 	initCmd.Flags().UintP("mtu", "", 1500, "the MUT will be used in TUN device")
+	initCmd.Flags().StringP("keyfile", "", "", "write the private key to the file rather than the config file")
+	initCmd.Flags().StringP("keytype", "", "ed25519", "the private key type, one of ed25519, rsa, secp256k1 and ecdsa")
+	initCmd.Flags().BoolP("encrypt", "e", false, "encrypt the private key with a passphrase")
 	// availabe in server mode
 	initCmd.Flags().StringP("vip", "", "192.168.1.1/24", "the CIDR subnet used in server, all clients in the same subnet with a fake DHCP")
 }
 
 // parse the config object
-func parseConfig(cmd cobra.Command, config *Config) {
-	var dev Device
-	host, err := libp2p.New()
+func parseConfig(cmd cobra.Command, config *gvn.Config) {
+	var dev gvn.Device
+	keyType, _ := cmd.Flags().GetString("keytype")
+	key, err := generateKey(keyType, 2048)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
 		}).Error("Create new peer config file error")
 		return
 	}
-	config.Id = host.ID().Pretty()
-	if priKey, err := crypto.MarshalPrivateKey(host.Peerstore().PrivKey(host.ID())); err == nil {
-		pubKey, _ := crypto.MarshalPublicKey(host.Peerstore().PubKey(host.ID()))
+	id, _ := peer.IDFromPrivateKey(key)
+	config.Id = id.Pretty()
+	encrypt, _ := cmd.Flags().GetBool("encrypt")
+	data, err := marshalKey(key, encrypt)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+		}).Error("Marshal private key error")
+		fmt.Fprintf(os.Stderr, "Marshal private key error: %s\n", err)
+		return
+	}
+	if keyFile, _ := cmd.Flags().GetString("keyfile"); keyFile != "" {
+		keyFile, _ = filepath.Abs(keyFile)
+		if err := writeKeyFile(keyFile, data); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"File":  keyFile,
+			}).Error("Write private key file error")
+			return
+		}
+		config.KeyFile = keyFile
+	} else {
 		// TODO: !!binary leading ?
-		config.PriKey = string(priKey)
+		config.PriKey = string(data)
+	}
+	if pubKey, err := crypto.MarshalPublicKey(key.GetPublic()); err == nil {
 		config.PubKey = string(pubKey)
 	}
-	config.Mode = MODECLIENT
+	config.Mode = gvn.MODECLIENT
 	if server, _ := cmd.Flags().GetBool("server"); server {
-		config.Mode = MODESERVER
+		config.Mode = gvn.MODESERVER
 		vip, _ := cmd.Flags().GetString("vip")
 		dev.Vip = vip
 	} else {
@@ -141,7 +142,7 @@ func parseConfig(cmd cobra.Command, config *Config) {
 	if mtu, err := cmd.Flags().GetUint("mtu"); err == nil {
 		dev.Mtu = mtu
 	}
-	if subnets, err := cmd.Flags().GetString("subnets"); err == nil {
+	if subnets, err := cmd.Flags().GetString("subnets"); err == nil && subnets != "" {
 		dev.Subnets = append(dev.Subnets, strings.Split(subnets, ",")...)
 	}
 	if version, err := cmd.Flags().GetString("version"); err == nil {
@@ -0,0 +1,124 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/liloew/gvn/dhcp"
+	"github.com/liloew/gvn/gvn"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var inviteCmd = &cobra.Command{
+	Use:   "invite",
+	Short: "generate invite token",
+	Long:  `Generate a signed and expiring invite token in server mode, the token is used by gvn join`,
+	Run: func(cmd *cobra.Command, args []string) {
+		config := gvn.Config{}
+		if err := viper.Unmarshal(&config); err != nil {
+			fmt.Fprintf(os.Stderr, "Unmarshal config file error: %s\n", err)
+			os.Exit(1)
+		}
+		// the token is of the network in server mode if the networks listed, the first one unless named
+		name, _ := cmd.Flags().GetString("network")
+		for _, network := range config.Networks {
+			if network.Mode == gvn.MODESERVER && (name == "" || network.Name == name) {
+				config = network
+				break
+			}
+		}
+		if config.Mode != gvn.MODESERVER {
+			fmt.Fprintln(os.Stderr, "Invite token can only be generated in server mode")
+			os.Exit(1)
+		}
+		priKey, err := loadPrivateKey(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Load private key error: %s\n", err)
+			os.Exit(1)
+		}
+		key, err := crypto.UnmarshalPrivateKey([]byte(priKey))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unmarshal private key error: %s\n", err)
+			os.Exit(1)
+		}
+		addrs, _ := cmd.Flags().GetStringSlice("addrs")
+		if len(addrs) == 0 {
+			addrs = localAddrs(config.Port)
+		}
+		for i, addr := range addrs {
+			if addrs[i], err = inviteAddr(addr, config.Id); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid address %s: %s\n", addr, err)
+				os.Exit(1)
+			}
+		}
+		uses, _ := cmd.Flags().GetInt("uses")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		token, err := dhcp.NewInvite(key, addrs, config.Version, config.Network, int(config.Dev.Mtu), uses, ttl)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Generate invite token error: %s\n", err)
+			os.Exit(1)
+		}
+		logrus.WithFields(logrus.Fields{
+			"Addrs": addrs,
+			"Uses":  uses,
+			"TTL":   ttl,
+		}).Info("Generate invite token")
+		fmt.Println(token)
+	},
+}
+
+// inviteAddr appends the server id to addr unless it's there already
+func inviteAddr(addr string, id string) (string, error) {
+	maddr, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if value, err := maddr.ValueForProtocol(multiaddr.P_P2P); err == nil {
+		if value != id {
+			return "", fmt.Errorf("not the address of server %s", id)
+		}
+		return addr, nil
+	}
+	return fmt.Sprintf("%s/p2p/%s", addr, id), nil
+}
+
+func init() {
+	rootCmd.AddCommand(inviteCmd)
+	inviteCmd.Flags().IntP("uses", "u", 1, "how many peers can join with the token")
+	inviteCmd.Flags().DurationP("ttl", "t", 24*time.Hour, "the token expires after ttl")
+	inviteCmd.Flags().StringP("network", "n", "", "the network in server mode the token is of (default the first one)")
+	inviteCmd.Flags().StringSliceP("addrs", "a", nil, "the server multiaddrs reachable by peers, /ip4/1.2.3.4/tcp/6543 for example (default all the local IPv4 addresses)")
+}
+
+// the multiaddrs of all the local IPv4 addresses
+func localAddrs(port uint) []string {
+	addrs := make([]string, 0)
+	networks, _ := net.InterfaceAddrs()
+	for _, network := range networks {
+		if ipNet, ok := network.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			addrs = append(addrs, fmt.Sprintf("/ip4/%s/tcp/%d", ipNet.IP, port))
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/liloew/gvn/dhcp"
+	"github.com/liloew/gvn/gvn"
+	"github.com/liloew/gvn/p2p"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+var joinCmd = &cobra.Command{
+	Use:   "join <token>",
+	Short: "join the network with invite token",
+	Long:  `Generate the client config file and enroll with the server using the invite token from gvn invite`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := os.Stat(viper.ConfigFileUsed()); err == nil {
+			if force, _ := cmd.Flags().GetBool("force"); !force {
+				fmt.Fprintf(os.Stderr, "File exists, use --force to overide: %s\n", viper.ConfigFileUsed())
+				os.Exit(1)
+			}
+		}
+		invite, err := dhcp.ParseInvite(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Parse invite token error: %s\n", err)
+			os.Exit(1)
+		}
+		if time.Now().Unix() > invite.ExpireAt {
+			fmt.Fprintf(os.Stderr, "Invite token expired at %s\n", time.Unix(invite.ExpireAt, 0))
+			os.Exit(1)
+		}
+
+		keyType, _ := cmd.Flags().GetString("keytype")
+		key, err := generateKey(keyType, 2048)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Generate private key error: %s\n", err)
+			os.Exit(1)
+		}
+		id, _ := peer.IDFromPrivateKey(key)
+		config := gvn.Config{
+			Id:      id.Pretty(),
+			Mode:    gvn.MODECLIENT,
+			Version: invite.Version,
+			Network: invite.Network,
+			Dev: gvn.Device{
+				Mtu: uint(invite.Mtu),
+			},
+		}
+		config.Port, _ = cmd.Flags().GetUint("port")
+		config.Dev.Name, _ = cmd.Flags().GetString("devname")
+		if subnets, _ := cmd.Flags().GetString("subnets"); subnets != "" {
+			config.Dev.Subnets = strings.Split(subnets, ",")
+		}
+
+		var psk pnet.PSK
+		if pskFile, _ := cmd.Flags().GetString("pskfile"); pskFile != "" {
+			config.PskFile, _ = filepath.Abs(pskFile)
+			if psk, err = loadPSK(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Load pre-shared key error: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		// enroll before writing anything
+		res, server, err := enroll(key, psk, invite, dhcp.Request{
+			Id:      config.Id,
+			Name:    config.Dev.Name,
+			Subnets: config.Dev.Subnets,
+			Token:   args[0],
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Enroll with server error: %s\n", err)
+			os.Exit(1)
+		}
+		config.Server = server
+
+		encrypt, _ := cmd.Flags().GetBool("encrypt")
+		data, err := marshalKey(key, encrypt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Marshal private key error: %s\n", err)
+			os.Exit(1)
+		}
+		if keyFile, _ := cmd.Flags().GetString("keyfile"); keyFile != "" {
+			keyFile, _ = filepath.Abs(keyFile)
+			if err := writeKeyFile(keyFile, data); err != nil {
+				fmt.Fprintf(os.Stderr, "Write private key file error: %s\n", err)
+				os.Exit(1)
+			}
+			config.KeyFile = keyFile
+		} else {
+			config.PriKey = string(data)
+		}
+		if pubKey, err := crypto.MarshalPublicKey(key.GetPublic()); err == nil {
+			config.PubKey = string(pubKey)
+		}
+		if dir := filepath.Dir(viper.ConfigFileUsed()); dir != "" {
+			os.MkdirAll(dir, 0700)
+		}
+		if err := writeConfigFile(viper.ConfigFileUsed(), config); err != nil {
+			fmt.Fprintf(os.Stderr, "Write config file error: %s\n", err)
+			os.Exit(1)
+		}
+		logrus.WithFields(logrus.Fields{
+			"File":   viper.ConfigFileUsed(),
+			"ID":     config.Id,
+			"VIP":    res.Ip,
+			"Server": server,
+		}).Info("Join network successful")
+		fmt.Fprintf(os.Stderr, "Join network successful, VIP %s, config file: %s\n", res.Ip, viper.ConfigFileUsed())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(joinCmd)
+	joinCmd.Flags().BoolP("force", "f", false, "force overide the file")
+	joinCmd.Flags().UintP("port", "", 0, "the port listen on, random if 0")
+	joinCmd.Flags().StringP("devname", "", "", "the TUN device name, recommend using utun[\\d] for cross platform, utun3 for example")
+	joinCmd.Flags().StringP("subnets", "", "", "the subnets traffice through this node")
+	joinCmd.Flags().StringP("keyfile", "", "", "write the private key to the file rather than the config file")
+	joinCmd.Flags().StringP("keytype", "", "ed25519", "the private key type, one of ed25519, rsa, secp256k1 and ecdsa")
+	joinCmd.Flags().BoolP("encrypt", "e", false, "encrypt the private key with a passphrase")
+	joinCmd.Flags().StringP("pskfile", "", "", "the pre-shared key file of the private network, copied from the server")
+}
+
+// connect to the first reachable server address and request DHCP with the token
+func enroll(key crypto.PrivKey, psk pnet.PSK, invite dhcp.Invite, req dhcp.Request) (dhcp.Response, string, error) {
+	var res dhcp.Response
+	buff, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return res, "", err
+	}
+	host, err := p2p.NewPeer(string(buff), 0, psk)
+	if err != nil {
+		return res, "", err
+	}
+	defer host.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, addr := range invite.Addrs {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			continue
+		}
+		if err := host.Connect(ctx, *info); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"Addr":  addr,
+			}).Debug("Connect to server error")
+			continue
+		}
+		zones := []string{p2p.RPC_PROTOCOL_ID, fmt.Sprintf("/rpc/%s", invite.Version)}
+		if err := dhcp.CallAny(ctx, host, zones, info.ID, "DHCPService", "DHCP", req, &res); err != nil {
+			return res, "", err
+		}
+		return res, addr, nil
+	}
+	return res, "", fmt.Errorf("none of the server addresses is reachable: %s", strings.Join(invite.Addrs, ", "))
+}
+
+// rewrite the config file and keep its permission
+func writeConfigFile(filename string, config gvn.Config) error {
+	buff, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return os.WriteFile(filename, buff, perm)
+}
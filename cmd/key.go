@@ -0,0 +1,321 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/liloew/gvn/gvn"
+	"github.com/liloew/gvn/keystore"
+	"github.com/liloew/gvn/p2p"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// the passphrase of the existing private key
+	PASSPHRASE_ENV = "GVN_PASSPHRASE"
+	// the new passphrase used by key passwd
+	NEW_PASSPHRASE_ENV = "GVN_NEW_PASSPHRASE"
+)
+
+var (
+	keyCmd = &cobra.Command{
+		Use:   "key",
+		Short: "manage gvn private key",
+		Long:  `Manage the private key referenced by keyFile or priKey in gvn.yaml`,
+	}
+	passwdCmd = &cobra.Command{
+		Use:   "passwd",
+		Short: "change the passphrase of private key",
+		Long:  `Change, set or remove the passphrase of the private key in keyFile or priKey`,
+		Run: func(cmd *cobra.Command, args []string) {
+			config := gvn.Config{}
+			if err := viper.Unmarshal(&config); err != nil {
+				fmt.Fprintf(os.Stderr, "Unmarshal config file error: %s\n", err)
+				os.Exit(1)
+			}
+			// the key is of the network listed, the first one unless named
+			name, _ := cmd.Flags().GetString("network")
+			index := -1
+			for i, network := range gvn.Networks(config) {
+				if name == "" || network.Name == name {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				fmt.Fprintf(os.Stderr, "Network not found: %s\n", name)
+				os.Exit(1)
+			}
+			network := gvn.Networks(config)[index]
+			plain, err := loadPrivateKey(network)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Load private key error: %s\n", err)
+				os.Exit(1)
+			}
+			data := []byte(plain)
+			if remove, _ := cmd.Flags().GetBool("remove"); !remove {
+				passphrase, err := newPassphrase(false)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Read new passphrase error: %s\n", err)
+					os.Exit(1)
+				}
+				if data, err = keystore.Encrypt(data, passphrase); err != nil {
+					fmt.Fprintf(os.Stderr, "Encrypt private key error: %s\n", err)
+					os.Exit(1)
+				}
+			}
+			if network.KeyFile != "" {
+				err = writeKeyFile(resolvePath(network.KeyFile), data)
+			} else {
+				err = writePriKey(viper.ConfigFileUsed(), index, string(data))
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Write private key error: %s\n", err)
+				os.Exit(1)
+			}
+			logrus.WithFields(logrus.Fields{
+				"File":    viper.ConfigFileUsed(),
+				"Network": network.Name,
+			}).Info("Change passphrase successful")
+			fmt.Fprintln(os.Stderr, "Change passphrase successful")
+		},
+	}
+	passphraseFd int
+)
+
+var pskCmd = &cobra.Command{
+	Use:   "psk",
+	Short: "generate the pre-shared key of private network",
+	Long:  `Generate the pre-shared key file referenced by pskFile in gvn.yaml, all the nodes of the network must use the same one`,
+	Run: func(cmd *cobra.Command, args []string) {
+		out, _ := cmd.Flags().GetString("out")
+		if out == "" {
+			out = filepath.Join(filepath.Dir(viper.ConfigFileUsed()), "swarm.key")
+		}
+		out, _ = filepath.Abs(out)
+		if _, err := os.Stat(out); err == nil {
+			if force, _ := cmd.Flags().GetBool("force"); !force {
+				fmt.Fprintf(os.Stderr, "File exists, use --force to overide: %s\n", out)
+				os.Exit(1)
+			}
+		}
+		psk, err := p2p.GeneratePSK()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Generate pre-shared key error: %s\n", err)
+			os.Exit(1)
+		}
+		if err := writeKeyFile(out, psk); err != nil {
+			fmt.Fprintf(os.Stderr, "Write pre-shared key file error: %s\n", err)
+			os.Exit(1)
+		}
+		logrus.WithFields(logrus.Fields{
+			"File": out,
+		}).Info("Generate pre-shared key file successful")
+		fmt.Fprintf(os.Stderr, "Generate pre-shared key file successful: %s\nCopy it to all the nodes and put the following line in gvn.yaml:\npskFile: %s\n", out, out)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keyCmd)
+	keyCmd.AddCommand(passwdCmd)
+	keyCmd.AddCommand(pskCmd)
+	pskCmd.Flags().BoolP("force", "f", false, "force overide the file")
+	pskCmd.Flags().StringP("out", "o", "", "the pre-shared key file (default is swarm.key beside the config file)")
+	passwdCmd.Flags().StringP("network", "n", "", "the network listed the private key is of (default the first one)")
+	passwdCmd.Flags().BoolP("remove", "", false, "remove the passphrase and store the private key in plain")
+	rootCmd.PersistentFlags().IntVarP(&passphraseFd, "passphrase-fd", "", -1, "read the private key passphrase from the file descriptor rather than "+PASSPHRASE_ENV+" or terminal")
+}
+
+// marshal the private key and encrypt it with a new passphrase if required
+func marshalKey(priKey crypto.PrivKey, encrypt bool) ([]byte, error) {
+	buff, err := crypto.MarshalPrivateKey(priKey)
+	if err != nil || !encrypt {
+		return buff, err
+	}
+	passphrase, err := newPassphrase(true)
+	if err != nil {
+		return nil, err
+	}
+	return keystore.Encrypt(buff, passphrase)
+}
+
+// read the passphrase of the existing private key from fd, environment or terminal
+func currentPassphrase() ([]byte, error) {
+	if passphrase, ok, err := passphraseFromFdOrEnv(); ok || err != nil {
+		return passphrase, err
+	}
+	return readTerminal("Enter passphrase for private key: ")
+}
+
+// read a new passphrase, the sources of current passphrase are available if reuse is set
+func newPassphrase(reuse bool) ([]byte, error) {
+	if env, ok := os.LookupEnv(NEW_PASSPHRASE_ENV); ok {
+		addSecret(env)
+		return []byte(env), nil
+	}
+	if reuse {
+		if passphrase, ok, err := passphraseFromFdOrEnv(); ok || err != nil {
+			return passphrase, err
+		}
+	}
+	passphrase, err := readTerminal("Enter new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := readTerminal("Enter same passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, errors.New("passphrases do not match")
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase, use key passwd --remove to store the key in plain")
+	}
+	return passphrase, nil
+}
+
+// the passphrase from fd or environment, read once and reused by all the keys of the run since the fd is closed and
+// the environment unset after read
+var passphraseCache struct {
+	once       sync.Once
+	passphrase []byte
+	ok         bool
+	err        error
+}
+
+func passphraseFromFdOrEnv() ([]byte, bool, error) {
+	passphraseCache.once.Do(func() {
+		passphraseCache.passphrase, passphraseCache.ok, passphraseCache.err = readPassphraseFromFdOrEnv()
+	})
+	return passphraseCache.passphrase, passphraseCache.ok, passphraseCache.err
+}
+
+func readPassphraseFromFdOrEnv() ([]byte, bool, error) {
+	if passphraseFd >= 0 {
+		file := os.NewFile(uintptr(passphraseFd), "passphrase")
+		if file == nil {
+			return nil, true, fmt.Errorf("invalid passphrase fd %d", passphraseFd)
+		}
+		line, err := bufio.NewReader(file).ReadString('\n')
+		file.Close()
+		if err != nil && line == "" {
+			return nil, true, fmt.Errorf("read passphrase from fd %d error: %s", passphraseFd, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		addSecret(line)
+		return []byte(line), true, nil
+	}
+	if env, ok := os.LookupEnv(PASSPHRASE_ENV); ok {
+		// avoid leaking to the scripts executed later
+		os.Unsetenv(PASSPHRASE_ENV)
+		addSecret(env)
+		return []byte(env), true, nil
+	}
+	return nil, false, nil
+}
+
+func readTerminal(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no terminal to read passphrase, set %s or use --passphrase-fd", PASSPHRASE_ENV)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	addSecret(string(passphrase))
+	return passphrase, nil
+}
+
+// read the pre-shared key from pskFile, nil if not a private network
+func loadPSK(config gvn.Config) (pnet.PSK, error) {
+	if config.PskFile == "" {
+		return nil, nil
+	}
+	return p2p.LoadPSK(resolvePath(config.PskFile))
+}
+
+// replace the priKey of the config file, or of the index-th network if listed, the comments, order and other keys are
+// kept as is
+func writePriKey(filename string, index int, priKey string) error {
+	buff, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(buff, &doc); err != nil {
+		return err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("not a mapping: %s", filename)
+	}
+	node := doc.Content[0]
+	if networks := mappingValue(node, "networks"); networks != nil {
+		if networks.Kind != yaml.SequenceNode || index >= len(networks.Content) || networks.Content[index].Kind != yaml.MappingNode {
+			return fmt.Errorf("network %d not found: %s", index, filename)
+		}
+		node = networks.Content[index]
+	}
+	if value := mappingValue(node, "priKey"); value != nil {
+		value.SetString(priKey)
+	} else {
+		key, value := &yaml.Node{}, &yaml.Node{}
+		key.SetString("priKey")
+		value.SetString(priKey)
+		node.Content = append(node.Content, key, value)
+	}
+	out := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return os.WriteFile(filename, out.Bytes(), perm)
+}
+
+// the value of key in the mapping node, nil if absent
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/gvn"
+	"github.com/liloew/gvn/keystore"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	KEYFILE_PERM = 0600
+)
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "generate gvn private key file",
+	Long:  `Generate the private key file referenced by keyFile in gvn.yaml`,
+	Run: func(cmd *cobra.Command, args []string) {
+		out, _ := cmd.Flags().GetString("out")
+		if out == "" {
+			out = filepath.Join(filepath.Dir(viper.ConfigFileUsed()), "gvn.key")
+		}
+		out, _ = filepath.Abs(out)
+		if _, err := os.Stat(out); err == nil {
+			if force, _ := cmd.Flags().GetBool("force"); !force {
+				logrus.WithFields(logrus.Fields{
+					"File": out,
+				}).Error("File Exists and doesn't write forcely")
+				fmt.Fprintf(os.Stderr, "File exists, use --force to overide: %s\n", out)
+				os.Exit(1)
+			}
+		}
+		typ, _ := cmd.Flags().GetString("type")
+		bits, _ := cmd.Flags().GetInt("bits")
+		priKey, err := generateKey(typ, bits)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Generate private key error: %s\n", err)
+			os.Exit(1)
+		}
+		encrypt, _ := cmd.Flags().GetBool("encrypt")
+		data, err := marshalKey(priKey, encrypt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Marshal private key error: %s\n", err)
+			os.Exit(1)
+		}
+		if err := writeKeyFile(out, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Write private key file error: %s\n", err)
+			os.Exit(1)
+		}
+		id, _ := peer.IDFromPrivateKey(priKey)
+		logrus.WithFields(logrus.Fields{
+			"File": out,
+			"ID":   id.Pretty(),
+		}).Info("Generate private key file successful")
+		fmt.Fprintf(os.Stderr, "Generate private key file successful: %s\nPut the following lines in gvn.yaml:\nid: %s\nkeyFile: %s\n", out, id.Pretty(), out)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+	keygenCmd.Flags().BoolP("force", "f", false, "force overide the file")
+	keygenCmd.Flags().StringP("out", "o", "", "the private key file (default is gvn.key beside the config file)")
+	keygenCmd.Flags().StringP("type", "t", "ed25519", "the key type, one of ed25519, rsa, secp256k1 and ecdsa")
+	keygenCmd.Flags().IntP("bits", "b", 2048, "the key size, only available for rsa")
+	keygenCmd.Flags().BoolP("encrypt", "e", false, "encrypt the private key with a passphrase")
+}
+
+func generateKey(typ string, bits int) (crypto.PrivKey, error) {
+	var t int
+	switch strings.ToLower(typ) {
+	case "", "ed25519":
+		t = crypto.Ed25519
+	case "rsa":
+		t = crypto.RSA
+	case "secp256k1":
+		t = crypto.Secp256k1
+	case "ecdsa":
+		t = crypto.ECDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", typ)
+	}
+	priKey, _, err := crypto.GenerateKeyPair(t, bits)
+	return priKey, err
+}
+
+func writeKeyFile(filename string, buff []byte) error {
+	if dir := filepath.Dir(filename); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filename, buff, KEYFILE_PERM); err != nil {
+		return err
+	}
+	// WriteFile doesn't change the permission of an existing file
+	return os.Chmod(filename, KEYFILE_PERM)
+}
+
+// read the private key from keyFile or the inline priKey, which may be encrypted
+func readKey(config gvn.Config) ([]byte, error) {
+	if config.KeyFile == "" {
+		if config.PriKey == "" {
+			return nil, fmt.Errorf("neither keyFile nor priKey is set")
+		}
+		return []byte(config.PriKey), nil
+	}
+	return keystore.ReadFile(resolvePath(config.KeyFile))
+}
+
+// load the marshaled private key and decrypt it if required
+func loadPrivateKey(config gvn.Config) (string, error) {
+	data, err := readKey(config)
+	if err != nil {
+		return "", err
+	}
+	if keystore.IsEncrypted(data) {
+		passphrase, err := currentPassphrase()
+		if err != nil {
+			return "", err
+		}
+		if data, err = keystore.Decrypt(data, passphrase); err != nil {
+			return "", err
+		}
+	}
+	addSecret(string(data))
+	return string(data), nil
+}
+
+// the relative path is relative to the config file
+func resolvePath(filename string) string {
+	if filename == "" || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(filepath.Dir(viper.ConfigFileUsed()), filename)
+}
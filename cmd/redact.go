@@ -0,0 +1,91 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/liloew/gvn/internal/strslice"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	REDACTED = "[REDACTED]"
+	// the shorter secrets are not redacted as substrings, which would mangle every log containing the common words
+	MIN_SECRET_LEN = 8
+)
+
+var (
+	secrets   = make([]string, 0)
+	secretsMu sync.RWMutex
+	// the fields always be redacted whatever the value is
+	sensitiveFields = []string{"prikey", "privatekey", "keyfilecontent", "passphrase"}
+)
+
+// redactHook removes the key material from every log entry
+type redactHook struct {
+}
+
+func (h *redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redact(entry.Message)
+	for k, v := range entry.Data {
+		if strslice.Contains(sensitiveFields, strings.ToLower(k)) {
+			entry.Data[k] = REDACTED
+			continue
+		}
+		switch value := v.(type) {
+		case string:
+			entry.Data[k] = redact(value)
+		case error:
+			if s := redact(value.Error()); s != value.Error() {
+				entry.Data[k] = s
+			}
+		case []byte:
+			entry.Data[k] = redact(string(value))
+		default:
+			if s := fmt.Sprintf("%+v", value); redact(s) != s {
+				entry.Data[k] = redact(s)
+			}
+		}
+	}
+	return nil
+}
+
+// addSecret registers the key material which must not appear in logs, the short ones are redacted by field name only
+func addSecret(secret string) {
+	if len(secret) < MIN_SECRET_LEN {
+		return
+	}
+	secretsMu.Lock()
+	secrets = append(secrets, secret, base64.StdEncoding.EncodeToString([]byte(secret)))
+	secretsMu.Unlock()
+}
+
+func redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, REDACTED)
+	}
+	return s
+}
@@ -81,6 +81,7 @@ func initConfig() {
 	} else {
 		logrus.SetOutput(file)
 	}
+	logrus.AddHook(&redactHook{})
 	if debug, _ := rootCmd.Flags().GetBool("debug"); debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
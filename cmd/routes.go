@@ -0,0 +1,300 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/control"
+	"github.com/liloew/gvn/route"
+	"github.com/spf13/cobra"
+)
+
+// the source of the routes found in the kernel only
+const SOURCE_KERNEL route.Source = "kernel"
+
+// RouteInfo is a route with its state in the kernel
+type RouteInfo struct {
+	route.Entry
+	// whether the kernel routes the subnet via gvn, nil if unknown
+	Installed *bool `json:"installed,omitempty"`
+}
+
+// RouteParams are the params of the route methods of the control socket
+type RouteParams struct {
+	Ip     string `json:"ip,omitempty"`
+	Subnet string `json:"subnet,omitempty"`
+	// peer id or name
+	Peer   string `json:"peer,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+	// the first network if empty
+	Network string `json:"network,omitempty"`
+}
+
+var (
+	routesCmd = &cobra.Command{
+		Use:   "routes",
+		Short: "manage the routes",
+		Long:  `Show and change the overlay routes of the running gvn`,
+	}
+	routesListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "list the routes",
+		Long:  `List the routes with their owners and whether the kernel routes them via gvn`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var routes []RouteInfo
+			callControl("routes.list", RouteParams{Network: routesNetwork(cmd)}, &routes)
+			printRoutes(cmd, routes)
+		},
+	}
+	routesGetCmd = &cobra.Command{
+		Use:   "get <ip>",
+		Short: "show the route of the ip",
+		Long:  `Show the route used to forward the packets to the ip`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var info RouteInfo
+			callControl("routes.get", RouteParams{Ip: args[0], Network: routesNetwork(cmd)}, &info)
+			printRoutes(cmd, []RouteInfo{info})
+		},
+	}
+	routesAddCmd = &cobra.Command{
+		Use:   "add <subnet> <peer>",
+		Short: "add a static route",
+		Long:  `Route the subnet via the peer given by id or name until gvn restarts`,
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			metric, _ := cmd.Flags().GetInt("metric")
+			callControl("routes.add", RouteParams{Subnet: args[0], Peer: args[1], Metric: metric, Network: routesNetwork(cmd)}, nil)
+		},
+	}
+	routesDelCmd = &cobra.Command{
+		Use:   "del <subnet> [peer]",
+		Short: "delete the static routes",
+		Long:  `Delete the static routes of the subnet, via the peer only if given`,
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			params := RouteParams{Subnet: args[0], Network: routesNetwork(cmd)}
+			if len(args) > 1 {
+				params.Peer = args[1]
+			}
+			callControl("routes.del", params, nil)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(routesCmd)
+	routesCmd.AddCommand(routesListCmd, routesGetCmd, routesAddCmd, routesDelCmd)
+	routesCmd.PersistentFlags().StringP("network", "n", "", "the network of the routes (default the first one)")
+	routesListCmd.Flags().BoolP("json", "", false, "print the routes in json")
+	routesGetCmd.Flags().BoolP("json", "", false, "print the route in json")
+	routesAddCmd.Flags().IntP("metric", "m", 0, "the route with the lowest metric is preferred")
+}
+
+func routesNetwork(cmd *cobra.Command) string {
+	network, _ := cmd.Flags().GetString("network")
+	return network
+}
+
+func callControl(method string, params interface{}, result interface{}) {
+	if err := control.Call(controlSocket(), method, params, result); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func printRoutes(cmd *cobra.Command, routes []RouteInfo) {
+	if asJson, _ := cmd.Flags().GetBool("json"); asJson {
+		buff, _ := json.MarshalIndent(routes, "", "  ")
+		fmt.Println(string(buff))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PREFIX\tPEER\tNAME\tSOURCE\tMETRIC\tSTATE\tEXPIRES\tKERNEL")
+	for _, r := range routes {
+		peer, name, state, expires, kernel := r.Peer, r.Name, string(r.State), "never", "unknown"
+		if peer == "" {
+			peer = "-"
+		}
+		if name == "" {
+			name = "-"
+		}
+		if state == "" {
+			state = "-"
+		}
+		if !r.Expires.IsZero() {
+			expires = time.Until(r.Expires).Round(time.Second).String()
+		}
+		if r.Installed != nil {
+			kernel = "no"
+			if *r.Installed {
+				kernel = "yes"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", r.Subnet, peer, name, r.Source, r.Metric, state, expires, kernel)
+	}
+	w.Flush()
+}
+
+// handleRoutes serves the route methods on the control socket, the route table is found by the network name
+func handleRoutes(server *control.Server, tables func(name string) (*route.RouteTable, error)) {
+	server.Handle("routes.list", func(params json.RawMessage) (interface{}, error) {
+		_, routes, err := routeParams(params, tables)
+		if err != nil {
+			return nil, err
+		}
+		return routeInfos(routes), nil
+	})
+	server.Handle("routes.get", func(params json.RawMessage) (interface{}, error) {
+		p, routes, err := routeParams(params, tables)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(p.Ip).To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %s", p.Ip)
+		}
+		entry, found := routes.Get(p.Ip)
+		if !found {
+			return nil, fmt.Errorf("no route to %s", p.Ip)
+		}
+		for _, info := range routeInfos(routes) {
+			if info.Subnet == entry.Subnet && info.Peer == entry.Peer {
+				return info, nil
+			}
+		}
+		return RouteInfo{Entry: entry}, nil
+	})
+	server.Handle("routes.add", func(params json.RawMessage) (interface{}, error) {
+		p, routes, err := routeParams(params, tables)
+		if err != nil {
+			return nil, err
+		}
+		id, name, err := resolvePeer(routes, p.Peer)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range routes.Entries() {
+			if e.Subnet == canonicalSubnet(p.Subnet) && e.Peer == id && e.Source != route.SourceStatic {
+				return nil, fmt.Errorf("%s is routed via %s by %s already", e.Subnet, p.Peer, e.Source)
+			}
+		}
+		return nil, routes.Add(route.Entry{Subnet: p.Subnet, Peer: id, Name: name, Source: route.SourceStatic, Metric: p.Metric})
+	})
+	server.Handle("routes.del", func(params json.RawMessage) (interface{}, error) {
+		p, routes, err := routeParams(params, tables)
+		if err != nil {
+			return nil, err
+		}
+		id := ""
+		if p.Peer != "" {
+			var err error
+			if id, _, err = resolvePeer(routes, p.Peer); err != nil {
+				return nil, err
+			}
+		}
+		removed := 0
+		for _, e := range routes.Entries() {
+			if e.Subnet != canonicalSubnet(p.Subnet) || (id != "" && e.Peer != id) {
+				continue
+			}
+			if e.Source != route.SourceStatic {
+				if id != "" {
+					return nil, fmt.Errorf("the route via %s is added by %s, change the subnets of the peer instead", p.Peer, e.Source)
+				}
+				continue
+			}
+			if routes.Remove(e.Subnet, e.Peer) {
+				removed++
+			}
+		}
+		if removed == 0 {
+			return nil, fmt.Errorf("no static route of %s", p.Subnet)
+		}
+		return nil, nil
+	})
+}
+
+// the params and the route table of the network named by them
+func routeParams(params json.RawMessage, tables func(name string) (*route.RouteTable, error)) (RouteParams, *route.RouteTable, error) {
+	var p RouteParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return p, nil, err
+		}
+	}
+	routes, err := tables(p.Network)
+	return p, routes, err
+}
+
+// the routes with their state in the kernel, followed by the ones found in the kernel only
+func routeInfos(routes *route.RouteTable) []RouteInfo {
+	entries := routes.Entries()
+	infos := make([]RouteInfo, 0, len(entries))
+	installed, err := routes.Installed()
+	kernel := map[string]bool{}
+	for _, subnet := range installed {
+		kernel[subnet] = true
+	}
+	known := map[string]bool{}
+	for _, e := range entries {
+		info := RouteInfo{Entry: e}
+		if err == nil {
+			ok := kernel[e.Subnet]
+			info.Installed = &ok
+		}
+		known[e.Subnet] = true
+		infos = append(infos, info)
+	}
+	for _, subnet := range installed {
+		if !known[subnet] {
+			ok := true
+			infos = append(infos, RouteInfo{Entry: route.Entry{Subnet: subnet, Source: SOURCE_KERNEL}, Installed: &ok})
+		}
+	}
+	return infos
+}
+
+// the peer id and name of the peer given by id or name
+func resolvePeer(routes *route.RouteTable, p string) (string, string, error) {
+	if p == "" {
+		return "", "", errors.New("peer required")
+	}
+	for _, e := range routes.Entries() {
+		if e.Name == p || e.Peer == p {
+			return e.Peer, e.Name, nil
+		}
+	}
+	if _, err := peer.Decode(p); err != nil {
+		return "", "", fmt.Errorf("unknown peer %s", p)
+	}
+	return p, "", nil
+}
+
+func canonicalSubnet(subnet string) string {
+	if _, network, err := net.ParseCIDR(subnet); err == nil {
+		return network.String()
+	}
+	return subnet
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/liloew/gvn/gvn"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// seconds between the status file updates
+	STATUS_INTERVAL = 5
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show gvn status",
+	Long:  `Show the peers and the traffic of the running gvn`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("network")
+		if name == "" {
+			config := gvn.Config{}
+			if err := viper.Unmarshal(&config); err == nil {
+				name = gvn.Networks(config)[0].Name
+			}
+		}
+		buff, err := os.ReadFile(statusFile(name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Read status error, is gvn running? %s\n", err)
+			os.Exit(1)
+		}
+		var status gvn.Status
+		if err := json.Unmarshal(buff, &status); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid status file %s: %s\n", statusFile(name), err)
+			os.Exit(1)
+		}
+		if asJson, _ := cmd.Flags().GetBool("json"); asJson {
+			fmt.Println(string(buff))
+			return
+		}
+		if status.Network != "" {
+			fmt.Printf("Network: %s\n", status.Network)
+		}
+		fmt.Printf("ID:      %s\nVIP:     %s\nMTU:     %d\nUpdated: %s\n\n", status.Id, status.Vip, status.Mtu, status.UpdatedAt.Format(time.RFC3339))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PEER\tSTATE\tCOMPRESSION\tTX PACKETS\tTX BYTES\tTX RATIO\tRX PACKETS\tRX BYTES\tRX RATIO")
+		for _, s := range status.Peers {
+			state, compression := "offline", "off"
+			if s.Online {
+				state = "online"
+			}
+			if s.Compression {
+				compression = "on"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%.2f\t%d\t%d\t%.2f\n", s.Peer, state, compression, s.TxPackets, s.TxBytes, s.TxRatio(), s.RxPackets, s.RxBytes, s.RxRatio())
+		}
+		w.Flush()
+		fmt.Printf("\nQoS: %d queued, %d dropped larger than the burst, %d dropped by full queue\n", status.Qos.Queued, status.Qos.Dropped, status.Qos.Overflowed)
+		if status.Flood != nil {
+			fmt.Printf("Flood: %d sent, %d received, %d dropped as looped, %d dropped by rate limit\n", status.Flood.Sent, status.Flood.Received, status.Flood.Looped, status.Flood.Limited)
+		}
+		if len(status.Events) > 0 {
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "EVENTS\tDEPTH\tCAPACITY\tDELIVERED\tDROPPED")
+			for _, e := range status.Events {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", strings.Join(e.Topics, ","), e.Depth, e.Capacity, e.Delivered, e.Dropped)
+			}
+			w.Flush()
+		}
+		if len(status.Usages) > 0 {
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "LEASE\tMONTH\tTX BYTES\tRX BYTES\tRELAY BYTES\tTOTAL BYTES\tQUOTA\tSTATE")
+			for _, u := range status.Usages {
+				quota, state := "unlimited", "ok"
+				if u.Quota > 0 {
+					quota = fmt.Sprintf("%dMB", u.Quota)
+				}
+				if u.Exceeded {
+					state = u.Action
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", u.Id, u.Month, u.TxBytes, u.RxBytes, u.RelayBytes, u.TotalBytes, quota, state)
+			}
+			w.Flush()
+		}
+		if len(status.Switch) > 0 {
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "MAC\tPEER\tLAST SEEN")
+			for _, e := range status.Switch {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", e.Mac, e.Peer, e.Seen.Format(time.RFC3339))
+			}
+			w.Flush()
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().BoolP("json", "", false, "print the status in json")
+	statusCmd.Flags().StringP("network", "n", "", "the network listed in the config file (default the first one)")
+}
+
+// the status file of the network named name
+func statusFile(name string) string {
+	if name == "" {
+		return filepath.Join(os.TempDir(), "gvn-status.json")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gvn-status-%s.json", name))
+}
+
+// writeStatus dumps the status of the node periodically until it stopped
+func writeStatus(node *gvn.Node) {
+	ticker := time.NewTicker(STATUS_INTERVAL * time.Second)
+	defer ticker.Stop()
+	filename := statusFile(node.Config().Name)
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.Done():
+			os.Remove(filename)
+			return
+		}
+		status := node.Status()
+		for _, s := range status.Peers {
+			logrus.WithFields(logrus.Fields{
+				"Peer":        s.Peer,
+				"TxBytes":     s.TxBytes,
+				"TxRatio":     s.TxRatio(),
+				"RxBytes":     s.RxBytes,
+				"RxRatio":     s.RxRatio(),
+				"Compression": s.Compression,
+			}).Debug("Peer stats")
+		}
+		buff, _ := json.Marshal(status)
+		if err := os.WriteFile(filename, buff, 0644); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"File":  filename,
+			}).Error("Write status file error")
+		}
+	}
+}
@@ -16,26 +16,17 @@ limitations under the License.
 package cmd
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
-	"time"
 
-	"github.com/libp2p/go-libp2p-core/network"
-	"github.com/libp2p/go-libp2p-core/protocol"
-	"github.com/liloew/gvn/dhcp"
-	"github.com/liloew/gvn/p2p"
-	"github.com/liloew/gvn/route"
-	"github.com/liloew/gvn/tun"
+	"github.com/fsnotify/fsnotify"
+	"github.com/liloew/gvn/gvn"
 	"github.com/sirupsen/logrus"
-	"github.com/songgao/packets/ethernet"
-	"github.com/songgao/water/waterutil"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -44,12 +35,11 @@ var (
 	upCmd = &cobra.Command{
 		Use:   "up",
 		Short: "run gvn",
-		Long:  `Run gvn using the configure file (gvn.yaml)`,
+		Long:  `Run gvn using the configure file (gvn.yaml), all the networks listed are run by the same process`,
 		Run: func(cmd *cobra.Command, args []string) {
 			upCommand(cmd)
 		},
 	}
-	mainDev tun.Device
 )
 
 func init() {
@@ -58,119 +48,58 @@ func init() {
 }
 
 func upCommand(cmd *cobra.Command) {
-	devChan := make(chan tun.Device, 1)
-	config := Config{}
+	if errs := validateConfig(viper.ConfigFileUsed()); len(errs) > 0 {
+		printConfigErrors(viper.ConfigFileUsed(), errs)
+		logrus.WithFields(logrus.Fields{
+			"File":   viper.ConfigFileUsed(),
+			"ERRORS": errs,
+		}).Fatal("Invalid config file")
+	}
+	config := gvn.Config{}
 	if err := viper.Unmarshal(&config); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
 		}).Panic("Unmarshal config file error")
 	}
-	host, err := p2p.NewPeer(config.PriKey, config.Port)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"ERROR":      err,
-			"PrivateKey": config.PriKey,
-		}).Panic("Create peer error")
-	}
-	logrus.WithFields(logrus.Fields{
-		"ID":    host.ID().Pretty(),
-		"Addrs": host.Addrs(),
-	}).Info("Peer info")
-
-	zone := fmt.Sprintf("/gvn/%s", viper.GetString("version"))
-	rpcZone := fmt.Sprintf("/rpc/%s", viper.GetString("version"))
-	host.SetStreamHandler(protocol.ID(zone), func(stream network.Stream) {
-		logrus.WithFields(logrus.Fields{
-			"LocalPeer":  stream.Conn().LocalPeer(),
-			"RemotePeer": stream.Conn().RemotePeer(),
-			"LocalAddr":  stream.Conn().LocalMultiaddr(),
-			"RemoteAddr": stream.Conn().RemoteMultiaddr(),
-			"Protocol":   stream.Protocol(),
-		}).Info("handler new stream")
-		go readData(stream)
-	})
-
-	var bootstraps []string
-	if MODE(viper.GetUint("mode")) == MODECLIENT {
-		// start dht in server mode
-		bootstraps = viper.GetStringSlice("server")
-	} else {
-		// DHT connect to self
-		for _, addr := range host.Addrs() {
-			bootstraps = append(bootstraps, fmt.Sprintf("%s/p2p/%s", addr.String(), host.ID().Pretty()))
+	nodes := make([]*gvn.Node, 0)
+	for _, c := range gvn.Networks(config) {
+		node, err := newNode(c)
+		if err == nil {
+			err = node.Start(context.Background())
 		}
-		dhcp.NewRPCServer(host, rpcZone, viper.GetString("dev.vip"), viper.GetInt("dev.mtu"), viper.GetStringSlice("dev.subnets"))
-		// auto config in server mode
-		devChan <- tun.Device{
-			Name: viper.GetString("dev.name"),
-			Ip:   viper.GetString("dev.vip"),
-			Mtu:  viper.GetInt("dev.mtu"),
-			// Subnets:   viper.GetStringSlice("dev.subnets"),
-			ServerVIP: viper.GetString("dev.vip"),
-			Port:      viper.GetUint("port"),
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"Network": c.Name,
+				"ERROR":   err,
+			}).Fatal("Start network error")
 		}
+		go writeStatus(node)
+		nodes = append(nodes, node)
 	}
-	p2p.NewDHT(host, zone, bootstraps)
+	ctl := serveControl(nodes)
 
-	// DHCP for client mode
-	if MODE(viper.GetUint("mode")) == MODECLIENT {
-		go func() {
-			// HEARTBEAT
-			req := dhcp.Request{
-				Id:      viper.GetString("id"),
-				Name:    viper.GetString("dev.name"),
-				Subnets: viper.GetStringSlice("dev.subnets"),
-			}
-			if client, res := dhcp.NewRPCClient(host, rpcZone, viper.GetString("server"), req); client != nil {
-				// ticker.Stop()
-				logrus.WithFields(logrus.Fields{
-					"res": res,
-					"req": req,
-				}).Info("RPC - Client received data")
-				devChan <- tun.Device{
-					Name: req.Name,
-					Ip:   res.Ip,
-					Mtu:  res.Mtu,
-					// ignore subnets because of self did't forward it to TUN
-					// Subnets:   res.Subnets,
-					ServerVIP: res.ServerVIP,
-					Port:      viper.GetUint("port"),
-				}
-			}
-			ticker := time.NewTicker(INTERVAL * time.Second)
-			for range ticker.C {
-				var ress []dhcp.Response
-				if err := dhcp.Call("DHCPService", "Clients", req, &ress); err == nil {
-					for _, r := range ress {
-						logrus.WithFields(logrus.Fields{
-							"VIP":    r.Ip,
-							"ID":     r.Id,
-							"Subnet": r.Subnets,
-						}).Debug("Refresh local vip table")
-						subnet := strings.Split(r.Ip, "/")[0] + "/32"
-						route.EventBus.Publish(route.ADD_ROUTE_TOPIC, route.RouteEvent{Id: r.Id, Subnets: []string{subnet}})
-						if r.Id != host.ID().Pretty() {
-							// does not change route via local ethernet
-							route.EventBus.Publish(route.ADD_ROUTE_TOPIC, route.RouteEvent{Id: r.Id, Subnets: r.Subnets})
-						}
-					}
-				} else {
-					logrus.WithFields(logrus.Fields{
-						"ERROR": err,
-					}).Error("Request clients error")
-				}
-				if err := dhcp.Call("DHCPService", "Ping", req, nil); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"ERROR": err,
-					}).Error("RPC - Ping error")
+	// apply the changes of the config file to the running networks, the networks added or removed take effect after
+	// restart
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		current := gvn.Config{}
+		if err := viper.Unmarshal(&current); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"File":  e.Name,
+			}).Error("Reload config file error")
+			return
+		}
+		for _, c := range gvn.Networks(current) {
+			for _, node := range nodes {
+				if node.Config().Name == c.Name {
+					node.Reload(c)
 				}
 			}
-		}()
-	}
-	// END: DHCP
-	go p2p.FindPeerIdsViaDHT(host, zone)
+		}
+	})
+	viper.WatchConfig()
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		for sig := range c {
@@ -178,12 +107,18 @@ func upCommand(cmd *cobra.Command) {
 			case syscall.SIGINT:
 				// exit when receive ctrl+c and others signal
 				logrus.WithFields(logrus.Fields{
-					"SIG": sig,
-					"dev": mainDev,
+					"SIG":      sig,
+					"Networks": len(nodes),
 				}).Info("Exit for SIGINT")
 				filename := filepath.Join(os.TempDir(), "gvn.pid")
 				os.Remove(filename)
-				tun.Close(mainDev)
+				if ctl != nil {
+					ctl.Close()
+				}
+				for _, node := range nodes {
+					os.Remove(statusFile(node.Config().Name))
+					node.Stop()
+				}
 				os.Exit(0)
 			case syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT:
 				logrus.WithFields(logrus.Fields{
@@ -197,48 +132,10 @@ func upCommand(cmd *cobra.Command) {
 		}
 	}()
 
-	mainDev = <-devChan
-	logrus.WithFields(logrus.Fields{
-		"dev": mainDev,
-	}).Info("Create TUN device")
-	tun.NewTun(mainDev)
-	// avoid create duplicate
-	close(devChan)
-	_, vipNet, err := net.ParseCIDR(mainDev.Ip)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"ERROR": err,
-		}).Fatal("Device VIP error")
-	}
-	go func() {
-		for {
-			var frame ethernet.Frame
-			frame.Resize(int(config.Dev.Mtu))
-			n, err := tun.Read([]byte(frame))
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"ERROR": err,
-				}).Error("Read packet from TUN error")
-			}
-			frame = frame[:n]
-			if frame != nil && len(frame) > 0 {
-				if !waterutil.IsIPv6(frame) {
-					// Only process IPv4 packet
-					logrus.WithFields(logrus.Fields{
-						"SRC": waterutil.IPv4Source(frame).String(),
-						"DST": waterutil.IPv4Destination(frame).String(),
-					}).Debug("TUN - Packet SRC and DST")
-					if waterutil.IPv4Source(frame).String() != waterutil.IPv4Destination(frame).String() {
-						p2p.ForwardPacket(host, zone, frame, vipNet)
-					}
-				}
-			}
-		}
-	}()
-
 	// wirte pid file
 	filename := filepath.Join(os.TempDir(), "gvn.pid")
 	var pidfile *os.File
+	var err error
 	if pidfile, err = os.Create(filename); err != nil {
 		os.Remove(filename)
 		pidfile, _ = os.Create(filename)
@@ -259,34 +156,15 @@ func upCommand(cmd *cobra.Command) {
 	select {}
 }
 
-func readData(stream network.Stream) {
-	for {
-		var psize = make([]byte, 2)
-		if _, err := stream.Read(psize); err != nil {
-			stream.Close()
-		}
-		size := binary.LittleEndian.Uint16(psize)
-		bytes := make([]byte, size)
-		n, err := stream.Read(bytes[:size])
-		if err != nil || n <= 0 {
-			logrus.WithFields(logrus.Fields{
-				"ERROR": err,
-				"SIZE":  n,
-			}).Error("Read data error")
-			stream.Close()
-			break
-		}
-		logrus.WithFields(logrus.Fields{
-			"LocalPeer":  stream.Conn().LocalPeer().Pretty(),
-			"RemotePeer": stream.Conn().RemotePeer().Pretty(),
-		}).Debug("Read data from stream")
-		// Write to TUN
-		n, err = tun.Write(bytes)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"ERROR": err,
-				"SIZE":  n,
-			}).Error("Write to TUN error")
-		}
+// newNode creates the node of the network, the private key is decrypted and the key files are resolved by the config
+// file
+func newNode(config gvn.Config) (*gvn.Node, error) {
+	priKey, err := loadPrivateKey(config)
+	if err != nil {
+		return nil, fmt.Errorf("load private key error: %s", err)
 	}
+	config.PriKey, config.KeyFile = priKey, ""
+	node := gvn.New(config)
+	node.Dir = filepath.Dir(viper.ConfigFileUsed())
+	return node, nil
 }
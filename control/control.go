@@ -0,0 +1,171 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the command and its reply must finish in
+	CALL_TIMEOUT = 10 * time.Second
+)
+
+// Request is sent by the commands to the running gvn, one per connection
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Handler decodes the params and returns the result to be encoded
+type Handler func(params json.RawMessage) (interface{}, error)
+
+// Server serves the requests from the control socket, only the owner of the socket can connect
+type Server struct {
+	path     string
+	listener net.Listener
+	handlers map[string]Handler
+	mu       sync.RWMutex
+}
+
+// Listen listens on the unix socket path, the stale socket left by the crashed gvn is removed. The directory of the
+// socket is created accessible by owner only and refused if others can access it, so the socket is never exposed even
+// before its permission is set
+func Listen(path string) (*Server, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() || info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("directory %s of control socket must be accessible by owner only", dir)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use, is gvn running?", path)
+	}
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &Server{path: path, listener: listener, handlers: map[string]Handler{}}, nil
+}
+
+func (s *Server) Handle(method string, handler Handler) {
+	s.mu.Lock()
+	s.handlers[method] = handler
+	s.mu.Unlock()
+}
+
+// Serve accepts the connections until closed
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close stops serving and removes the socket
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT))
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+		}).Error("Control - decode request error")
+		return
+	}
+	s.mu.RLock()
+	handler, ok := s.handlers[req.Method]
+	s.mu.RUnlock()
+	var res Response
+	if !ok {
+		res.Error = fmt.Sprintf("unknown method %s, is gvn up to date?", req.Method)
+	} else if result, err := handler(req.Params); err != nil {
+		res.Error = err.Error()
+	} else if res.Result, err = json.Marshal(result); err != nil {
+		res.Error = err.Error()
+	}
+	logrus.WithFields(logrus.Fields{
+		"Method": req.Method,
+		"Error":  res.Error,
+	}).Debug("Control - handled request")
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+		}).Error("Control - encode response error")
+	}
+}
+
+// Call sends the request to the gvn listening on path and decodes the result into result if not nil
+func Call(path string, method string, params interface{}, result interface{}) error {
+	conn, err := net.DialTimeout("unix", path, CALL_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("connect to control socket %s error, is gvn running? %s", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT))
+	req := Request{Method: method}
+	if params != nil {
+		if req.Params, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	var res Response
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	if result != nil && len(res.Result) > 0 {
+		return json.Unmarshal(res.Result, result)
+	}
+	return nil
+}
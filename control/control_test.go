@@ -0,0 +1,71 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gvn", "gvn.sock")
+	server, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Handle("echo", func(params json.RawMessage) (interface{}, error) {
+		var s string
+		err := json.Unmarshal(params, &s)
+		return s, err
+	})
+	server.Handle("fail", func(params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	go server.Serve()
+
+	var result string
+	if err := Call(path, "echo", "hello", &result); err != nil || result != "hello" {
+		t.Errorf("echo returned %q, %v", result, err)
+	}
+	if err := Call(path, "fail", nil, nil); err == nil || err.Error() != "failed" {
+		t.Errorf("fail returned %v", err)
+	}
+	if err := Call(path, "unknown", nil, nil); err == nil {
+		t.Error("unknown method succeeded")
+	}
+	if _, err := Listen(path); err == nil {
+		t.Error("listen on the socket in use succeeded")
+	}
+}
+
+func TestListenPrivateDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the permission bits are not supported")
+	}
+	dir := filepath.Join(t.TempDir(), "gvn")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := Listen(filepath.Join(dir, "gvn.sock")); err == nil {
+		server.Close()
+		t.Error("listen in the directory accessible by others succeeded")
+	}
+}
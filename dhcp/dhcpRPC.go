@@ -17,7 +17,9 @@ package dhcp
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -27,20 +29,14 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	rpc "github.com/libp2p/go-libp2p-gorpc"
+	"github.com/liloew/gvn/eventbus"
+	"github.com/liloew/gvn/internal/strslice"
+	"github.com/liloew/gvn/qos"
 	"github.com/liloew/gvn/route"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	ServerVIP string
-	MaxCIDR   string
-	Mtu       int
-	mu        sync.Mutex
-	client    *rpc.Client
-	serverId  peer.ID
-)
-
 type RPC struct {
 }
 
@@ -49,6 +45,12 @@ type Request struct {
 	Mode    int
 	Name    string
 	Subnets []string
+	// the lower is preferred among the peers advertise the same subnet
+	Metric int
+	// invite token used by the first DHCP
+	Token string
+	// the traffic since the last Ping
+	Traffic []Traffic
 }
 
 type Response struct {
@@ -57,82 +59,344 @@ type Response struct {
 	Ip        string
 	Mtu       int
 	Subnets   []string
+	Metric    int
 	ServerVIP string
 	Mode      int
 	Ttl       int64
 	LoginTime int64
+	// the QoS policy applied by all the nodes
+	Policy qos.Policy
+	// the traffic of the lease in the month, only returned by Ping
+	Usage Usage
 }
 
-type DHCPService struct {
-	// bind to database or KV store
-	KV map[string]Response
+// Pool is the leases of a DHCP server, the server holds Cidr itself and the clients are assigned the following
+// addresses of its network
+type Pool struct {
 	// should be 192.168.1.1/24 for example
 	Cidr string
 	Mtu  int
+	// the subnets and metric advertised by the server itself
+	Subnets []string
+	Metric  int
+}
+
+// ServerOptions configures the DHCP server
+type ServerOptions struct {
+	Pool Pool
+	// the consumed invite tokens, invite tokens are not accepted if nil
+	Invites *InviteStore
+	// reject the peers without invite token
+	InviteOnly bool
+	// pushed to the clients
+	Policy qos.Policy
+	// the traffic accounting and quotas, optional
+	Traffic *TrafficStore
+}
+
+type DHCPService struct {
+	// bind to database or KV store
+	KV   map[string]Response
+	Pool Pool
+	// the last address assigned
+	last string
+	mu   sync.Mutex
+	// the consumed invite tokens
+	Invites *InviteStore
+	// reject the peers without invite token
+	InviteOnly bool
+	// pushed to the clients
+	Policy qos.Policy
+	// the traffic accounting and quotas
+	Traffic *TrafficStore
+	// the route events are published to
+	bus *eventbus.EventBus
+	// the server itself and the client calls the online clients
+	id     peer.ID
+	client *rpc.Client
 }
 
 func (s *DHCPService) DHCP(ctx context.Context, req Request, res *Response) error {
+	// the invite token is a bearer secret
+	logged := req
+	if logged.Token != "" {
+		logged.Token = "[REDACTED]"
+	}
 	logrus.WithFields(logrus.Fields{
-		"Request": req,
+		"Request": logged,
 	}).Info("RPC call Clients")
-	mu.Lock()
+	if sender, err := rpc.GetRequestSender(ctx); err != nil || sender.Pretty() != req.Id {
+		logrus.WithFields(logrus.Fields{
+			"Sender": sender,
+			"ID":     req.Id,
+		}).Error("RPC - DHCP for other peer is forbidden")
+		return errors.New("permission denied")
+	}
+	s.mu.Lock()
 	data, ok := s.KV[req.Id]
+	var ip string
 	if !ok {
+		// allocate first, the invite token isn't consumed if the pool is exhausted
+		var err error
+		if ip, err = s.allocate(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"ID":    req.Id,
+			}).Error("RPC - allocate address error")
+			s.mu.Unlock()
+			return err
+		}
+		if err := s.enroll(req); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"ID":    req.Id,
+			}).Error("RPC - enroll peer error")
+			s.mu.Unlock()
+			return err
+		}
+	}
+	changed := ok && (!strslice.Equal(data.Subnets, req.Subnets) || data.Metric != req.Metric)
+	if ok {
+		// the subnets may be changed during the client restart
+		data.Subnets = req.Subnets
+		data.Metric = req.Metric
+	} else {
 		data.Id = req.Id
 		data.Name = req.Name
 		data.Subnets = req.Subnets
+		data.Metric = req.Metric
 		data.Mode = req.Mode
 		data.LoginTime = time.Now().Unix()
 		data.Ttl = 10 * 60 // 10 min
-
-		if MaxCIDR == "" {
-			MaxCIDR = s.Cidr
-			ServerVIP = s.Cidr
-			Mtu = s.Mtu
-		}
-		ipv4Addr, ipv4Net, err := net.ParseCIDR(MaxCIDR)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"PEER": MaxCIDR,
-			}).Fatal("IP addr is invalid")
-		}
-		ipv4Addr = ipv4Addr.To4()
-		ipv4Addr[3]++
-		if ipv4Net.Contains(ipv4Addr) {
-			MaxCIDR = ipv4Addr.String() + "/" + strings.Split(MaxCIDR, "/")[1]
-		} else {
-			// TODO: loop for an available ip
-		}
-		data.Ip = MaxCIDR
-		data.Mtu = s.Mtu
-		data.ServerVIP = ServerVIP
+		data.Ip = ip
+		data.Mtu = s.Pool.Mtu
+		data.ServerVIP = s.Pool.Cidr
 	}
 	s.KV[req.Id] = data
+	if s.Traffic != nil {
+		s.Traffic.Lease(req.Id)
+	}
 	// res = &data
 	res.Id = data.Id
 	res.Ip = data.Ip
 	res.Name = data.Name
 	res.Mtu = data.Mtu
 	res.Subnets = data.Subnets
+	res.Metric = data.Metric
 	res.ServerVIP = data.ServerVIP
 	res.Mode = data.Mode
 	res.LoginTime = data.LoginTime
 	res.Ttl = data.Ttl
+	res.Policy = s.effectivePolicy()
 	logrus.WithFields(logrus.Fields{
 		"res": res,
 	}).Info("RPC - Client requested data")
 
 	// vip/mask -> vip/32
 	// route.Route.Add(strings.Split(data.Ip, "/")[0]+"/32", data.Id)
-	subnet := strings.Split(data.Ip, "/")[0] + "/32"
-	route.EventBus.Publish(route.ADD_ROUTE_TOPIC, route.RouteEvent{Id: data.Id, Subnets: []string{subnet}})
-	route.EventBus.Publish(route.ADD_ROUTE_TOPIC, route.RouteEvent{Id: req.Id, Subnets: req.Subnets})
-	mu.Unlock()
+	event := route.RouteEvent{Id: data.Id, Name: data.Name, Vip: data.Ip, Subnets: data.Subnets, Metric: data.Metric}
+	s.bus.Publish(route.REFRESH_ROUTE_TOPIC, event)
+	if changed {
+		s.notify(event)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// allocate the first address not leased after the last one assigned, the network and broadcast addresses are
+// skipped, should be called with mu locked
+func (s *DHCPService) allocate() (string, error) {
+	// the pool is validated by NewRPCServer
+	ip, network, _ := net.ParseCIDR(s.last)
+	ones, bits := network.Mask.Size()
+	if bits != 8*net.IPv4len || bits-ones < 2 {
+		return "", fmt.Errorf("pool %s exhausted", s.Pool.Cidr)
+	}
+	leased := map[string]bool{strings.Split(s.Pool.Cidr, "/")[0]: true}
+	for _, v := range s.KV {
+		leased[strings.Split(v.Ip, "/")[0]] = true
+	}
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	size := uint32(1) << uint(bits-ones)
+	offset := binary.BigEndian.Uint32(ip.To4()) - base
+	for i := uint32(1); i < size; i++ {
+		offset = (offset + 1) % size
+		if offset == 0 || offset == size-1 {
+			continue
+		}
+		next := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(next, base+offset)
+		if !leased[next.String()] {
+			s.last = fmt.Sprintf("%s/%d", next, ones)
+			return s.last, nil
+		}
+	}
+	return "", fmt.Errorf("pool %s exhausted", s.Pool.Cidr)
+}
+
+// validate and consume the invite token of new peer
+func (s *DHCPService) enroll(req Request) error {
+	if s.Invites == nil {
+		return nil
+	}
+	if req.Token != "" {
+		return s.Invites.Consume(req.Token, s.id.Pretty(), req.Id)
+	}
+	if s.InviteOnly && !s.Invites.Enrolled(req.Id) {
+		return ErrInviteRequired
+	}
+	return nil
+}
+
+// UpdateSubnets replace the subnets of the sender's lease and push them to all the online clients
+func (s *DHCPService) UpdateSubnets(ctx context.Context, req Request, res *Response) error {
+	if sender, err := rpc.GetRequestSender(ctx); err != nil || sender.Pretty() != req.Id {
+		logrus.WithFields(logrus.Fields{
+			"Sender": sender,
+			"ID":     req.Id,
+		}).Error("RPC - update subnets of other peer is forbidden")
+		return errors.New("permission denied")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.KV[req.Id]
+	if !ok {
+		return errors.New("not found")
+	}
+	logrus.WithFields(logrus.Fields{
+		"ID":      req.Id,
+		"Old":     data.Subnets,
+		"Subnets": req.Subnets,
+		"Metric":  req.Metric,
+	}).Info("RPC - update subnets")
+	data.Subnets = req.Subnets
+	data.Metric = req.Metric
+	s.KV[req.Id] = data
+	*res = data
+
+	event := route.RouteEvent{Id: data.Id, Name: data.Name, Vip: data.Ip, Subnets: data.Subnets, Metric: data.Metric}
+	if data.Id == s.id.Pretty() {
+		// does not change route via local ethernet
+		event.Subnets = nil
+	}
+	s.bus.Publish(route.REFRESH_ROUTE_TOPIC, event)
+	s.notify(route.RouteEvent{Id: data.Id, Name: data.Name, Vip: data.Ip, Subnets: data.Subnets, Metric: data.Metric})
+	return nil
+}
+
+// push the route event to all online clients except the owner, should be called with mu locked
+func (s *DHCPService) notify(event route.RouteEvent) {
+	s.broadcast("RouteService", "Refresh", event.Id, event)
+}
+
+// SetPolicy applies the QoS policy locally and pushes it to all online clients
+func (s *DHCPService) SetPolicy(policy qos.Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Policy = policy
+	s.pushPolicy()
+}
+
+// SetQuotas replaces the quotas and pushes the policy if any lease is throttled or released
+func (s *DHCPService) SetQuotas(quotas []Quota) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Traffic != nil && s.Traffic.SetQuotas(quotas) {
+		s.pushPolicy()
+	}
+}
+
+// the configured policy with the limits of throttled leases
+func (s *DHCPService) effectivePolicy() qos.Policy {
+	if s.Traffic == nil {
+		return s.Policy
+	}
+	throttled := s.Traffic.Throttled()
+	if len(throttled) == 0 {
+		return s.Policy
+	}
+	policy := qos.Policy{Classes: s.Policy.Classes}
+	policy.Limits = append(append(policy.Limits, s.Policy.Limits...), throttled...)
+	return policy
+}
+
+// should be called with mu locked
+func (s *DHCPService) pushPolicy() {
+	policy := s.effectivePolicy()
+	s.bus.Publish(qos.POLICY_TOPIC, policy)
+	s.broadcast("PolicyService", "Apply", "", policy)
+}
+
+// call the service of all online clients except the given one, should be called with mu locked
+func (s *DHCPService) broadcast(svcName string, svcMethod string, except string, args interface{}) {
+	for _, v := range s.KV {
+		if v.Mode == 1 || v.Id == except || time.Now().Unix()-v.LoginTime > v.Ttl {
+			continue
+		}
+		go func(id string) {
+			peerId, err := peer.Decode(id)
+			if err != nil {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := s.client.CallContext(ctx, peerId, svcName, svcMethod, args, &Response{}); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"ERROR":     err,
+					"ID":        id,
+					"svcName":   svcName,
+					"svcMethod": svcMethod,
+				}).Error("RPC - push to client error")
+			}
+		}(v.Id)
+	}
+}
+
+// RouteService runs on clients and receives the route changes pushed by server
+type RouteService struct {
+	server peer.ID
+	self   peer.ID
+	bus    *eventbus.EventBus
+}
+
+func (s *RouteService) Refresh(ctx context.Context, event route.RouteEvent, res *Response) error {
+	if sender, err := rpc.GetRequestSender(ctx); err != nil || sender != s.server {
+		logrus.WithFields(logrus.Fields{
+			"Sender": sender,
+			"Event":  event,
+		}).Error("RPC - route refreshed by other peer rather than server is forbidden")
+		return errors.New("permission denied")
+	}
+	logrus.WithFields(logrus.Fields{
+		"Event": event,
+	}).Info("RPC - refresh route")
+	if event.Id == s.self.Pretty() {
+		// does not change route via local ethernet
+		event.Subnets = nil
+	}
+	s.bus.Publish(route.REFRESH_ROUTE_TOPIC, event)
+	return nil
+}
+
+// PolicyService runs on clients and receives the QoS policy pushed by server, the policy is published to bus
+type PolicyService struct {
+	server peer.ID
+	bus    *eventbus.EventBus
+}
+
+func (s *PolicyService) Apply(ctx context.Context, policy qos.Policy, res *Response) error {
+	if sender, err := rpc.GetRequestSender(ctx); err != nil || sender != s.server {
+		logrus.WithFields(logrus.Fields{
+			"Sender": sender,
+		}).Error("RPC - QoS policy pushed by other peer rather than server is forbidden")
+		return errors.New("permission denied")
+	}
+	s.bus.Publish(qos.POLICY_TOPIC, policy)
 	return nil
 }
 
 func (s *DHCPService) Clients(ctx context.Context, req Request, res *[]Response) error {
-	mu.Lock()
+	s.mu.Lock()
 	for _, v := range s.KV {
 		if v.Mode != 1 && time.Now().Unix()-v.LoginTime > v.Ttl {
 			continue
@@ -144,35 +408,69 @@ func (s *DHCPService) Clients(ctx context.Context, req Request, res *[]Response)
 			Mtu:       v.Mtu,
 			Mode:      v.Mode,
 			Subnets:   v.Subnets,
+			Metric:    v.Metric,
 			ServerVIP: v.ServerVIP,
 		}
 		*res = append(*res, r)
 	}
-	mu.Unlock()
+	s.mu.Unlock()
 	return nil
 }
 
 func (s *DHCPService) Ping(ctx context.Context, req Request, res *Response) error {
-	mu.Lock()
+	if sender, err := rpc.GetRequestSender(ctx); err != nil || sender.Pretty() != req.Id {
+		logrus.WithFields(logrus.Fields{
+			"Sender": sender,
+			"ID":     req.Id,
+		}).Error("RPC - Ping for other peer is forbidden")
+		return errors.New("permission denied")
+	}
+	s.mu.Lock()
 	if v, ok := s.KV[req.Id]; ok {
 		v.Ttl = 10 * 60 // 10 min
 		v.LoginTime = time.Now().Unix()
 		s.KV[req.Id] = v
+		if s.Traffic != nil {
+			if s.Traffic.Report(req.Id, req.Traffic) {
+				s.pushPolicy()
+			}
+			res.Usage = s.Traffic.Usage(req.Id)
+		}
+		res.Policy = s.effectivePolicy()
 	} else {
-		mu.Unlock()
+		s.mu.Unlock()
 		return errors.New("not found")
 	}
-	mu.Unlock()
+	s.mu.Unlock()
 	return nil
 }
 
-func NewRPCServer(host host.Host, zone string, cidr string, mtu int, subnets []string) {
-	server := rpc.NewServer(host, protocol.ID(zone))
-	service := DHCPService{KV: map[string]Response{}, Cidr: cidr, Mtu: mtu}
-	if err := server.Register(&service); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"ERROR": err,
-		}).Panic("RPC - build RPC service error")
+// NewRPCServer serves the leases of the pool in options on all the zones, the first one is preferred, the route events
+// are published to bus
+func NewRPCServer(host host.Host, zones []string, bus *eventbus.EventBus, options ServerOptions) (*DHCPService, error) {
+	pool := options.Pool
+	ip, _, err := net.ParseCIDR(pool.Cidr)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid pool %q, should be 192.168.1.1/24 for example", pool.Cidr)
+	}
+	service := &DHCPService{
+		KV:         map[string]Response{},
+		Pool:       pool,
+		last:       pool.Cidr,
+		Invites:    options.Invites,
+		InviteOnly: options.InviteOnly,
+		Policy:     options.Policy,
+		Traffic:    options.Traffic,
+		bus:        bus,
+		id:         host.ID(),
+	}
+	servers := make([]*rpc.Server, 0)
+	for _, zone := range zones {
+		server := rpc.NewServer(host, protocol.ID(zone))
+		if err := server.Register(service); err != nil {
+			return nil, fmt.Errorf("build RPC service on %s error: %s", zone, err)
+		}
+		servers = append(servers, server)
 	}
 	// does not clean the zombie client
 	/*
@@ -181,56 +479,135 @@ func NewRPCServer(host host.Host, zone string, cidr string, mtu int, subnets []s
 			for range ticker.C {
 				for k, v := range service.KV {
 					if time.Now().Unix()-v.LoginTime > v.Ttl {
-						mu.Lock()
+						service.mu.Lock()
 						delete(service.KV, k)
-						mu.Unlock()
+						service.mu.Unlock()
 					}
 				}
 			}
 		}()
 	*/
 	// server register
-	mu.Lock()
+	service.mu.Lock()
+	// local calls to the server itself
+	service.client = rpc.NewClientWithServer(host, protocol.ID(zones[0]), servers[0])
 	service.KV[host.ID().Pretty()] = Response{
 		Id:        host.ID().Pretty(),
-		Ip:        cidr,
-		Mtu:       mtu,
-		ServerVIP: cidr,
+		Ip:        pool.Cidr,
+		Mtu:       pool.Mtu,
+		ServerVIP: pool.Cidr,
 		Mode:      1,
-		Subnets:   subnets,
+		Subnets:   pool.Subnets,
+		Metric:    pool.Metric,
 		LoginTime: time.Now().Unix(),
 		Ttl:       10 * 60, // 10 min
 	}
-	mu.Unlock()
+	bus.Publish(qos.POLICY_TOPIC, service.effectivePolicy())
+	service.mu.Unlock()
+	return service, nil
+}
+
+// LocalClient calls the server itself
+func (s *DHCPService) LocalClient() *Client {
+	return &Client{Client: s.client, Server: s.id, bus: s.bus}
 }
 
-func NewRPCClient(host host.Host, zone string, server string, req Request) (*rpc.Client, Response) {
-	client = rpc.NewClient(host, protocol.ID(zone))
+// Client calls the server and serves the route and policy pushed by it
+type Client struct {
+	*rpc.Client
+	Server peer.ID
+	bus    *eventbus.EventBus
+}
+
+// NewRPCClient requests DHCP via the first zone supported by server until ctx done, the route events are published to
+// bus
+func NewRPCClient(ctx context.Context, host host.Host, zones []string, bus *eventbus.EventBus, server string, req Request) (*Client, Response) {
 	var res Response
-	if ma, err := multiaddr.NewMultiaddr(server); err == nil {
-		if addr, err := peer.AddrInfoFromP2pAddr(ma); err == nil {
-			serverId = addr.ID
-			if err := client.Call(addr.ID, "DHCPService", "DHCP", req, &res); err != nil {
-				logrus.WithFields(logrus.Fields{
-					"ERROR": err,
-				}).Error("RPC - call DHCP RPC serveice error")
+	ma, err := multiaddr.NewMultiaddr(server)
+	if err != nil {
+		return nil, res
+	}
+	addr, err := peer.AddrInfoFromP2pAddr(ma)
+	if err != nil {
+		return nil, res
+	}
+	for _, zone := range zones {
+		rpcServer := rpc.NewServer(host, protocol.ID(zone))
+		if err := rpcServer.Register(&RouteService{server: addr.ID, self: host.ID(), bus: bus}); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+			}).Panic("RPC - build RPC service error")
+		}
+		if err := rpcServer.Register(&PolicyService{server: addr.ID, bus: bus}); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+			}).Panic("RPC - build RPC service error")
+		}
+		c := rpc.NewClientWithServer(host, protocol.ID(zone), rpcServer)
+		if err := c.CallContext(ctx, addr.ID, "DHCPService", "DHCP", req, &res); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"Zone":  zone,
+			}).Error("RPC - call DHCP RPC serveice error")
+			if IsProtocolNotSupported(err) {
+				continue
 			}
-			return client, res
+			return nil, res
 		}
+		return &Client{Client: c, Server: addr.ID, bus: bus}, res
 	}
 	return nil, res
 }
 
-func Call(svcName string, svcMethod string, req Request, res interface{}) error {
-	if err := client.Call(serverId, svcName, svcMethod, req, &res); err != nil {
+// Call calls the service of server
+func (c *Client) Call(svcName string, svcMethod string, req Request, res interface{}) error {
+	if err := c.Client.Call(c.Server, svcName, svcMethod, req, res); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR":     err,
 			"svcName":   svcName,
 			"svcMethod": svcMethod,
-			"req":       req,
-			"res":       res,
 		}).Error("RPC - call RPC serveice error")
 		return err
 	}
 	return nil
 }
+
+// Refresh requests the online clients from server and refreshes the routes via them
+func (c *Client) Refresh(req Request) error {
+	var ress []Response
+	if err := c.Call("DHCPService", "Clients", req, &ress); err != nil {
+		return err
+	}
+	for _, r := range ress {
+		logrus.WithFields(logrus.Fields{
+			"VIP":    r.Ip,
+			"ID":     r.Id,
+			"Subnet": r.Subnets,
+		}).Debug("Refresh local vip table")
+		// the routes of the peer expire with its lease unless refreshed
+		event := route.RouteEvent{Id: r.Id, Name: r.Name, Vip: r.Ip, Subnets: r.Subnets, Metric: r.Metric, Ttl: 10 * 60}
+		if r.Id == c.ID().Pretty() {
+			// does not change route via local ethernet
+			event.Subnets = nil
+		}
+		c.bus.Publish(route.REFRESH_ROUTE_TOPIC, event)
+	}
+	return nil
+}
+
+// CallAny calls the peer via the first zone it supports
+func CallAny(ctx context.Context, host host.Host, zones []string, dest peer.ID, svcName string, svcMethod string, req interface{}, res interface{}) error {
+	var err error
+	for _, zone := range zones {
+		c := rpc.NewClient(host, protocol.ID(zone))
+		if err = c.CallContext(ctx, dest, svcName, svcMethod, req, res); err == nil || !IsProtocolNotSupported(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// IsProtocolNotSupported reports whether the peer is running an older or newer protocol
+func IsProtocolNotSupported(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "protocol not supported")
+}
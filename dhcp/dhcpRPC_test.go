@@ -0,0 +1,61 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dhcp
+
+import (
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	s := &DHCPService{
+		KV:   map[string]Response{},
+		Pool: Pool{Cidr: "10.0.0.1/29"},
+		last: "10.0.0.1/29",
+	}
+	// the server holds .1, .0 and .7 are the network and broadcast addresses
+	expected := []string{"10.0.0.2/29", "10.0.0.3/29", "10.0.0.4/29", "10.0.0.5/29", "10.0.0.6/29"}
+	for i, ip := range expected {
+		got, err := s.allocate()
+		if err != nil || got != ip {
+			t.Fatalf("got %s %v, %s expected", got, err, ip)
+		}
+		s.KV[string(rune('a'+i))] = Response{Ip: got}
+	}
+	if got, err := s.allocate(); err == nil {
+		t.Fatalf("got %s from the exhausted pool", got)
+	}
+	// the released address is reused once wrapped around
+	delete(s.KV, "b")
+	if got, err := s.allocate(); err != nil || got != "10.0.0.3/29" {
+		t.Fatalf("got %s %v, 10.0.0.3/29 expected", got, err)
+	}
+}
+
+func TestAllocateWideNetwork(t *testing.T) {
+	s := &DHCPService{
+		KV:   map[string]Response{},
+		Pool: Pool{Cidr: "10.1.0.1/16"},
+		last: "10.1.0.254/16",
+	}
+	// the next octet rather than wrapping in the last one
+	for _, ip := range []string{"10.1.0.255/16", "10.1.1.0/16"} {
+		got, err := s.allocate()
+		if err != nil || got != ip {
+			t.Fatalf("got %s %v, %s expected", got, err, ip)
+		}
+		s.KV[ip] = Response{Ip: got}
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dhcp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	INVITE_PREFIX = "gvn1"
+)
+
+var (
+	ErrInviteInvalid  = errors.New("invalid invite token")
+	ErrInviteExpired  = errors.New("invite token expired")
+	ErrInviteConsumed = errors.New("invite token has been used up")
+	ErrInviteRequired = errors.New("invite token required")
+)
+
+// Invite is the payload of an invite token signed by the server
+type Invite struct {
+	Id       string   `json:"id"`
+	Server   string   `json:"server"`
+	Addrs    []string `json:"addrs"`
+	Version  string   `json:"version"`
+	Network  string   `json:"network,omitempty"`
+	Mtu      int      `json:"mtu"`
+	Uses     int      `json:"uses"`
+	ExpireAt int64    `json:"expireAt"`
+	PubKey   []byte   `json:"pubKey"`
+}
+
+// NewInvite mints a token which can be used uses times before ttl
+func NewInvite(priKey crypto.PrivKey, addrs []string, version string, network string, mtu int, uses int, ttl time.Duration) (string, error) {
+	if uses <= 0 {
+		return "", fmt.Errorf("invalid uses %d, must be positive", uses)
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("invalid ttl %s, must be positive", ttl)
+	}
+	id, err := peer.IDFromPrivateKey(priKey)
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := crypto.MarshalPublicKey(priKey.GetPublic())
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	invite := Invite{
+		Id:       hex.EncodeToString(nonce),
+		Server:   id.Pretty(),
+		Addrs:    addrs,
+		Version:  version,
+		Network:  network,
+		Mtu:      mtu,
+		Uses:     uses,
+		ExpireAt: time.Now().Add(ttl).Unix(),
+		PubKey:   pubKey,
+	}
+	return signInvite(priKey, invite)
+}
+
+// sign the invite with the private key of the server and encode it as a token
+func signInvite(priKey crypto.PrivKey, invite Invite) (string, error) {
+	payload, err := json.Marshal(invite)
+	if err != nil {
+		return "", err
+	}
+	sig, err := priKey.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	return strings.Join([]string{INVITE_PREFIX, encoding.EncodeToString(payload), encoding.EncodeToString(sig)}, "."), nil
+}
+
+// ParseInvite verifies the token is signed by the server it embeds, the expiration isn't checked
+func ParseInvite(token string) (Invite, error) {
+	var invite Invite
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || parts[0] != INVITE_PREFIX {
+		return invite, ErrInviteInvalid
+	}
+	encoding := base64.RawURLEncoding
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return invite, ErrInviteInvalid
+	}
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return invite, ErrInviteInvalid
+	}
+	if err := json.Unmarshal(payload, &invite); err != nil {
+		return invite, ErrInviteInvalid
+	}
+	pubKey, err := crypto.UnmarshalPublicKey(invite.PubKey)
+	if err != nil {
+		return invite, ErrInviteInvalid
+	}
+	if id, err := peer.IDFromPublicKey(pubKey); err != nil || id.Pretty() != invite.Server {
+		return invite, ErrInviteInvalid
+	}
+	if ok, err := pubKey.Verify(payload, sig); err != nil || !ok {
+		return invite, ErrInviteInvalid
+	}
+	return invite, nil
+}
+
+// InviteStore records the consumed tokens and the enrolled peers
+type InviteStore struct {
+	// persist to the file if not empty
+	file string
+	// token id -> used times
+	Used map[string]int `json:"used"`
+	// peer id -> token id
+	Peers map[string]string `json:"peers"`
+	mu    sync.Mutex
+}
+
+func NewInviteStore(file string) *InviteStore {
+	store := &InviteStore{file: file, Used: map[string]int{}, Peers: map[string]string{}}
+	if file == "" {
+		return store
+	}
+	if buff, err := os.ReadFile(file); err == nil {
+		if err := json.Unmarshal(buff, store); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"File":  file,
+			}).Error("Load invite store error")
+		}
+	}
+	return store
+}
+
+// Enrolled reports whether the peer has joined with an invite token
+func (s *InviteStore) Enrolled(peerId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.Peers[peerId]
+	return ok
+}
+
+// Consume validates the token is issued by server and enrolls the peer
+func (s *InviteStore) Consume(token string, server string, peerId string) error {
+	invite, err := ParseInvite(token)
+	if err != nil {
+		return err
+	}
+	if invite.Server != server {
+		return ErrInviteInvalid
+	}
+	if time.Now().Unix() > invite.ExpireAt {
+		return ErrInviteExpired
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Peers[peerId] == invite.Id {
+		// enroll again with the same token
+		return nil
+	}
+	if s.Used[invite.Id] >= invite.Uses {
+		return ErrInviteConsumed
+	}
+	previous, enrolled := s.Peers[peerId]
+	s.Used[invite.Id]++
+	s.Peers[peerId] = invite.Id
+	if err := s.save(); err != nil {
+		// roll back so that the token isn't used up by the failed attempts
+		s.Used[invite.Id]--
+		if s.Used[invite.Id] == 0 {
+			delete(s.Used, invite.Id)
+		}
+		if enrolled {
+			s.Peers[peerId] = previous
+		} else {
+			delete(s.Peers, peerId)
+		}
+		return err
+	}
+	return nil
+}
+
+// should be called with mu locked
+func (s *InviteStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	buff, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.file, buff, 0600); err != nil {
+		return fmt.Errorf("save invite store error: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dhcp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func newKey(t *testing.T) (crypto.PrivKey, string) {
+	t.Helper()
+	priKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priKey, id.Pretty()
+}
+
+func TestInviteSignature(t *testing.T) {
+	priKey, server := newKey(t)
+	token, err := NewInvite(priKey, []string{"/ip4/1.2.3.4/tcp/6543/p2p/" + server}, "v1", "office", 1400, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := ParseInvite(token + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invite.Server != server || invite.Network != "office" || invite.Mtu != 1400 || invite.Uses != 2 || len(invite.Addrs) != 1 {
+		t.Fatalf("unexpected invite %+v", invite)
+	}
+
+	parts := strings.Split(token, ".")
+	encoding := base64.RawURLEncoding
+	payload, _ := encoding.DecodeString(parts[1])
+	// signed by another key but claims the server
+	otherKey, _ := newKey(t)
+	forged, err := otherKey.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the uses raised without signing again
+	raised := strings.Replace(string(payload), `"uses":2`, `"uses":200`, 1)
+	cases := map[string]string{
+		"prefix":    strings.Join([]string{"gvn2", parts[1], parts[2]}, "."),
+		"parts":     strings.Join(parts[:2], "."),
+		"forged":    strings.Join([]string{parts[0], parts[1], encoding.EncodeToString(forged)}, "."),
+		"tampered":  strings.Join([]string{parts[0], encoding.EncodeToString([]byte(raised)), parts[2]}, "."),
+		"signature": strings.Join([]string{parts[0], parts[1], parts[1]}, "."),
+		"garbage":   "gvn1.!.!",
+	}
+	for name, token := range cases {
+		if _, err := ParseInvite(token); err != ErrInviteInvalid {
+			t.Errorf("%s token: got %v, want %v", name, err, ErrInviteInvalid)
+		}
+	}
+}
+
+func TestNewInviteInvalid(t *testing.T) {
+	priKey, _ := newKey(t)
+	cases := map[string]struct {
+		uses int
+		ttl  time.Duration
+	}{
+		"zero uses":     {0, time.Hour},
+		"negative uses": {-1, time.Hour},
+		"zero ttl":      {1, 0},
+		"negative ttl":  {1, -time.Minute},
+	}
+	for name, c := range cases {
+		if _, err := NewInvite(priKey, nil, "v1", "", 0, c.uses, c.ttl); err == nil {
+			t.Errorf("%s: minted the token", name)
+		}
+	}
+}
+
+func TestInviteConsume(t *testing.T) {
+	priKey, server := newKey(t)
+	token, err := NewInvite(priKey, nil, "v1", "", 0, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "invites.json")
+	s := NewInviteStore(file)
+	for _, peerId := range []string{"a", "a", "b"} {
+		if err := s.Consume(token, server, peerId); err != nil {
+			t.Fatalf("consume for %s: %s", peerId, err)
+		}
+	}
+	if err := s.Consume(token, server, "c"); err != ErrInviteConsumed {
+		t.Errorf("got %v once used up, want %v", err, ErrInviteConsumed)
+	}
+	// issued by another server
+	if err := s.Consume(token, "other", "d"); err != ErrInviteInvalid {
+		t.Errorf("got %v for another server, want %v", err, ErrInviteInvalid)
+	}
+	invite, err := ParseInvite(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite.Id = "expired"
+	invite.ExpireAt = time.Now().Add(-time.Minute).Unix()
+	expired, err := signInvite(priKey, invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Consume(expired, server, "d"); err != ErrInviteExpired {
+		t.Errorf("got %v for expired token, want %v", err, ErrInviteExpired)
+	}
+
+	// the uses survive restart
+	s = NewInviteStore(file)
+	if !s.Enrolled("a") || !s.Enrolled("b") || s.Enrolled("c") || s.Enrolled("d") {
+		t.Errorf("unexpected enrolled peers %v", s.Peers)
+	}
+	if err := s.Consume(token, server, "c"); err != ErrInviteConsumed {
+		t.Errorf("got %v once reloaded, want %v", err, ErrInviteConsumed)
+	}
+}
+
+func TestInviteConsumeSaveError(t *testing.T) {
+	priKey, server := newKey(t)
+	token, err := NewInvite(priKey, nil, "v1", "", 0, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewInviteStore(filepath.Join(t.TempDir(), "missing", "invites.json"))
+	if err := s.Consume(token, server, "a"); err == nil {
+		t.Fatal("consumed without saving")
+	}
+	// the failed attempt doesn't use the token up
+	if s.Enrolled("a") || len(s.Used) != 0 {
+		t.Fatalf("state changed by the failed attempt %v %v", s.Used, s.Peers)
+	}
+	s.file = ""
+	if err := s.Consume(token, server, "a"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,349 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liloew/gvn/qos"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// stop relaying for the peer once the quota exceeded
+	QUOTA_REFUSE = "refuse"
+	// limit the rate of the peer once the quota exceeded
+	QUOTA_THROTTLE = "throttle"
+	// kbit/s of the throttled peers if the quota doesn't set rate
+	DEFAULT_THROTTLE_RATE = 1024
+	// the traffic store is saved every
+	TRAFFIC_SAVE_INTERVAL = time.Minute
+	MB                    = 1024 * 1024
+)
+
+// Traffic are the counters of a node to one of its peers since the last report
+type Traffic struct {
+	Peer      string `json:"peer"`
+	TxPackets uint64 `json:"txPackets"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+}
+
+// Quota is the monthly traffic allowed, the one with empty peer applies to all peers without their own
+type Quota struct {
+	Peer string `yaml:"peer,omitempty" json:"peer,omitempty"`
+	// MB sent and received per month
+	Monthly uint64 `yaml:"monthly" json:"monthly"`
+	// refuse or throttle, defaults to throttle
+	Action string `yaml:"action,omitempty" json:"action,omitempty"`
+	// kbit/s once throttled
+	Rate uint64 `yaml:"rate,omitempty" json:"rate,omitempty"`
+}
+
+// Usage is the traffic of a lease in the month
+type Usage struct {
+	Id        string `json:"id"`
+	Month     string `json:"month"`
+	TxPackets uint64 `json:"txPackets"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+	// sent to other peers through the server
+	RelayPackets uint64 `json:"relayPackets"`
+	RelayBytes   uint64 `json:"relayBytes"`
+	// sent and received since the lease created
+	TotalBytes uint64 `json:"totalBytes"`
+	// peer id -> traffic in the month
+	Peers map[string]Traffic `json:"peers"`
+	// the quota in MB, 0 if unlimited
+	Quota    uint64 `json:"quota"`
+	Exceeded bool   `json:"exceeded"`
+	Action   string `json:"action,omitempty"`
+}
+
+// TrafficStore aggregates the traffic reported by nodes and enforces the quotas
+type TrafficStore struct {
+	// persist to the file if not empty
+	file   string
+	quotas []Quota
+	// lease id -> usage
+	Leases map[string]*Usage `json:"leases"`
+	dirty  bool
+	mu     sync.Mutex
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func NewTrafficStore(file string, quotas []Quota) *TrafficStore {
+	store := &TrafficStore{file: file, quotas: quotas, Leases: map[string]*Usage{}, stop: make(chan struct{})}
+	if file != "" {
+		if buff, err := os.ReadFile(file); err == nil {
+			if err := json.Unmarshal(buff, store); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"ERROR": err,
+					"File":  file,
+				}).Error("Load traffic store error")
+			}
+		}
+		go func() {
+			ticker := time.NewTicker(TRAFFIC_SAVE_INTERVAL)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-store.stop:
+					return
+				}
+				if err := store.Save(); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"ERROR": err,
+					}).Error("Save traffic store error")
+				}
+			}
+		}()
+	}
+	return store
+}
+
+// Close stops saving periodically and saves the store for the last time
+func (s *TrafficStore) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	return s.Save()
+}
+
+// Lease starts tracking the traffic of the lease, the traffic of the peers without lease is never tracked
+func (s *TrafficStore) Lease(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage(id)
+}
+
+// Report adds the traffic of the lease, reports whether the quota state changed
+func (s *TrafficStore) Report(id string, traffic []Traffic) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usage(id)
+	// the counters saturate rather than wrap around, so they never go backwards
+	for _, t := range traffic {
+		usage.TxPackets = add(usage.TxPackets, t.TxPackets)
+		usage.TxBytes = add(usage.TxBytes, t.TxBytes)
+		usage.RxPackets = add(usage.RxPackets, t.RxPackets)
+		usage.RxBytes = add(usage.RxBytes, t.RxBytes)
+		usage.TotalBytes = add(usage.TotalBytes, add(t.TxBytes, t.RxBytes))
+		p := usage.Peers[t.Peer]
+		p.Peer = t.Peer
+		p.TxPackets = add(p.TxPackets, t.TxPackets)
+		p.TxBytes = add(p.TxBytes, t.TxBytes)
+		p.RxPackets = add(p.RxPackets, t.RxPackets)
+		p.RxBytes = add(p.RxBytes, t.RxBytes)
+		usage.Peers[t.Peer] = p
+	}
+	s.dirty = s.dirty || len(traffic) > 0
+	return s.check(usage)
+}
+
+// Relay counts the packet relayed by server from one peer to another, false if either of them is refused. The bytes
+// relayed count toward the quota of the sender even if it reports less, the peers without lease are not tracked
+func (s *TrafficStore) Relay(from string, to string, size int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Leases[to]; ok && refused(s.usage(to)) {
+		return false
+	}
+	if _, ok := s.Leases[from]; !ok {
+		return true
+	}
+	usage := s.usage(from)
+	if refused(usage) {
+		return false
+	}
+	usage.RelayPackets = add(usage.RelayPackets, 1)
+	usage.RelayBytes = add(usage.RelayBytes, uint64(size))
+	// the quota state is updated by the next report, so that the change is pushed
+	s.dirty = true
+	return true
+}
+
+// SetQuotas replaces the quotas, reports whether the quota state of any lease changed
+func (s *TrafficStore) SetQuotas(quotas []Quota) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas = quotas
+	changed := false
+	for _, usage := range s.Leases {
+		changed = s.check(usage) || changed
+	}
+	return changed
+}
+
+// Throttled returns the rate limits of the leases exceeded their throttle quotas
+func (s *TrafficStore) Throttled() []qos.Limit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limits := make([]qos.Limit, 0)
+	for id := range s.Leases {
+		usage := s.usage(id)
+		if !usage.Exceeded || usage.Action != QUOTA_THROTTLE {
+			continue
+		}
+		rate := uint64(DEFAULT_THROTTLE_RATE)
+		if quota, ok := s.quota(id); ok && quota.Rate > 0 {
+			rate = quota.Rate
+		}
+		limits = append(limits, qos.Limit{Peer: id, Rate: rate})
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		return limits[i].Peer < limits[j].Peer
+	})
+	return limits
+}
+
+// Usage returns a copy of the usage of the lease
+func (s *TrafficStore) Usage(id string) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyUsage(s.usage(id))
+}
+
+// Usages returns a copy of all the usages ordered by lease id
+func (s *TrafficStore) Usages() []Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usages := make([]Usage, 0, len(s.Leases))
+	for id := range s.Leases {
+		usages = append(usages, copyUsage(s.usage(id)))
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Id < usages[j].Id
+	})
+	return usages
+}
+
+// Save writes the store to the file if changed
+func (s *TrafficStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == "" || !s.dirty {
+		return nil
+	}
+	buff, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.file, buff, 0600); err != nil {
+		return fmt.Errorf("save traffic store error: %s", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// the usage of the current month, should be called with mu locked
+func (s *TrafficStore) usage(id string) *Usage {
+	month := time.Now().UTC().Format("2006-01")
+	usage, ok := s.Leases[id]
+	if !ok {
+		usage = &Usage{Id: id, Month: month, Peers: map[string]Traffic{}}
+		s.Leases[id] = usage
+		s.check(usage)
+	} else if usage.Month != month {
+		// the total is kept across months
+		*usage = Usage{Id: id, Month: month, TotalBytes: usage.TotalBytes, Peers: map[string]Traffic{}}
+		s.dirty = true
+		s.check(usage)
+	}
+	if usage.Peers == nil {
+		usage.Peers = map[string]Traffic{}
+	}
+	return usage
+}
+
+// update the quota state, should be called with mu locked
+func (s *TrafficStore) check(usage *Usage) bool {
+	exceeded, action := usage.Exceeded, usage.Action
+	usage.Quota, usage.Exceeded, usage.Action = 0, false, ""
+	if quota, ok := s.quota(usage.Id); ok {
+		usage.Quota = quota.Monthly
+		usage.Action = quota.Action
+		if usage.Action == "" {
+			usage.Action = QUOTA_THROTTLE
+		}
+		usage.Exceeded = used(usage) >= quota.Monthly*MB
+	}
+	if usage.Exceeded && !exceeded {
+		logrus.WithFields(logrus.Fields{
+			"ID":     usage.Id,
+			"Quota":  usage.Quota,
+			"Action": usage.Action,
+		}).Warn("Monthly quota exceeded")
+	}
+	return usage.Exceeded != exceeded || usage.Action != action
+}
+
+// the quota of the peer itself or the default one
+func (s *TrafficStore) quota(id string) (Quota, bool) {
+	var fallback *Quota
+	for i, q := range s.quotas {
+		if q.Peer == id {
+			return q, q.Monthly > 0
+		}
+		if q.Peer == "" && fallback == nil {
+			fallback = &s.quotas[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, fallback.Monthly > 0
+	}
+	return Quota{}, false
+}
+
+// the bytes counted toward the quota, never less than the server relayed for the lease
+func used(usage *Usage) uint64 {
+	reported := add(usage.TxBytes, usage.RxBytes)
+	if usage.RelayBytes > reported {
+		return usage.RelayBytes
+	}
+	return reported
+}
+
+// add saturates at the max rather than wraps around
+func add(a uint64, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+func refused(usage *Usage) bool {
+	return usage.Exceeded && usage.Action == QUOTA_REFUSE
+}
+
+func copyUsage(usage *Usage) Usage {
+	u := *usage
+	u.Peers = make(map[string]Traffic, len(usage.Peers))
+	for k, v := range usage.Peers {
+		u.Peers[k] = v
+	}
+	return u
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dhcp
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	s := NewTrafficStore("", []Quota{{Monthly: 1}, {Peer: "b", Monthly: 2, Action: QUOTA_REFUSE}})
+	defer s.Close()
+	s.Lease("a")
+	s.Lease("b")
+	if s.Report("a", []Traffic{{Peer: "b", TxBytes: MB / 2, RxBytes: MB/2 - 1}}) {
+		t.Error("quota exceeded below the quota")
+	}
+	if !s.Report("a", []Traffic{{Peer: "b", TxBytes: 1}}) {
+		t.Error("quota state unchanged once exceeded")
+	}
+	if u := s.Usage("a"); !u.Exceeded || u.Action != QUOTA_THROTTLE || u.Quota != 1 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+	if limits := s.Throttled(); len(limits) != 1 || limits[0].Peer != "a" || limits[0].Rate != DEFAULT_THROTTLE_RATE {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+
+	// the peer of its own quota is refused once exceeded, the packets to it as well
+	s.Report("b", []Traffic{{Peer: "a", TxBytes: 2 * MB}})
+	if s.Relay("b", "a", 100) || s.Relay("a", "b", 100) {
+		t.Error("relay for the refused peer")
+	}
+	if !s.SetQuotas(nil) || s.Usage("b").Exceeded || !s.Relay("b", "a", 100) {
+		t.Error("still refused once the quotas removed")
+	}
+}
+
+func TestRelayCountsTowardQuota(t *testing.T) {
+	s := NewTrafficStore("", []Quota{{Monthly: 1, Action: QUOTA_REFUSE}})
+	defer s.Close()
+	s.Lease("a")
+	s.Lease("b")
+	for i := 0; i < 4; i++ {
+		if !s.Relay("a", "b", MB/4) {
+			t.Fatal("relay refused below the quota")
+		}
+	}
+	// reports nothing but the server relayed the quota
+	if !s.Report("a", nil) || !s.Usage("a").Exceeded || s.Relay("a", "b", 1) {
+		t.Error("the bytes relayed are not counted toward the quota")
+	}
+
+	// the peers without lease are not tracked
+	if !s.Relay("c", "b", MB) {
+		t.Error("relay refused for the peer without lease")
+	}
+	for _, u := range s.Usages() {
+		if u.Id == "c" {
+			t.Error("the peer without lease tracked")
+		}
+	}
+}
+
+func TestReportSaturates(t *testing.T) {
+	s := NewTrafficStore("", []Quota{{Monthly: 1}})
+	defer s.Close()
+	s.Lease("a")
+	s.Report("a", []Traffic{{Peer: "b", TxBytes: 2 * MB}})
+	// wrap the counters around to go back under the quota
+	s.Report("a", []Traffic{{Peer: "b", TxBytes: math.MaxUint64 - MB}})
+	if u := s.Usage("a"); u.TxBytes != math.MaxUint64 || !u.Exceeded {
+		t.Errorf("the counters went backwards %+v", u)
+	}
+}
+
+func TestMonthRollover(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "gvn-traffic.json")
+	s := NewTrafficStore(filename, []Quota{{Monthly: 1}})
+	s.Lease("a")
+	s.Report("a", []Traffic{{Peer: "b", TxBytes: 2 * MB}})
+	s.Relay("a", "b", 100)
+	s.mu.Lock()
+	s.Leases["a"].Month = "2000-01"
+	s.mu.Unlock()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reloaded from the file
+	s = NewTrafficStore(filename, []Quota{{Monthly: 1}})
+	defer s.Close()
+	u := s.Usage("a")
+	if u.Month == "2000-01" || u.TxBytes != 0 || u.RelayBytes != 0 || len(u.Peers) != 0 || u.Exceeded {
+		t.Errorf("the usage of last month kept %+v", u)
+	}
+	if u.TotalBytes != 2*MB {
+		t.Errorf("total %d, want %d", u.TotalBytes, 2*MB)
+	}
+}
@@ -16,48 +16,259 @@ limitations under the License.
 package eventbus
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
+const (
+	// the events buffered per subscription if the size is not given
+	DEFAULT_BUFFER_SIZE = 64
+)
+
+// OverflowPolicy decides what to do once the buffer of a subscription is full
+type OverflowPolicy int
+
+const (
+	// the publisher waits until the subscriber catches up
+	Block OverflowPolicy = iota
+	// the new event is dropped
+	DropNewest
+	// the oldest buffered event is dropped for the new one
+	DropOldest
+)
+
+var (
+	ErrClosed = errors.New("event bus closed")
+)
+
+// Topic is the name of the events and the type of their data
+type Topic struct {
+	Name string
+	typ  reflect.Type
+}
+
+// NewTopic defines the topic carries the data of the same type as sample, any data is allowed if sample is nil
+func NewTopic(name string, sample interface{}) Topic {
+	return Topic{Name: name, typ: reflect.TypeOf(sample)}
+}
+
+func (t Topic) String() string {
+	return t.Name
+}
+
 type DataEvent struct {
 	Data  interface{}
-	Topic string
+	Topic Topic
 }
 
-// DataChannel is a channel which can accept an DataEvent
-type DataChannel chan DataEvent
+// Subscription receives the events of its topics from C in the order they published
+type Subscription struct {
+	C      <-chan DataEvent
+	ch     chan DataEvent
+	topics []Topic
+	policy OverflowPolicy
+	bus    *EventBus
+	// unblocks the blocked publishers once unsubscribed
+	done      chan struct{}
+	closed    bool
+	delivered uint64
+	dropped   uint64
+	// serializes the deliveries so that the order is kept
+	mu   sync.Mutex
+	once sync.Once
+}
 
-// DataChannelSlice is a slice of DataChannels
-type DataChannelSlice []DataChannel
+// Stats are the counters of a subscription
+type Stats struct {
+	Topics   []string `json:"topics"`
+	Depth    int      `json:"depth"`
+	Capacity int      `json:"capacity"`
+	// queued to the subscription, including the ones dropped later by DropOldest
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
 
-// EventBus stores the information about subscribers interested for a particular topic
+// EventBus delivers the events published to the subscribers of the topic
 type EventBus struct {
-	Subscribers map[string]DataChannelSlice
+	subscribers map[Topic][]*Subscription
+	closed      bool
 	rm          sync.RWMutex
 }
 
-func (eb *EventBus) Publish(topic string, data interface{}) {
+func New() *EventBus {
+	return &EventBus{subscribers: map[Topic][]*Subscription{}}
+}
+
+// Publish delivers the data to all the subscribers of the topic, the error is returned if the bus closed or the
+// data doesn't match the type of the topic
+func (eb *EventBus) Publish(topic Topic, data interface{}) error {
+	if topic.typ != nil && reflect.TypeOf(data) != topic.typ {
+		return fmt.Errorf("topic %s requires %s but %T published", topic.Name, topic.typ, data)
+	}
 	eb.rm.RLock()
-	if chans, found := eb.Subscribers[topic]; found {
-		// this is done because the slices refer to same array even though they are passed by value
-		// thus we are creating a new slice with our elements thus preserve locking correctly.
-		// special thanks for /u/freesid who pointed it out
-		channels := append(DataChannelSlice{}, chans...)
-		go func(data DataEvent, dataChannelSlices DataChannelSlice) {
-			for _, ch := range dataChannelSlices {
-				ch <- data
-			}
-		}(DataEvent{Data: data, Topic: topic}, channels)
+	if eb.closed {
+		eb.rm.RUnlock()
+		return ErrClosed
 	}
+	subscriptions := append([]*Subscription{}, eb.subscribers[topic]...)
 	eb.rm.RUnlock()
+	event := DataEvent{Data: data, Topic: topic}
+	for _, s := range subscriptions {
+		s.deliver(event)
+	}
+	return nil
+}
+
+// Subscribe subscribes the topics with a buffer of size events, the events of all the topics are received in order
+func (eb *EventBus) Subscribe(size int, policy OverflowPolicy, topics ...Topic) *Subscription {
+	if size <= 0 {
+		size = DEFAULT_BUFFER_SIZE
+	}
+	ch := make(chan DataEvent, size)
+	s := &Subscription{C: ch, ch: ch, topics: topics, policy: policy, bus: eb, done: make(chan struct{})}
+	eb.rm.Lock()
+	defer eb.rm.Unlock()
+	if eb.closed {
+		s.close()
+		return s
+	}
+	for _, topic := range topics {
+		eb.subscribers[topic] = append(eb.subscribers[topic], s)
+	}
+	return s
 }
 
-func (eb *EventBus) Subscribe(topic string, ch DataChannel) {
+// Unsubscribe stops the deliveries and closes C of the subscription
+func (eb *EventBus) Unsubscribe(s *Subscription) {
+	s.close()
 	eb.rm.Lock()
-	if prev, found := eb.Subscribers[topic]; found {
-		eb.Subscribers[topic] = append(prev, ch)
-	} else {
-		eb.Subscribers[topic] = append([]DataChannel{}, ch)
+	defer eb.rm.Unlock()
+	for _, topic := range s.topics {
+		subscriptions := eb.subscribers[topic]
+		for i, current := range subscriptions {
+			if current == s {
+				eb.subscribers[topic] = append(subscriptions[:i:i], subscriptions[i+1:]...)
+				break
+			}
+		}
+		if len(eb.subscribers[topic]) == 0 {
+			delete(eb.subscribers, topic)
+		}
 	}
+}
+
+// Close unsubscribes all the subscriptions, the events published after are refused
+func (eb *EventBus) Close() {
+	eb.rm.Lock()
+	eb.closed = true
+	subscriptions := eb.subscriptions()
+	eb.subscribers = map[Topic][]*Subscription{}
 	eb.rm.Unlock()
+	for _, s := range subscriptions {
+		s.close()
+	}
+}
+
+// Stats returns the counters of all the subscriptions
+func (eb *EventBus) Stats() []Stats {
+	eb.rm.RLock()
+	subscriptions := eb.subscriptions()
+	eb.rm.RUnlock()
+	stats := make([]Stats, 0, len(subscriptions))
+	for _, s := range subscriptions {
+		stats = append(stats, s.Stats())
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return fmt.Sprint(stats[i].Topics) < fmt.Sprint(stats[j].Topics)
+	})
+	return stats
+}
+
+// the distinct subscriptions, should be called with rm locked
+func (eb *EventBus) subscriptions() []*Subscription {
+	seen := map[*Subscription]bool{}
+	subscriptions := make([]*Subscription, 0)
+	for _, ss := range eb.subscribers {
+		for _, s := range ss {
+			if !seen[s] {
+				seen[s] = true
+				subscriptions = append(subscriptions, s)
+			}
+		}
+	}
+	return subscriptions
+}
+
+func (s *Subscription) Unsubscribe() {
+	s.bus.Unsubscribe(s)
+}
+
+// Depth returns the number of events waiting to be received
+func (s *Subscription) Depth() int {
+	return len(s.ch)
+}
+
+func (s *Subscription) Stats() Stats {
+	topics := make([]string, 0, len(s.topics))
+	for _, t := range s.topics {
+		topics = append(topics, t.Name)
+	}
+	return Stats{
+		Topics:    topics,
+		Depth:     len(s.ch),
+		Capacity:  cap(s.ch),
+		Delivered: atomic.LoadUint64(&s.delivered),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+	}
+}
+
+func (s *Subscription) deliver(event DataEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.policy {
+	case DropNewest:
+		select {
+		case s.ch <- event:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		}
+	case DropOldest:
+		for sent := false; !sent; {
+			select {
+			case s.ch <- event:
+				sent = true
+			default:
+				select {
+				case <-s.ch:
+					atomic.AddUint64(&s.dropped, 1)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case s.ch <- event:
+		case <-s.done:
+			return
+		}
+	}
+	atomic.AddUint64(&s.delivered, 1)
+}
+
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
 }
@@ -0,0 +1,122 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package eventbus
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	ADD    = NewTopic("ADD", 0)
+	REMOVE = NewTopic("REMOVE", 0)
+	ANY    = NewTopic("ANY", nil)
+)
+
+func TestOrderAcrossTopics(t *testing.T) {
+	bus := New()
+	s := bus.Subscribe(0, Block, ADD, REMOVE)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			bus.Publish(ADD, i)
+			bus.Publish(REMOVE, i)
+		}
+		bus.Close()
+	}()
+	i, add := 0, true
+	for e := range s.C {
+		if e.Data.(int) != i || (e.Topic == ADD) != add {
+			t.Fatalf("received %s %d, %d expected", e.Topic, e.Data, i)
+		}
+		if !add {
+			i++
+		}
+		add = !add
+	}
+	if i != 1000 {
+		t.Errorf("%d events received, 1000 expected", i)
+	}
+}
+
+func TestTypedTopic(t *testing.T) {
+	bus := New()
+	if err := bus.Publish(ADD, "one"); err == nil {
+		t.Error("string published to int topic")
+	}
+	if err := bus.Publish(ANY, "one"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	bus := New()
+	newest := bus.Subscribe(2, DropNewest, ADD)
+	oldest := bus.Subscribe(2, DropOldest, ADD)
+	for i := 0; i < 5; i++ {
+		bus.Publish(ADD, i)
+	}
+	if got := []int{(<-newest.C).Data.(int), (<-newest.C).Data.(int)}; got[0] != 0 || got[1] != 1 {
+		t.Errorf("DropNewest kept %v", got)
+	}
+	if got := []int{(<-oldest.C).Data.(int), (<-oldest.C).Data.(int)}; got[0] != 3 || got[1] != 4 {
+		t.Errorf("DropOldest kept %v", got)
+	}
+	if stats := newest.Stats(); stats.Dropped != 3 || stats.Delivered != 2 || stats.Capacity != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats := oldest.Stats(); stats.Dropped != 3 || stats.Delivered != 5 || stats.Capacity != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestUnsubscribeUnblocksPublisher(t *testing.T) {
+	bus := New()
+	s := bus.Subscribe(1, Block, ADD)
+	other := bus.Subscribe(0, Block, ADD)
+	bus.Publish(ADD, 0)
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(ADD, 1)
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publisher not blocked by full subscription")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if depth := s.Depth(); depth != 1 {
+		t.Errorf("depth %d, 1 expected", depth)
+	}
+	s.Unsubscribe()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publisher still blocked after unsubscribed")
+	}
+	if _, ok := <-s.C; !ok {
+		t.Error("buffered event lost after unsubscribed")
+	}
+	if _, ok := <-s.C; ok {
+		t.Error("C not closed after unsubscribed")
+	}
+	if len(bus.Stats()) != 1 || other.Depth() != 2 {
+		t.Errorf("unexpected stats %+v", bus.Stats())
+	}
+	bus.Close()
+	if err := bus.Publish(ADD, 2); err != ErrClosed {
+		t.Errorf("published after closed: %v", err)
+	}
+}
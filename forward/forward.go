@@ -0,0 +1,332 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liloew/gvn/netstack"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PROTO_TCP = "tcp"
+	PROTO_UDP = "udp"
+	// the UDP sessions idle for are closed
+	UDP_TIMEOUT = time.Minute
+	// the targets must be connected in
+	DIAL_TIMEOUT = 10 * time.Second
+)
+
+// Rule forwards the connections to Listen to Target. Listen is a port of VIP and Target a local or LAN address by
+// default, or a local address and a remote VIP:port once reversed
+type Rule struct {
+	// tcp or udp, tcp by default
+	Proto string `yaml:"proto,omitempty" json:"proto,omitempty"`
+	// the port or address listened on, the host is VIP or 127.0.0.1 once reversed if omitted
+	Listen  string `yaml:"listen" json:"listen"`
+	Target  string `yaml:"target" json:"target"`
+	Reverse bool   `yaml:"reverse,omitempty" json:"reverse,omitempty"`
+}
+
+func (r Rule) proto() string {
+	if r.Proto == "" {
+		return PROTO_TCP
+	}
+	return r.Proto
+}
+
+// Validate checks the rule without the VIP known
+func (r Rule) Validate() error {
+	if r.proto() != PROTO_TCP && r.proto() != PROTO_UDP {
+		return fmt.Errorf("unknown proto %q", r.Proto)
+	}
+	if _, err := listenAddress(r.Listen, "0.0.0.0"); err != nil {
+		return err
+	}
+	if host, port, err := net.SplitHostPort(r.Target); err != nil || host == "" || port == "" {
+		return fmt.Errorf("invalid target %q", r.Target)
+	}
+	return nil
+}
+
+// Key identifies the rule, no two rules listen on the same address
+func (r Rule) Key() string {
+	listen, err := listenAddress(r.Listen, "")
+	if err != nil {
+		listen = r.Listen
+	}
+	key := r.proto() + " " + listen
+	if r.Reverse {
+		key += " reverse"
+	}
+	return key
+}
+
+// the address of listen, which is a port or an address, host is used if omitted
+func listenAddress(listen string, host string) (string, error) {
+	if _, err := strconv.ParseUint(listen, 10, 16); err == nil {
+		return net.JoinHostPort(host, listen), nil
+	}
+	h, port, err := net.SplitHostPort(listen)
+	if _, e := strconv.ParseUint(port, 10, 16); err != nil || e != nil {
+		return "", fmt.Errorf("invalid listen address %q", listen)
+	}
+	if h == "" {
+		h = host
+	}
+	return net.JoinHostPort(h, port), nil
+}
+
+// Network dials and listens on one side of the rules, the system or the userspace stack
+type Network interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+	Listen(network string, address string) (net.Listener, error)
+	ListenPacket(network string, address string) (net.PacketConn, error)
+}
+
+// System is the network of the system
+type System struct{}
+
+func (System) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (System) Listen(network string, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (System) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+// Status is a rule running
+type Status struct {
+	Rule
+	// the address listened on
+	Address string `json:"address"`
+	// the connections or UDP sessions being forwarded
+	Active int64 `json:"active"`
+}
+
+type forwarding struct {
+	rule     Rule
+	address  string
+	listener net.Listener
+	conn     net.PacketConn
+	active   int64
+}
+
+func (f *forwarding) close() {
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+// Manager runs the rules of a network
+type Manager struct {
+	vip string
+	// listens on VIP and dials the remote VIPs
+	overlay Network
+	// listens on and dials the local or LAN addresses
+	local Network
+	// rule key -> the rule running
+	rules map[string]*forwarding
+	mu    sync.Mutex
+}
+
+// NewManager runs the rules on the VIP without mask, overlay and local are the same System in TUN mode
+func NewManager(vip string, overlay Network, local Network) *Manager {
+	return &Manager{vip: vip, overlay: overlay, local: local, rules: map[string]*forwarding{}}
+}
+
+// Add starts to forward by the rule
+func (m *Manager) Add(rule Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	rule.Proto = rule.proto()
+	listenOn, dialVia, host := m.overlay, m.local, m.vip
+	if rule.Reverse {
+		listenOn, dialVia, host = m.local, m.overlay, "127.0.0.1"
+	}
+	address, _ := listenAddress(rule.Listen, host)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rules[rule.Key()]; ok {
+		return fmt.Errorf("%s is forwarded already", rule.Key())
+	}
+	f := &forwarding{rule: rule, address: address}
+	var err error
+	if rule.Proto == PROTO_TCP {
+		if f.listener, err = listenOn.Listen("tcp", address); err != nil {
+			return err
+		}
+		f.address = f.listener.Addr().String()
+		go m.serveTCP(f, dialVia)
+	} else {
+		if f.conn, err = listenOn.ListenPacket("udp", address); err != nil {
+			return err
+		}
+		f.address = f.conn.LocalAddr().String()
+		go m.serveUDP(f, dialVia)
+	}
+	m.rules[rule.Key()] = f
+	logrus.WithFields(logrus.Fields{
+		"Proto":   rule.Proto,
+		"Listen":  f.address,
+		"Target":  rule.Target,
+		"Reverse": rule.Reverse,
+	}).Info("Forward rule added")
+	return nil
+}
+
+// Remove stops the rule of the same key and closes its connections
+func (m *Manager) Remove(rule Rule) error {
+	rule.Proto = rule.proto()
+	m.mu.Lock()
+	f, ok := m.rules[rule.Key()]
+	delete(m.rules, rule.Key())
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no forward rule %s", rule.Key())
+	}
+	f.close()
+	return nil
+}
+
+// Rules returns the rules running ordered by key
+func (m *Manager) Rules() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules := make([]Status, 0, len(m.rules))
+	for _, f := range m.rules {
+		rules = append(rules, Status{Rule: f.rule, Address: f.address, Active: atomic.LoadInt64(&f.active)})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Key() < rules[j].Key()
+	})
+	return rules
+}
+
+// Close stops all the rules
+func (m *Manager) Close() {
+	m.mu.Lock()
+	rules := m.rules
+	m.rules = map[string]*forwarding{}
+	m.mu.Unlock()
+	for _, f := range rules {
+		f.close()
+	}
+}
+
+func (m *Manager) serveTCP(f *forwarding, dial Network) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			atomic.AddInt64(&f.active, 1)
+			defer atomic.AddInt64(&f.active, -1)
+			ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+			defer cancel()
+			target, err := dial.DialContext(ctx, "tcp", f.rule.Target)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"ERROR":  err,
+					"Target": f.rule.Target,
+				}).Error("Forward the connection error")
+				conn.Close()
+				return
+			}
+			netstack.Pipe(conn, target)
+		}()
+	}
+}
+
+// every client address is a session with its own connection to the target, the replies are sent back to the client
+func (m *Manager) serveUDP(f *forwarding, dial Network) {
+	sessions := map[string]net.Conn{}
+	var mu sync.Mutex
+	buff := make([]byte, 65535)
+	for {
+		n, from, err := f.conn.ReadFrom(buff)
+		if err != nil {
+			// closed by Remove
+			mu.Lock()
+			for _, session := range sessions {
+				session.Close()
+			}
+			mu.Unlock()
+			return
+		}
+		mu.Lock()
+		session, ok := sessions[from.String()]
+		mu.Unlock()
+		if !ok {
+			ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+			session, err = dial.DialContext(ctx, "udp", f.rule.Target)
+			cancel()
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"ERROR":  err,
+					"Target": f.rule.Target,
+				}).Error("Forward the UDP packets error")
+				continue
+			}
+			mu.Lock()
+			sessions[from.String()] = session
+			mu.Unlock()
+			atomic.AddInt64(&f.active, 1)
+			go func(from net.Addr, session net.Conn) {
+				defer func() {
+					mu.Lock()
+					delete(sessions, from.String())
+					mu.Unlock()
+					session.Close()
+					atomic.AddInt64(&f.active, -1)
+				}()
+				reply := make([]byte, 65535)
+				for {
+					n, err := session.Read(reply)
+					if err != nil {
+						return
+					}
+					session.SetReadDeadline(time.Now().Add(UDP_TIMEOUT))
+					if _, err := f.conn.WriteTo(reply[:n], from); err != nil {
+						return
+					}
+				}
+			}(from, session)
+		}
+		// the session is kept as long as either side sends
+		session.SetReadDeadline(time.Now().Add(UDP_TIMEOUT))
+		session.Write(buff[:n])
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echo serves the TCP lines and UDP packets received with the prefix on the same port
+func echo(t *testing.T, prefix string) (string, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		conn.Close()
+	})
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				fmt.Fprintf(c, "%s%s", prefix, line)
+			}()
+		}
+	}()
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(prefix), buff[:n]...), from)
+		}
+	}()
+	return listener.Addr().String(), conn.LocalAddr().String()
+}
+
+func TestRule(t *testing.T) {
+	for _, rule := range []Rule{{Listen: "5432", Target: "127.0.0.1:5432"}, {Proto: "udp", Listen: "127.0.0.1:53", Target: "10.0.0.2:53", Reverse: true}} {
+		if err := rule.Validate(); err != nil {
+			t.Errorf("%v is invalid: %s", rule, err)
+		}
+	}
+	for _, rule := range []Rule{{Proto: "icmp", Listen: "1", Target: "127.0.0.1:1"}, {Listen: "65536", Target: "127.0.0.1:1"}, {Listen: "22", Target: "22"}} {
+		if err := rule.Validate(); err == nil {
+			t.Errorf("%v is valid", rule)
+		}
+	}
+	if a, b := (Rule{Listen: "22"}).Key(), (Rule{Proto: "tcp", Listen: ":22"}).Key(); a != b {
+		t.Errorf("the keys of the same rule differ: %q %q", a, b)
+	}
+}
+
+func TestManager(t *testing.T) {
+	tcpTarget, udpTarget := echo(t, "echo:")
+	m := NewManager("127.0.0.1", System{}, System{})
+	defer m.Close()
+	if err := m.Add(Rule{Listen: "0", Target: tcpTarget}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(Rule{Proto: PROTO_UDP, Listen: "0", Target: udpTarget, Reverse: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(Rule{Proto: PROTO_TCP, Listen: ":0", Target: tcpTarget}); err == nil {
+		t.Fatal("the same rule added twice")
+	}
+	rules := m.Rules()
+	if len(rules) != 2 {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+
+	conn, err := net.Dial("tcp", rules[0].Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "hello\n")
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "echo:hello\n" {
+		t.Fatalf("unexpected TCP reply %q", line)
+	}
+
+	udp, err := net.Dial("udp", rules[1].Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, payload := range []string{"first", "second"} {
+		udp.Write([]byte(payload))
+		buff := make([]byte, 1500)
+		n, err := udp.Read(buff)
+		if err != nil || string(buff[:n]) != "echo:"+payload {
+			t.Fatalf("unexpected UDP reply %q %v", buff[:n], err)
+		}
+	}
+	if rules := m.Rules(); rules[1].Active != 1 {
+		t.Errorf("%d UDP sessions rather than 1", rules[1].Active)
+	}
+
+	if err := m.Remove(Rule{Listen: "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", rules[0].Address); err == nil {
+		t.Fatal("connected to the rule removed")
+	}
+	if err := m.Remove(Rule{Listen: "0"}); err == nil {
+		t.Fatal("the rule removed twice")
+	}
+}
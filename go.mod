@@ -3,21 +3,29 @@ module github.com/liloew/gvn
 go 1.16
 
 require (
+	github.com/fsnotify/fsnotify v1.5.1
 	github.com/ipfs/go-datastore v0.5.0
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
+	github.com/klauspost/compress v1.11.7
 	github.com/libp2p/go-libp2p v0.17.0
 	github.com/libp2p/go-libp2p-core v0.13.0
 	github.com/libp2p/go-libp2p-discovery v0.6.0
 	github.com/libp2p/go-libp2p-gorpc v0.1.4
 	github.com/libp2p/go-libp2p-kad-dht v0.15.0
+	github.com/libp2p/go-tcp-transport v0.4.0
 	github.com/liloew/wireguard-go v0.0.0-20220224014633-9cd745e6f114
+	github.com/miekg/dns v1.1.43
 	github.com/multiformats/go-multiaddr v0.4.0
 	github.com/sevlyar/go-daemon v0.1.5
-	github.com/sirupsen/logrus v1.6.0
+	github.com/sirupsen/logrus v1.7.0
 	github.com/songgao/packets v0.0.0-20160404182456-549a10cd4091
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	github.com/spf13/cobra v1.3.0
 	github.com/spf13/viper v1.10.0
 	github.com/zmap/go-iptree v0.0.0-20210731043055-d4e632617837
+	golang.org/x/crypto v0.0.0-20211108221036-ceb1ce70b4fa
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+	gvisor.dev/gvisor v0.0.0-20210506004418-fbfeba3024f0
 )
@@ -0,0 +1,112 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gvn
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/dhcp"
+	"github.com/liloew/gvn/forward"
+	"github.com/liloew/gvn/netstack"
+	"github.com/liloew/gvn/p2p"
+	"github.com/liloew/gvn/qos"
+	"github.com/liloew/gvn/route"
+	"github.com/multiformats/go-multiaddr"
+)
+
+type MODE uint
+
+const (
+	MODECLIENT MODE = iota
+	MODESERVER
+)
+
+type Device struct {
+	Name    string   `yaml:"name,omitempty"`
+	Vip     string   `yaml:"vip,omitempty"`
+	Mtu     uint     `yaml:"mtu,omitempty"`
+	Subnets []string `yaml:"subnets,omitempty"`
+	// the lower is preferred among the peers advertise the same subnets
+	Metric int `yaml:"metric,omitempty"`
+	// clamp the MSS of TCP SYN packets to fit in the overlay MTU
+	MssClamp bool `yaml:"mssClamp,omitempty"`
+	// layer 2 mode, the TAP device is bridged with the peers by a virtual switch, all the nodes must enable it
+	Tap bool `yaml:"tap,omitempty"`
+}
+
+// Config is the config file of gvn, each network of it runs as a node
+type Config struct {
+	// informational only, the node always uses the id derived from its key
+	Id      string `yaml:"id,omitempty"`
+	Port    uint   `yaml:"port,omitempty"`
+	Mode    MODE   `yaml:"mode,omitempty"`
+	Server  string `yaml:"server,omitempty"`
+	Dev     Device `yaml:"dev,omitempty"`
+	Version string `yaml:"version"`
+	PriKey  string `yaml:"priKey,omitempty"`
+	PubKey  string `yaml:"pubKey,omitempty"`
+	// the private key file, must be accessible by owner only
+	KeyFile string `yaml:"keyFile,omitempty"`
+	// only the peers joined with invite token are allowed in server mode
+	InviteOnly bool `yaml:"inviteOnly,omitempty"`
+	// compress the packets to the peers enabled compression as well
+	Compression bool `yaml:"compression,omitempty"`
+	// the rate limits and priority classes pushed to all nodes in server mode
+	Qos qos.Policy `yaml:"qos,omitempty"`
+	// the monthly traffic quotas of the leases in server mode
+	Quotas []dhcp.Quota `yaml:"quotas,omitempty"`
+	// switch back to the preferred subnet router once it recovered (preempt) or not (sticky)
+	Failback route.Failback `yaml:"failback,omitempty"`
+	// discover the peers of the same network on the LAN via mDNS
+	Mdns bool `yaml:"mdns,omitempty"`
+	// the id of the gvn network, the nodes of other networks are refused and never share the DHT
+	Network string `yaml:"network,omitempty"`
+	// the pre-shared key file of the private network, only the nodes holding it can connect
+	PskFile string `yaml:"pskFile,omitempty"`
+	// the name of the network listed in networks
+	Name string `yaml:"name,omitempty"`
+	// the broadcast and multicast packets forwarded to the peers in TUN mode
+	Flood p2p.FloodConfig `yaml:"flood,omitempty"`
+	// run in the userspace network stack rather than the TUN device, the overlay is reached via the proxies
+	Netstack netstack.Config `yaml:"netstack,omitempty"`
+	// the ports of VIP forwarded to the local services and the local ports forwarded to the peers
+	Forwards []forward.Rule `yaml:"forwards,omitempty"`
+	// the networks run by one process, each is configured as a whole config file without networks
+	Networks []Config `yaml:"networks,omitempty"`
+}
+
+// Networks returns the networks of config, the config itself unless it lists the networks
+func Networks(config Config) []Config {
+	if len(config.Networks) > 0 {
+		return config.Networks
+	}
+	return []Config{config}
+}
+
+// NetworkName is the name of the gvn network, the id of the server unless the network id given
+func NetworkName(config Config, self string) string {
+	if config.Network != "" {
+		return config.Network
+	}
+	if config.Mode == MODESERVER {
+		return self
+	}
+	if ma, err := multiaddr.NewMultiaddr(config.Server); err == nil {
+		if addr, err := peer.AddrInfoFromP2pAddr(ma); err == nil {
+			return addr.ID.Pretty()
+		}
+	}
+	return config.Server
+}
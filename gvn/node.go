@@ -0,0 +1,680 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gvn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/liloew/gvn/dhcp"
+	"github.com/liloew/gvn/eventbus"
+	"github.com/liloew/gvn/forward"
+	"github.com/liloew/gvn/internal/strslice"
+	"github.com/liloew/gvn/keystore"
+	"github.com/liloew/gvn/netstack"
+	"github.com/liloew/gvn/p2p"
+	"github.com/liloew/gvn/qos"
+	"github.com/liloew/gvn/route"
+	"github.com/liloew/gvn/tun"
+	"github.com/sirupsen/logrus"
+	"github.com/songgao/water/waterutil"
+)
+
+const (
+	// seconds between the heartbeats to server in client mode
+	INTERVAL = 30
+	// the stores of server live in Dir, suffixed with the name of the network if named
+	INVITE_STORE  = "gvn-invites"
+	TRAFFIC_STORE = "gvn-traffic"
+	// the events waiting for the callbacks, the oldest ones are dropped once full
+	EVENT_QUEUE = 256
+)
+
+// Node is a node of an overlay network, the nodes in one process share nothing but the process itself: each has its
+// own host, TUN device, event bus and route table
+type Node struct {
+	// the directory of the stores in server mode and the relative key files, the working directory if empty
+	Dir string
+	// called once the VIP is assigned
+	OnUp func(vip string)
+	// called once a peer connected or disconnected
+	OnPeer func(peerId string, online bool)
+	// called once the routes via a peer added, refreshed by the lease or removed
+	OnRoute func(event route.RouteEvent, added bool)
+
+	config    Config
+	host      host.Host
+	bus       *eventbus.EventBus
+	router    *route.SystemRouter
+	routes    *route.RouteTable
+	shaper    *qos.Shaper
+	forwarder *p2p.Forwarder
+	health    *p2p.HealthChecker
+	mdns      *p2p.MDNS
+	// the DHCP service in server mode
+	service *dhcp.DHCPService
+	// calls the server, the server itself in server mode
+	client *dhcp.Client
+	// the traffic accounting in server mode
+	traffic *dhcp.TrafficStore
+	// the usage of the lease returned by server in client mode
+	lastUsage atomic.Value
+	// the subnets and metric pushed to server
+	subnets []string
+	metric  int
+	dev     tun.Device
+	device  tun.Interface
+	// the userspace stack in netstack mode and the listeners of its proxies
+	stack   *netstack.Stack
+	proxies []net.Listener
+	// the forward rules running once the VIP is assigned
+	forwards *forward.Manager
+	dht      *dht.IpfsDHT
+	mu       sync.Mutex
+	// done once stopped, the background works of the node run with it
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// New creates the node of the network configured, it joins the network once started
+func New(config Config) *Node {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Node{config: config, subnets: config.Dev.Subnets, metric: config.Dev.Metric, ctx: ctx, cancel: cancel, stop: make(chan struct{})}
+}
+
+// Start joins the network and returns once the VIP is assigned, that is the TUN device is created, the node runs until
+// stopped or ctx done
+func (n *Node) Start(ctx context.Context) (err error) {
+	config := n.config
+	priKey, psk, err := loadKeys(config, n.Dir)
+	if err != nil {
+		return err
+	}
+	n.bus = eventbus.New()
+	if n.OnUp != nil || n.OnPeer != nil || n.OnRoute != nil {
+		go n.notify(n.bus.Subscribe(EVENT_QUEUE, eventbus.DropOldest, route.ONLINE_TOPIC, route.OFFLINE_TOPIC, route.ADD_ROUTE_TOPIC, route.REFRESH_ROUTE_TOPIC, route.REMOVE_ROUTE_TOPIC))
+	}
+	if n.host, err = p2p.NewPeer(priKey, config.Port, psk); err != nil {
+		return fmt.Errorf("create peer error: %s", err)
+	}
+	// leave the network if failed to start
+	defer func() {
+		if err != nil {
+			n.Stop()
+		}
+	}()
+	logrus.WithFields(logrus.Fields{
+		"Network": config.Name,
+		"ID":      n.host.ID().Pretty(),
+		"Addrs":   n.host.Addrs(),
+	}).Info("Peer info")
+
+	if config.Netstack.Enabled {
+		// the routes are never installed into the system, n.router is left nil
+		n.routes = route.NewRouteTable(n.bus, route.NoopRouter{})
+	} else {
+		// the routes are installed via the device of the network only
+		n.router = route.NewSystemRouter(tun.Device{Name: config.Dev.Name})
+		n.routes = route.NewRouteTable(n.bus, n.router)
+	}
+	n.shaper = qos.NewShaper(n.routes, n.bus)
+	// the legacy protocols named by version are kept for rolling upgrade
+	zone := fmt.Sprintf("/gvn/%s", config.Version)
+	rpcZones := []string{p2p.RPC_PROTOCOL_ID, fmt.Sprintf("/rpc/%s", config.Version)}
+	n.forwarder = p2p.NewForwarder(n.host, zone, n.routes)
+	n.forwarder.MssClamp = config.Dev.MssClamp
+	// the sessions with the nodes of other networks are refused
+	n.forwarder.Network = config.Network
+	if config.Compression {
+		n.forwarder.Capabilities = append(n.forwarder.Capabilities, p2p.CapCompression)
+	}
+	if config.Dev.Tap {
+		// the Ethernet frames are switched among the peers rather than routed
+		n.forwarder.Switch = p2p.NewSwitch()
+		n.forwarder.Switch.Start()
+		n.forwarder.Capabilities = append(n.forwarder.Capabilities, p2p.CapTap)
+	}
+	if !config.Dev.Tap && !config.Flood.Empty() {
+		if n.forwarder.Flooder, err = p2p.NewFlooder(config.Flood); err != nil {
+			return fmt.Errorf("invalid flood config: %s", err)
+		}
+	}
+	n.host.SetStreamHandler(protocol.ID(p2p.PROTOCOL_ID), n.forwarder.HandleStream)
+	n.host.SetStreamHandler(protocol.ID(zone), n.forwarder.HandleStream)
+	// fail over between the peers advertise the same subnets
+	n.routes.SetFailback(config.Failback)
+	n.health = p2p.NewHealthChecker(n.host, n.routes)
+	n.health.Start()
+	// the routes via the peers disconnected or timed out by keepalive are switched like the failed ones
+	p2p.NewLiveness(n.host, n.bus, n.forwarder.Peers)
+
+	var bootstraps []string
+	if config.Mode == MODECLIENT {
+		bootstraps = []string{config.Server}
+	} else {
+		// DHT connect to self
+		for _, addr := range n.host.Addrs() {
+			bootstraps = append(bootstraps, fmt.Sprintf("%s/p2p/%s", addr.String(), n.host.ID().Pretty()))
+		}
+		n.traffic = dhcp.NewTrafficStore(resolvePath(n.Dir, storeFile(TRAFFIC_STORE, config.Name)), config.Quotas)
+		n.forwarder.Filter = n.relayAllowed
+		options := dhcp.ServerOptions{
+			Pool:       dhcp.Pool{Cidr: config.Dev.Vip, Mtu: int(config.Dev.Mtu), Subnets: config.Dev.Subnets, Metric: config.Dev.Metric},
+			Invites:    dhcp.NewInviteStore(resolvePath(n.Dir, storeFile(INVITE_STORE, config.Name))),
+			InviteOnly: config.InviteOnly,
+			Policy:     config.Qos,
+			Traffic:    n.traffic,
+		}
+		if n.service, err = dhcp.NewRPCServer(n.host, rpcZones, n.bus, options); err != nil {
+			return err
+		}
+		n.client = n.service.LocalClient()
+	}
+	if n.dht, err = p2p.NewDHT(n.ctx, n.host, zone, config.Network, bootstraps); err != nil {
+		return err
+	}
+	if config.Mdns {
+		// the peers found are connected via LAN even if the server is unreachable
+		n.mdns = p2p.NewMDNS(n.host, n.routes, NetworkName(config, n.host.ID().Pretty()))
+		if err := n.mdns.Start(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"Network": config.Name,
+				"ERROR":   err,
+			}).Error("Start mDNS discovery error")
+		}
+	}
+
+	if config.Mode == MODESERVER {
+		// auto config in server mode
+		err = n.serve(tun.Device{
+			Name:      config.Dev.Name,
+			Ip:        config.Dev.Vip,
+			Mtu:       int(config.Dev.Mtu),
+			ServerVIP: config.Dev.Vip,
+			Port:      config.Port,
+			Tap:       config.Dev.Tap,
+		})
+	} else {
+		err = n.lease(ctx, rpcZones)
+	}
+	if err != nil {
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.Stop()
+		case <-n.stop:
+		}
+	}()
+	return nil
+}
+
+// lease requests the lease in client mode and serves with it, then refreshes the routes and reports the traffic
+// periodically
+func (n *Node) lease(ctx context.Context, rpcZones []string) error {
+	req := dhcp.Request{
+		Id:      n.host.ID().Pretty(),
+		Name:    n.config.Dev.Name,
+		Subnets: n.config.Dev.Subnets,
+		Metric:  n.config.Dev.Metric,
+	}
+	client, res := dhcp.NewRPCClient(ctx, n.host, rpcZones, n.bus, n.config.Server, req)
+	if client == nil {
+		return fmt.Errorf("DHCP from server %s error", n.config.Server)
+	}
+	logrus.WithFields(logrus.Fields{
+		"Network": n.config.Name,
+		"res":     res,
+		"req":     req,
+	}).Info("RPC - Client received data")
+	if n.config.Dev.Mtu != 0 && int(n.config.Dev.Mtu) != res.Mtu {
+		logrus.WithFields(logrus.Fields{
+			"Network": n.config.Name,
+			"Local":   n.config.Dev.Mtu,
+			"Server":  res.Mtu,
+		}).Warn("Ignore the local MTU, use the MTU from server")
+	}
+	n.mu.Lock()
+	n.client = client
+	n.mu.Unlock()
+	n.shaper.Apply(res.Policy)
+	err := n.serve(tun.Device{
+		Name: req.Name,
+		Ip:   res.Ip,
+		Mtu:  res.Mtu,
+		// ignore subnets because of self did't forward it to TUN
+		ServerVIP: res.ServerVIP,
+		Port:      n.config.Port,
+		Tap:       n.config.Dev.Tap,
+	})
+	if err != nil {
+		return err
+	}
+	// the peers are reachable once started rather than after the first heartbeat
+	if err := client.Refresh(req); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR":   err,
+			"Network": n.config.Name,
+		}).Error("Request clients error")
+	}
+	go n.heartbeat(client, req)
+	return nil
+}
+
+// heartbeat refreshes the routes and reports the traffic to server until stopped
+func (n *Node) heartbeat(client *dhcp.Client, req dhcp.Request) {
+	ticker := time.NewTicker(INTERVAL * time.Second)
+	defer ticker.Stop()
+	reported := make(map[string]p2p.Stats)
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stop:
+			return
+		}
+		if err := client.Refresh(req); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR":   err,
+				"Network": n.config.Name,
+			}).Error("Request clients error")
+		}
+		var pong dhcp.Response
+		current := n.peerStats()
+		req.Traffic = trafficSince(reported, current)
+		if err := client.Call("DHCPService", "Ping", req, &pong); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR":   err,
+				"Network": n.config.Name,
+			}).Error("RPC - Ping error")
+		} else {
+			// report the traffic since the last successful Ping only
+			for _, s := range current {
+				reported[s.Peer] = s
+			}
+			n.lastUsage.Store(pong.Usage)
+			// in case of the pushed policy lost
+			n.shaper.Apply(pong.Policy)
+		}
+	}
+}
+
+// serve creates the TUN or TAP device, or the userspace stack in netstack mode, and forwards the packets between it
+// and the peers
+func (n *Node) serve(dev tun.Device) error {
+	logrus.WithFields(logrus.Fields{
+		"Network": n.config.Name,
+		"dev":     dev,
+	}).Info("Create TUN device")
+	var device tun.Interface
+	var err error
+	if n.config.Netstack.Enabled {
+		var stack *netstack.Stack
+		if stack, err = netstack.New(dev.Ip, dev.Mtu); err == nil {
+			device = stack
+			n.mu.Lock()
+			n.stack = stack
+			n.mu.Unlock()
+			err = n.startProxies()
+		}
+	} else if dev.Tap {
+		device, err = tun.NewTap(dev)
+	} else {
+		device, err = tun.NewTun(dev)
+	}
+	n.mu.Lock()
+	n.dev, n.device = dev, device
+	n.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("create TUN device error: %s", err)
+	}
+	if n.router != nil {
+		n.router.SetDevice(dev)
+	}
+	// the sessions negotiate path MTU with it
+	n.forwarder.SetMtu(dev.Mtu)
+	n.forwarder.Vip = net.ParseIP(strings.Split(dev.Ip, "/")[0])
+	if n.forwarder.Flooder != nil {
+		n.forwarder.Flooder.SetNetwork(dev.Ip)
+	}
+	if !dev.Tap {
+		// the packets are sent in order of QoS priority, the frames in TAP mode are switched without QoS
+		n.shaper.Start(n.host.ID().Pretty(), n.forwarder.Forward)
+		n.forwarder.Send = n.shaper.Send
+	}
+	go func() {
+		err := n.forwarder.Serve(device)
+		select {
+		case <-n.stop:
+		default:
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+			}).Error("Stop forwarding the packets from TUN")
+		}
+	}()
+	n.startForwards(device)
+	if n.OnUp != nil {
+		n.OnUp(dev.Ip)
+	}
+	return nil
+}
+
+// startForwards runs the forward rules of config once the VIP is assigned, the VIP is held by the userspace stack in
+// netstack mode
+func (n *Node) startForwards(device tun.Interface) {
+	var overlay forward.Network = forward.System{}
+	if stack, ok := device.(*netstack.Stack); ok {
+		overlay = stack
+	}
+	forwards := forward.NewManager(n.forwarder.Vip.String(), overlay, forward.System{})
+	n.mu.Lock()
+	n.forwards = forwards
+	n.mu.Unlock()
+	for _, rule := range n.config.Forwards {
+		if err := forwards.Add(rule); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR":   err,
+				"Network": n.config.Name,
+				"Rule":    rule.Key(),
+			}).Error("Add forward rule error")
+		}
+	}
+}
+
+// Reload applies the changes of config without restarting, the subnets and metric are pushed to server
+func (n *Node) Reload(config Config) {
+	if n.service != nil {
+		n.service.SetPolicy(config.Qos)
+		n.service.SetQuotas(config.Quotas)
+	}
+	n.routes.SetFailback(config.Failback)
+	n.mu.Lock()
+	client, subnets := n.client, n.subnets
+	unchanged := strslice.Equal(subnets, config.Dev.Subnets) && n.metric == config.Dev.Metric
+	n.mu.Unlock()
+	if unchanged || client == nil {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"Network": config.Name,
+		"Old":     subnets,
+		"Subnets": config.Dev.Subnets,
+		"Metric":  config.Dev.Metric,
+	}).Info("Config file changed, update subnets")
+	req := dhcp.Request{
+		Id:      n.host.ID().Pretty(),
+		Name:    config.Dev.Name,
+		Subnets: config.Dev.Subnets,
+		Metric:  config.Dev.Metric,
+	}
+	if err := client.Call("DHCPService", "UpdateSubnets", req, &dhcp.Response{}); err == nil {
+		n.mu.Lock()
+		n.subnets, n.metric = config.Dev.Subnets, config.Dev.Metric
+		n.mu.Unlock()
+	}
+}
+
+// Stop leaves the network and removes the TUN device, the node can't be started again
+func (n *Node) Stop() {
+	n.once.Do(func() {
+		close(n.stop)
+		n.cancel()
+		if n.dht != nil {
+			n.dht.Close()
+		}
+		if n.shaper != nil {
+			n.shaper.Stop()
+		}
+		if n.health != nil {
+			n.health.Stop()
+		}
+		if n.forwarder != nil && n.forwarder.Switch != nil {
+			n.forwarder.Switch.Stop()
+		}
+		if n.mdns != nil {
+			n.mdns.Close()
+		}
+		if n.traffic != nil {
+			n.traffic.Close()
+		}
+		n.mu.Lock()
+		dev, device, proxies, forwards := n.dev, n.device, n.proxies, n.forwards
+		n.mu.Unlock()
+		if forwards != nil {
+			forwards.Close()
+		}
+		for _, listener := range proxies {
+			listener.Close()
+		}
+		if n.config.Netstack.Enabled {
+			// nothing was installed into the system
+			if device != nil {
+				device.Close()
+			}
+		} else if dev.Ip != "" {
+			tun.Close(dev, device)
+		}
+		if n.host != nil {
+			n.host.Close()
+		}
+		if n.bus != nil {
+			n.bus.Close()
+		}
+	})
+}
+
+// Done is closed once the node stopped
+func (n *Node) Done() <-chan struct{} {
+	return n.stop
+}
+
+// Config returns the config the node started with
+func (n *Node) Config() Config {
+	return n.config
+}
+
+// ID returns the peer id of the node, empty until started
+func (n *Node) ID() string {
+	if n.host == nil {
+		return ""
+	}
+	return n.host.ID().Pretty()
+}
+
+// Routes returns the route table of the network, nil until started
+func (n *Node) Routes() *route.RouteTable {
+	return n.routes
+}
+
+// Forwards returns the forward rules running, nil until the VIP is assigned
+func (n *Node) Forwards() *forward.Manager {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.forwards
+}
+
+// notify calls the callbacks with the events of the network until the bus closed
+func (n *Node) notify(events *eventbus.Subscription) {
+	for event := range events.C {
+		switch event.Topic {
+		case route.ONLINE_TOPIC, route.OFFLINE_TOPIC:
+			if n.OnPeer != nil {
+				n.OnPeer(event.Data.(string), event.Topic == route.ONLINE_TOPIC)
+			}
+		case route.ADD_ROUTE_TOPIC, route.REFRESH_ROUTE_TOPIC, route.REMOVE_ROUTE_TOPIC:
+			if n.OnRoute != nil {
+				n.OnRoute(event.Data.(route.RouteEvent), event.Topic != route.REMOVE_ROUTE_TOPIC)
+			}
+		}
+	}
+}
+
+// startProxies serves the proxies to the overlay in netstack mode
+func (n *Node) startProxies() error {
+	serves := []struct {
+		name    string
+		address string
+		serve   func(net.Listener, netstack.DialFunc) error
+	}{
+		{"SOCKS5", n.config.Netstack.Socks, netstack.ServeSocks},
+		{"HTTP", n.config.Netstack.Http, netstack.ServeHTTP},
+	}
+	for _, s := range serves {
+		if s.address == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", s.address)
+		if err != nil {
+			return fmt.Errorf("start %s proxy error: %s", s.name, err)
+		}
+		n.mu.Lock()
+		n.proxies = append(n.proxies, listener)
+		n.mu.Unlock()
+		logrus.WithFields(logrus.Fields{
+			"Network": n.config.Name,
+			"Listen":  listener.Addr(),
+		}).Info(s.name + " proxy started")
+		go s.serve(listener, n.DialContext)
+	}
+	return nil
+}
+
+// DialContext connects via the userspace stack in netstack mode if the address is routed via the peers, directly
+// otherwise
+func (n *Node) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	n.mu.Lock()
+	stack, vip := n.stack, strings.Split(n.dev.Ip, "/")[0]
+	n.mu.Unlock()
+	_, found := n.routes.Get(ip.String())
+	if stack != nil && ip.To4() != nil && (found || ip.String() == vip) {
+		return stack.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// the stats of the peers of the network only
+func (n *Node) peerStats() []p2p.Stats {
+	return n.forwarder.Peers.Stats()
+}
+
+// count the packets relayed by server to other peers, false if refused because of quota
+func (n *Node) relayAllowed(session *p2p.Session, packet []byte) bool {
+	if !waterutil.IsIPv4(packet) {
+		return true
+	}
+	entry, found := n.routes.Get(waterutil.IPv4Destination(packet).String())
+	if !found || entry.Peer == session.Conn().LocalPeer().Pretty() {
+		return true
+	}
+	from := session.Conn().RemotePeer().Pretty()
+	if !n.traffic.Relay(from, entry.Peer, len(packet)) {
+		logrus.WithFields(logrus.Fields{
+			"Network": n.config.Name,
+			"From":    from,
+			"To":      entry.Peer,
+		}).Debug("Refuse to relay because of quota exceeded")
+		return false
+	}
+	return true
+}
+
+// the marshaled private key and the pre-shared key of config, the encrypted private key must be decrypted into
+// priKey by the caller
+func loadKeys(config Config, dir string) (string, pnet.PSK, error) {
+	priKey := config.PriKey
+	if config.KeyFile != "" {
+		data, err := keystore.ReadFile(resolvePath(dir, config.KeyFile))
+		if err != nil {
+			return "", nil, err
+		}
+		priKey = string(data)
+	}
+	if priKey == "" {
+		return "", nil, errors.New("neither keyFile nor priKey is set")
+	}
+	if keystore.IsEncrypted([]byte(priKey)) {
+		return "", nil, errors.New("the private key is encrypted, decrypt it into priKey before starting")
+	}
+	if config.PskFile == "" {
+		return priKey, nil, nil
+	}
+	if err := keystore.CheckFile(resolvePath(dir, config.PskFile)); err != nil {
+		return "", nil, err
+	}
+	psk, err := p2p.LoadPSK(resolvePath(dir, config.PskFile))
+	return priKey, psk, err
+}
+
+// the relative path is relative to dir
+func resolvePath(dir string, filename string) string {
+	if filename == "" || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(dir, filename)
+}
+
+// the store of the network named, the servers in one process never share it
+func storeFile(store string, name string) string {
+	if name == "" {
+		return store + ".json"
+	}
+	return store + "-" + name + ".json"
+}
+
+// the traffic of each peer since the last report
+func trafficSince(reported map[string]p2p.Stats, current []p2p.Stats) []dhcp.Traffic {
+	traffic := make([]dhcp.Traffic, 0)
+	for _, s := range current {
+		last := reported[s.Peer]
+		t := dhcp.Traffic{
+			Peer:      s.Peer,
+			TxPackets: s.TxPackets - last.TxPackets,
+			TxBytes:   s.TxBytes - last.TxBytes,
+			RxPackets: s.RxPackets - last.RxPackets,
+			RxBytes:   s.RxBytes - last.RxBytes,
+		}
+		if t.TxPackets > 0 || t.RxPackets > 0 {
+			traffic = append(traffic, t)
+		}
+	}
+	return traffic
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gvn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/liloew/gvn/netstack"
+	"github.com/liloew/gvn/route"
+)
+
+const (
+	SERVER_VIP = "10.20.0.1/24"
+	TIMEOUT    = 10 * time.Second
+)
+
+func testConfig(t *testing.T, mode MODE) Config {
+	priKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := crypto.MarshalPrivateKey(priKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the id is left empty, the node derives it from the key
+	return Config{
+		Mode:     mode,
+		Version:  "test",
+		PriKey:   string(data),
+		Dev:      Device{Vip: SERVER_VIP, Mtu: 1400},
+		Netstack: netstack.Config{Enabled: true},
+	}
+}
+
+func TestNode(t *testing.T) {
+	server := New(testConfig(t, MODESERVER))
+	server.Dir = t.TempDir()
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if server.Status().Vip != SERVER_VIP {
+		t.Fatalf("server VIP %s, expected %s", server.Status().Vip, SERVER_VIP)
+	}
+	var addr string
+	for _, a := range server.host.Addrs() {
+		if strings.HasPrefix(a.String(), "/ip4/127.0.0.1/tcp/") {
+			addr = fmt.Sprintf("%s/p2p/%s", a, server.ID())
+		}
+	}
+	if addr == "" {
+		t.Fatalf("no loopback address in %v", server.host.Addrs())
+	}
+
+	// echo on the VIP of server
+	listener, err := server.stack.Listen("tcp", ":7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	config := testConfig(t, MODECLIENT)
+	config.Server = addr
+	config.Dev = Device{}
+	client := New(config)
+	client.Dir = t.TempDir()
+	up := make(chan string, 1)
+	client.OnUp = func(vip string) {
+		up <- vip
+	}
+	online := make(chan string, 16)
+	client.OnPeer = func(peerId string, ok bool) {
+		if ok {
+			online <- peerId
+		}
+	}
+	routes := make(chan route.RouteEvent, 16)
+	client.OnRoute = func(event route.RouteEvent, added bool) {
+		if added {
+			routes <- event
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case vip := <-up:
+		if vip == "" || vip == SERVER_VIP || vip != client.Status().Vip {
+			t.Fatalf("unexpected client VIP %s", vip)
+		}
+	default:
+		t.Fatal("OnUp not called before Start returned")
+	}
+	select {
+	case peerId := <-online:
+		if peerId != server.ID() {
+			t.Fatalf("online peer %s, expected server %s", peerId, server.ID())
+		}
+	case <-time.After(TIMEOUT):
+		t.Fatal("OnPeer not called")
+	}
+
+	// the VIP of server is routed via it
+	for found := false; !found; {
+		select {
+		case event := <-routes:
+			found = event.Id == server.ID()
+		case <-time.After(TIMEOUT):
+			t.Fatal("OnRoute not called for server")
+		}
+	}
+	// the route table applies the event on its own
+	serverIp := strings.Split(SERVER_VIP, "/")[0]
+	for deadline := time.Now().Add(TIMEOUT); ; time.Sleep(10 * time.Millisecond) {
+		if _, found := client.Routes().Get(serverIp); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no route to server")
+		}
+	}
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer dialCancel()
+	conn, err := client.DialContext(dialCtx, "tcp", net.JoinHostPort(serverIp, "7000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(TIMEOUT))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buff); err != nil || string(buff) != "ping" {
+		t.Fatalf("echo %q, %v", buff, err)
+	}
+
+	// the node stops once ctx done
+	cancel()
+	select {
+	case <-client.Done():
+	case <-time.After(TIMEOUT):
+		t.Fatal("client not stopped once ctx done")
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	config := testConfig(t, MODESERVER)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "gvn.key"), []byte(config.PriKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.PriKey, config.KeyFile = "", "gvn.key"
+	if runtime.GOOS != "windows" {
+		if _, _, err := loadKeys(config, dir); err == nil {
+			t.Error("the key file accessible by others loaded")
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "gvn.key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if priKey, _, err := loadKeys(config, dir); err != nil || priKey == "" {
+		t.Errorf("load key file error: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gvn
+
+import (
+	"time"
+
+	"github.com/liloew/gvn/dhcp"
+	"github.com/liloew/gvn/eventbus"
+	"github.com/liloew/gvn/p2p"
+	"github.com/liloew/gvn/qos"
+)
+
+// Status is the state of a node, written to the status file by gvn up
+type Status struct {
+	// the name of the network listed in the config file
+	Network   string      `json:"network,omitempty"`
+	Id        string      `json:"id"`
+	Vip       string      `json:"vip"`
+	Mtu       int         `json:"mtu"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+	Peers     []p2p.Stats `json:"peers"`
+	Qos       qos.Stats   `json:"qos"`
+	// the subscriptions of the event bus
+	Events []eventbus.Stats `json:"events"`
+	// all the leases in server mode, the lease itself in client mode
+	Usages []dhcp.Usage `json:"usages,omitempty"`
+	// the MAC addresses learned in TAP mode
+	Switch []p2p.SwitchEntry `json:"switch,omitempty"`
+	// the broadcast and multicast packets flooded in TUN mode
+	Flood *p2p.FloodStats `json:"flood,omitempty"`
+}
+
+// Status returns the current state of the started node
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	dev := n.dev
+	n.mu.Unlock()
+	status := Status{
+		Network:   n.config.Name,
+		Id:        n.host.ID().Pretty(),
+		Vip:       dev.Ip,
+		Mtu:       dev.Mtu,
+		UpdatedAt: time.Now(),
+		Peers:     n.peerStats(),
+		Qos:       n.shaper.Stats(),
+		Events:    n.bus.Stats(),
+	}
+	if n.forwarder.Switch != nil {
+		status.Switch = n.forwarder.Switch.Entries()
+	}
+	if n.forwarder.Flooder != nil {
+		stats := n.forwarder.Flooder.Stats()
+		status.Flood = &stats
+	}
+	if n.traffic != nil {
+		status.Usages = n.traffic.Usages()
+	} else if usage, ok := n.lastUsage.Load().(dhcp.Usage); ok {
+		status.Usages = []dhcp.Usage{usage}
+	}
+	return status
+}
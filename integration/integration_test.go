@@ -0,0 +1,732 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/liloew/gvn/dhcp"
+	"github.com/liloew/gvn/eventbus"
+	"github.com/liloew/gvn/forward"
+	"github.com/liloew/gvn/netstack"
+	"github.com/liloew/gvn/p2p"
+	"github.com/liloew/gvn/route"
+	"github.com/liloew/gvn/tun"
+	"github.com/sirupsen/logrus"
+	"github.com/songgao/packets/ethernet"
+)
+
+const (
+	SERVER_VIP = "10.10.0.1/24"
+	MTU        = 1400
+	ZONE       = "/gvn/test"
+	RPC_ZONE   = "/rpc/test"
+	TIMEOUT    = 5 * time.Second
+)
+
+// fakeRouter accepts all the routes without touching the system
+type fakeRouter struct {
+}
+
+func (fakeRouter) AddRoute(subnets []string) error {
+	return nil
+}
+
+func (fakeRouter) RemoveRoute(subnets []string) error {
+	return nil
+}
+
+func (fakeRouter) ConflictWithLAN(subnet *net.IPNet) *net.IPNet {
+	return nil
+}
+
+func (fakeRouter) Installed() ([]string, error) {
+	return nil, nil
+}
+
+// node is a gvn server or client running in process, the userspace stack replaces device in netstack mode
+type node struct {
+	host      host.Host
+	bus       *eventbus.EventBus
+	routes    *route.RouteTable
+	device    *tun.Memory
+	stack     *netstack.Stack
+	forwarder *p2p.Forwarder
+	client    *dhcp.Client
+	req       dhcp.Request
+	lease     dhcp.Response
+}
+
+func (n *node) id() string {
+	return n.host.ID().Pretty()
+}
+
+func (n *node) vip() net.IP {
+	return net.ParseIP(strings.Split(n.lease.Ip, "/")[0])
+}
+
+// cluster is a server and its clients linked by the mock network
+type cluster struct {
+	t       *testing.T
+	network mocknet.Mocknet
+	server  *node
+	clients []*node
+	// the nodes switch the Ethernet frames in TAP mode
+	tap bool
+	// the broadcast and multicast packets flooded in TUN mode
+	flood p2p.FloodConfig
+	// the nodes run the userspace stack rather than the TUN device
+	netstack bool
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logrus.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newCluster starts a server with subnets and a client for each of the subnets given
+func newCluster(t *testing.T, serverSubnets []string, clientSubnets ...[]string) *cluster {
+	return startCluster(&cluster{t: t}, serverSubnets, clientSubnets...)
+}
+
+func startCluster(c *cluster, serverSubnets []string, clientSubnets ...[]string) *cluster {
+	t := c.t
+	ctx, cancel := context.WithCancel(context.Background())
+	c.network = mocknet.New(ctx)
+	t.Cleanup(func() {
+		for _, n := range append(c.clients, c.server) {
+			if n != nil {
+				n.device.Close()
+				if n.stack != nil {
+					n.stack.Close()
+				}
+				n.host.Close()
+				n.bus.Close()
+			}
+		}
+		cancel()
+	})
+	c.server = c.newNode()
+	for range clientSubnets {
+		c.clients = append(c.clients, c.newNode())
+	}
+	if err := c.network.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.network.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.server.lease = dhcp.Response{Id: c.server.id(), Ip: SERVER_VIP, Mtu: MTU, Subnets: serverSubnets}
+	options := dhcp.ServerOptions{Pool: dhcp.Pool{Cidr: SERVER_VIP, Mtu: MTU, Subnets: serverSubnets}}
+	if _, err := dhcp.NewRPCServer(c.server.host, []string{p2p.RPC_PROTOCOL_ID, RPC_ZONE}, c.server.bus, options); err != nil {
+		t.Fatal(err)
+	}
+	c.server.serve(c.netstack)
+
+	server := fmt.Sprintf("%s/p2p/%s", c.server.host.Addrs()[0], c.server.id())
+	for i, n := range c.clients {
+		n.req = dhcp.Request{Id: n.id(), Name: fmt.Sprintf("client%d", i), Subnets: clientSubnets[i]}
+		n.client, n.lease = dhcp.NewRPCClient(context.Background(), n.host, []string{p2p.RPC_PROTOCOL_ID, RPC_ZONE}, n.bus, server, n.req)
+		if n.client == nil {
+			t.Fatalf("DHCP of %s failed", n.req.Name)
+		}
+		n.serve(c.netstack)
+	}
+	c.refresh()
+	return c
+}
+
+func (c *cluster) newNode() *node {
+	h, err := c.network.GenPeer()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	n := &node{host: h, bus: eventbus.New()}
+	n.routes = route.NewRouteTable(n.bus, fakeRouter{})
+	n.device = tun.NewMemory(MTU)
+	n.forwarder = p2p.NewForwarder(h, ZONE, n.routes)
+	n.forwarder.SetMtu(MTU)
+	if c.tap {
+		n.forwarder.Switch = p2p.NewSwitch()
+		n.forwarder.Capabilities = append(n.forwarder.Capabilities, p2p.CapTap)
+	}
+	if !c.flood.Empty() {
+		n.forwarder.Flooder, err = p2p.NewFlooder(c.flood)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	h.SetStreamHandler(protocol.ID(p2p.PROTOCOL_ID), n.forwarder.HandleStream)
+	h.SetStreamHandler(protocol.ID(ZONE), n.forwarder.HandleStream)
+	// answers the health checks
+	ping.NewPingService(h)
+	p2p.NewLiveness(h, n.bus, n.forwarder.Peers)
+	return n
+}
+
+func (n *node) serve(stack bool) {
+	n.forwarder.Vip = n.vip()
+	if n.forwarder.Flooder != nil {
+		n.forwarder.Flooder.SetNetwork(n.lease.Ip)
+	}
+	if !stack {
+		go n.forwarder.Serve(n.device)
+		return
+	}
+	var err error
+	if n.stack, err = netstack.New(n.lease.Ip, MTU); err != nil {
+		panic(err)
+	}
+	go n.forwarder.Serve(n.stack)
+}
+
+// refresh the routes of all the clients as the heartbeat does
+func (c *cluster) refresh() {
+	for _, n := range c.clients {
+		if err := n.client.Refresh(n.req); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// eventually fails the test if cond is not satisfied in time
+func eventually(t *testing.T, message string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(TIMEOUT)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stateOf returns the state of the route to the subnet via the peer on n
+func stateOf(n *node, subnet string, peerId string) route.State {
+	for _, e := range n.routes.Entries() {
+		if e.Subnet == subnet && e.Peer == peerId {
+			return e.State
+		}
+	}
+	return ""
+}
+
+// routedVia reports whether the ip is routed via the peer by n
+func routedVia(n *node, ip string, peerId string) bool {
+	entry, found := n.routes.Get(ip)
+	return found && entry.Peer == peerId
+}
+
+// packet builds an IPv4 UDP packet
+func packet(src net.IP, dst net.IP, payload string) []byte {
+	buff := make([]byte, 28+len(payload))
+	buff[0] = 0x45
+	binary.BigEndian.PutUint16(buff[2:4], uint16(len(buff)))
+	buff[8] = 64
+	buff[9] = 17
+	copy(buff[12:16], src.To4())
+	copy(buff[16:20], dst.To4())
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buff[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(buff[10:12], ^uint16(sum))
+	binary.BigEndian.PutUint16(buff[20:22], 5000)
+	binary.BigEndian.PutUint16(buff[22:24], 5000)
+	binary.BigEndian.PutUint16(buff[24:26], uint16(8+len(payload)))
+	copy(buff[28:], payload)
+	return buff
+}
+
+// send injects the packet into from and waits for it on to
+func send(t *testing.T, from *node, to *node, packet []byte) {
+	t.Helper()
+	if err := from.device.Inject(packet); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, to, packet)
+}
+
+// expect waits for the packet on n
+func expect(t *testing.T, n *node, packet []byte) {
+	t.Helper()
+	timeout := time.After(TIMEOUT)
+	for {
+		select {
+		case received := <-n.device.Received():
+			if bytes.Equal(received, packet) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("packet to %s not received", n.vip())
+		}
+	}
+}
+
+// silent fails the test if n receives any packet in a while
+func silent(t *testing.T, n *node) {
+	t.Helper()
+	select {
+	case received := <-n.device.Received():
+		t.Fatalf("unexpected packet of %d bytes to %s", len(received), n.vip())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// ethernetFrame builds an Ethernet frame carrying payload
+func ethernetFrame(dst string, src string, payload string) []byte {
+	d, _ := net.ParseMAC(dst)
+	s, _ := net.ParseMAC(src)
+	var frame ethernet.Frame
+	frame.Prepare(d, s, ethernet.NotTagged, ethernet.ARP, len(payload))
+	copy(frame.Payload(), payload)
+	return frame
+}
+
+func TestDHCP(t *testing.T) {
+	c := newCluster(t, nil, nil, nil, nil)
+	_, network, _ := net.ParseCIDR(SERVER_VIP)
+	seen := map[string]bool{c.server.vip().String(): true}
+	for _, n := range c.clients {
+		if !network.Contains(n.vip()) {
+			t.Errorf("VIP %s of %s is out of %s", n.lease.Ip, n.req.Name, SERVER_VIP)
+		}
+		if seen[n.vip().String()] {
+			t.Errorf("VIP %s is leased twice", n.lease.Ip)
+		}
+		seen[n.vip().String()] = true
+		if n.lease.Mtu != MTU || n.lease.ServerVIP != SERVER_VIP {
+			t.Errorf("unexpected lease %+v", n.lease)
+		}
+	}
+
+	var clients []dhcp.Response
+	if err := c.clients[0].client.Call("DHCPService", "Clients", c.clients[0].req, &clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != len(c.clients)+1 {
+		t.Errorf("%d clients listed, %d expected", len(clients), len(c.clients)+1)
+	}
+}
+
+func TestDHCPForOtherPeerIsForbidden(t *testing.T) {
+	c := newCluster(t, nil, nil, nil)
+	req := c.clients[0].req
+	req.Id = c.clients[1].id()
+	if err := c.clients[0].client.Call("DHCPService", "DHCP", req, &dhcp.Response{}); err == nil {
+		t.Error("DHCP for other peer succeeded")
+	}
+	if err := c.clients[0].client.Call("DHCPService", "Ping", req, &dhcp.Response{}); err == nil {
+		t.Error("Ping for other peer succeeded")
+	}
+}
+
+func TestTwoServers(t *testing.T) {
+	// the servers in one process lease from their own pools
+	for _, c := range []*cluster{newCluster(t, nil, nil, nil), newCluster(t, nil, nil)} {
+		if ip := c.clients[0].lease.Ip; ip != "10.10.0.2/24" {
+			t.Errorf("the first lease %s, expected 10.10.0.2/24", ip)
+		}
+		a := c.clients[0]
+		eventually(t, "route to server not refreshed", func() bool {
+			return routedVia(a, c.server.vip().String(), c.server.id()) && routedVia(c.server, a.vip().String(), a.id())
+		})
+		send(t, a, c.server, packet(a.vip(), c.server.vip(), "ping"))
+	}
+}
+
+func TestForwardBetweenVIPs(t *testing.T) {
+	c := newCluster(t, nil, nil, nil)
+	a, b := c.clients[0], c.clients[1]
+	eventually(t, "route to VIP not refreshed", func() bool {
+		return routedVia(a, b.vip().String(), b.id()) && routedVia(b, a.vip().String(), a.id())
+	})
+	send(t, a, b, packet(a.vip(), b.vip(), "ping"))
+	send(t, b, a, packet(b.vip(), a.vip(), "pong"))
+	// to and from server
+	eventually(t, "route to server not refreshed", func() bool {
+		return routedVia(a, c.server.vip().String(), c.server.id()) && routedVia(c.server, a.vip().String(), a.id())
+	})
+	send(t, a, c.server, packet(a.vip(), c.server.vip(), "ping"))
+	send(t, c.server, a, packet(c.server.vip(), a.vip(), "pong"))
+}
+
+func TestForwardToSubnets(t *testing.T) {
+	c := newCluster(t, []string{"192.168.10.0/24"}, nil, []string{"192.168.20.0/24"})
+	a, b := c.clients[0], c.clients[1]
+	eventually(t, "route to subnets not refreshed", func() bool {
+		return routedVia(a, "192.168.20.7", b.id()) && routedVia(a, "192.168.10.7", c.server.id())
+	})
+	if _, found := b.routes.Get("192.168.20.7"); found {
+		t.Error("the own subnet is routed via gvn")
+	}
+	send(t, a, b, packet(a.vip(), net.ParseIP("192.168.20.7"), "subnet"))
+	send(t, a, c.server, packet(a.vip(), net.ParseIP("192.168.10.7"), "subnet"))
+}
+
+func TestUpdateSubnets(t *testing.T) {
+	c := newCluster(t, nil, nil, []string{"192.168.30.0/24"})
+	a, b := c.clients[0], c.clients[1]
+	eventually(t, "route to subnet not refreshed", func() bool {
+		return routedVia(a, "192.168.30.1", b.id())
+	})
+	req := b.req
+	req.Subnets = []string{"192.168.40.0/24"}
+	if err := b.client.Call("DHCPService", "UpdateSubnets", req, &dhcp.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	// pushed by server without refresh
+	eventually(t, "subnet update not pushed", func() bool {
+		_, found := a.routes.Get("192.168.30.1")
+		return !found && routedVia(a, "192.168.40.1", b.id()) && routedVia(c.server, "192.168.40.1", b.id())
+	})
+	send(t, a, b, packet(a.vip(), net.ParseIP("192.168.40.1"), "updated"))
+}
+
+func TestDiscardUnroutable(t *testing.T) {
+	c := newCluster(t, nil, nil, nil)
+	a, b := c.clients[0], c.clients[1]
+	eventually(t, "route to VIP not refreshed", func() bool {
+		return routedVia(a, b.vip().String(), b.id())
+	})
+	if err := a.device.Inject(packet(a.vip(), net.ParseIP("172.31.0.1"), "lost")); err != nil {
+		t.Fatal(err)
+	}
+	// the unroutable packet doesn't block the following ones
+	send(t, a, b, packet(a.vip(), b.vip(), "after"))
+	for _, n := range append(c.clients, c.server) {
+		select {
+		case received := <-n.device.Received():
+			t.Errorf("unexpected packet %v received by %s", received, n.vip())
+		default:
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	subnet := []string{"10.30.20.0/24"}
+	c := newCluster(t, nil, nil, subnet, subnet)
+	a, b, standby := c.clients[0], c.clients[1], c.clients[2]
+	for i, n := range []*node{b, standby} {
+		req := n.req
+		req.Metric = (i + 1) * 10
+		if err := n.client.Call("DHCPService", "UpdateSubnets", req, &dhcp.Response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "redundant routes not pushed", func() bool {
+		return len(a.routes.Redundant()) == 2 && routedVia(a, "10.30.20.1", b.id())
+	})
+	health := p2p.NewHealthChecker(a.host, a.routes)
+	health.Interval = 50 * time.Millisecond
+	health.Timeout = 200 * time.Millisecond
+	health.Start()
+	defer health.Stop()
+
+	if err := c.network.UnlinkPeers(a.host.ID(), b.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	c.network.DisconnectPeers(a.host.ID(), b.host.ID())
+	eventually(t, "not failed over to standby", func() bool {
+		return routedVia(a, "10.30.20.1", standby.id())
+	})
+	send(t, a, standby, packet(a.vip(), net.ParseIP("10.30.20.1"), "failover"))
+
+	if _, err := c.network.LinkPeers(a.host.ID(), b.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "not switched back to preferred", func() bool {
+		return routedVia(a, "10.30.20.1", b.id())
+	})
+	send(t, a, b, packet(a.vip(), net.ParseIP("10.30.20.1"), "failback"))
+}
+
+func TestOfflineOnDisconnect(t *testing.T) {
+	c := newCluster(t, nil, nil, nil)
+	a, b := c.clients[0], c.clients[1]
+	vip := b.vip().String() + "/32"
+	eventually(t, "route to VIP not refreshed", func() bool {
+		return stateOf(a, vip, b.id()) == route.StateActive
+	})
+	if err := c.network.UnlinkPeers(a.host.ID(), b.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	c.network.DisconnectPeers(a.host.ID(), b.host.ID())
+	eventually(t, "peer not offline after disconnected", func() bool {
+		return stateOf(a, vip, b.id()) == route.StateDown
+	})
+	if _, err := c.network.LinkPeers(a.host.ID(), b.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.network.ConnectPeers(a.host.ID(), b.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "peer not online after connected", func() bool {
+		return stateOf(a, vip, b.id()) == route.StateActive
+	})
+}
+
+func TestKeepalive(t *testing.T) {
+	c := newCluster(t, nil, nil, nil)
+	a, b := c.clients[0], c.clients[1]
+	for _, n := range []*node{a, b} {
+		n.forwarder.Keepalive = 20 * time.Millisecond
+		n.forwarder.KeepaliveTimeout = 100 * time.Millisecond
+	}
+	eventually(t, "route to VIP not refreshed", func() bool {
+		return routedVia(a, b.vip().String(), b.id())
+	})
+	send(t, a, b, packet(a.vip(), b.vip(), "idle"))
+	// the idle session is kept by the keepalives of both sides
+	time.Sleep(300 * time.Millisecond)
+	if a.host.Network().Connectedness(b.host.ID()) != network.Connected {
+		t.Fatal("idle peer disconnected")
+	}
+	send(t, a, b, packet(a.vip(), b.vip(), "after idle"))
+
+	// the half-open peer swallows all the frames without reply
+	h, err := c.network.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.SetStreamHandler(protocol.ID(p2p.PROTOCOL_ID), func(stream network.Stream) {
+		if _, err := p2p.Handshake(stream, a.forwarder.Hello()); err == nil {
+			io.Copy(io.Discard, stream)
+		}
+	})
+	if _, err := c.network.LinkPeers(a.host.ID(), h.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.network.ConnectPeers(a.host.ID(), h.ID()); err != nil {
+		t.Fatal(err)
+	}
+	a.routes.Add(route.Entry{Subnet: "10.50.0.0/24", Peer: h.ID().Pretty()})
+	if err := a.device.Inject(packet(a.vip(), net.ParseIP("10.50.0.1"), "lost")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "half-open peer not disconnected", func() bool {
+		return stateOf(a, "10.50.0.0/24", h.ID().Pretty()) == route.StateDown && a.host.Network().Connectedness(h.ID()) != network.Connected
+	})
+}
+
+func TestNetworkIsolation(t *testing.T) {
+	c := newCluster(t, nil, nil)
+	a := c.clients[0]
+	h, err := c.network.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	other := a.forwarder.Hello()
+	other.Network = "other"
+	// the stream is reset by the dialer, so the hello is read before the reset
+	h.SetStreamHandler(protocol.ID(p2p.PROTOCOL_ID), func(stream network.Stream) {
+		p2p.Handshake(stream, other)
+	})
+	if _, err := c.network.LinkPeers(a.host.ID(), h.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.network.ConnectPeers(a.host.ID(), h.ID()); err != nil {
+		t.Fatal(err)
+	}
+	local := a.forwarder.Hello()
+	local.Network = "home"
+	_, err = p2p.NewSession(a.host, ZONE, h.ID().Pretty(), local)
+	if _, ok := err.(p2p.NetworkError); !ok {
+		t.Fatalf("session with peer of another network: %v", err)
+	}
+}
+
+func TestTapSwitch(t *testing.T) {
+	c := startCluster(&cluster{t: t, tap: true}, nil, nil, nil)
+	s, a, b := c.server, c.clients[0], c.clients[1]
+	const macA, macB = "02:00:00:00:00:0a", "02:00:00:00:00:0b"
+
+	// the broadcast is flooded to all the peers
+	broadcast := ethernetFrame("ff:ff:ff:ff:ff:ff", macA, "who has")
+	send(t, a, b, broadcast)
+	expect(t, s, broadcast)
+	// macA learned from the broadcast
+	send(t, b, a, ethernetFrame(macA, macB, "is at"))
+	silent(t, s)
+	// macB learned from the reply
+	send(t, a, b, ethernetFrame(macB, macA, "unicast"))
+	silent(t, s)
+	// the unknown unicast is flooded
+	unknown := ethernetFrame("02:00:00:00:00:0c", macA, "unknown")
+	send(t, a, b, unknown)
+	expect(t, s, unknown)
+	// the frames received are never flooded again
+	silent(t, a)
+}
+
+func TestFlood(t *testing.T) {
+	c := startCluster(&cluster{t: t, flood: p2p.FloodConfig{Broadcast: true, Groups: []string{"224.0.0.251"}}}, nil, nil, nil)
+	s, a, b := c.server, c.clients[0], c.clients[1]
+
+	for _, dst := range []string{"10.10.0.255", "224.0.0.251"} {
+		flooded := packet(a.vip(), net.ParseIP(dst), "flooded")
+		send(t, a, b, flooded)
+		expect(t, s, flooded)
+	}
+	// the packets received are never flooded again
+	silent(t, a)
+	// the groups not selected are discarded
+	if err := a.device.Inject(packet(a.vip(), net.ParseIP("239.255.255.250"), "discarded")); err != nil {
+		t.Fatal(err)
+	}
+	silent(t, b)
+}
+
+// echoServer echoes the TCP and UDP data on the local addresses returned
+func echoServer(t *testing.T) (string, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		conn.Close()
+	})
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	go func() {
+		buff := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buff[:n], from)
+		}
+	}()
+	return listener.Addr().String(), conn.LocalAddr().String()
+}
+
+func TestNetstack(t *testing.T) {
+	c := startCluster(&cluster{t: t, netstack: true}, nil, nil, nil)
+	a, b := c.clients[0], c.clients[1]
+
+	tcpEcho, _ := echoServer(t)
+	// the connections to the VIP of b are forwarded to the local echo server
+	forwards := forward.NewManager(b.vip().String(), b.stack, forward.System{})
+	defer forwards.Close()
+	if err := forwards.Add(forward.Rule{Listen: "7", Target: tcpEcho}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := a.stack.DialContext(ctx, "tcp", net.JoinHostPort(b.vip().String(), "7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// larger than MTU so that it's segmented by the stack
+	sent := bytes.Repeat([]byte("netstack"), 1000)
+	if _, err := conn.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Fatal("echoed data mismatch")
+	}
+}
+
+func TestForwardRules(t *testing.T) {
+	c := startCluster(&cluster{t: t, netstack: true}, nil, nil, nil)
+	a, b := c.clients[0], c.clients[1]
+
+	tcpEcho, udpEcho := echoServer(t)
+	inbound := forward.NewManager(b.vip().String(), b.stack, forward.System{})
+	defer inbound.Close()
+	reverse := forward.NewManager(a.vip().String(), a.stack, forward.System{})
+	defer reverse.Close()
+	// the local ports of a are forwarded to the VIP of b, then to the local echo server of b
+	for _, proto := range []string{forward.PROTO_TCP, forward.PROTO_UDP} {
+		target := tcpEcho
+		if proto == forward.PROTO_UDP {
+			target = udpEcho
+		}
+		if err := inbound.Add(forward.Rule{Proto: proto, Listen: "7", Target: target}); err != nil {
+			t.Fatal(err)
+		}
+		if err := reverse.Add(forward.Rule{Proto: proto, Listen: "127.0.0.1:0", Target: net.JoinHostPort(b.vip().String(), "7"), Reverse: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := reverse.Rules()
+	for _, r := range rules {
+		conn, err := net.Dial(r.Proto, r.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		sent := []byte("forwarded via " + r.Proto)
+		if _, err := conn.Write(sent); err != nil {
+			t.Fatal(err)
+		}
+		received := make([]byte, 1500)
+		n, err := conn.Read(received)
+		if err != nil || !bytes.Equal(sent, received[:n]) {
+			t.Fatalf("%s echoed %q, %v", r.Proto, received[:n], err)
+		}
+	}
+	if err := reverse.Remove(rules[0].Rule); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", rules[0].Address); err == nil {
+		t.Fatal("connected to the rule removed")
+	}
+}
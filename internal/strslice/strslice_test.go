@@ -0,0 +1,42 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package strslice
+
+import "testing"
+
+func TestEqual(t *testing.T) {
+	cases := []struct {
+		left, right []string
+		equal       bool
+	}{
+		{nil, nil, true},
+		{nil, []string{}, true},
+		{[]string{"a", "b"}, []string{"a", "b"}, true},
+		{[]string{"a", "b"}, []string{"b", "a"}, false},
+		{[]string{"a"}, []string{"a", "b"}, false},
+	}
+	for _, c := range cases {
+		if got := Equal(c.left, c.right); got != c.equal {
+			t.Errorf("Equal(%q, %q) = %v, want %v", c.left, c.right, got, c.equal)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	if !Contains([]string{"a", "b"}, "b") || Contains([]string{"a", "b"}, "c") || Contains(nil, "") {
+		t.Error("Contains mismatched")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package keystore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// the encrypted key looks like
+// gvn-enc-v1$argon2id$t=3,m=65536,p=4$<salt>$<nonce>$<ciphertext>
+const (
+	PREFIX  = "gvn-enc-v1"
+	KDF     = "argon2id"
+	SALTLEN = 16
+	TIME    = 3
+	MEMORY  = 64 * 1024
+	THREADS = 4
+	// the upper bounds of the parameters read from the header, a tampered one mustn't exhaust the CPU or memory
+	// before the header is authenticated
+	MAX_TIME    = 16
+	MAX_MEMORY  = 256 * 1024
+	MAX_THREADS = 16
+)
+
+var (
+	ErrPassphrase = errors.New("wrong passphrase or corrupted key")
+	ErrFormat     = errors.New("unknown encrypted key format")
+)
+
+// IsEncrypted reports whether the key is encrypted by Encrypt
+func IsEncrypted(data []byte) bool {
+	return strings.HasPrefix(string(data), PREFIX+"$")
+}
+
+// Encrypt seals the plain key with the key derived from passphrase by argon2id
+func Encrypt(plain []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, SALTLEN)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("%s$%s$t=%d,m=%d,p=%d", PREFIX, KDF, TIME, MEMORY, THREADS)
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, TIME, MEMORY, THREADS, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	// the header is authenticated so the KDF parameters can't be downgraded
+	sealed := aead.Seal(nil, nonce, plain, []byte(header))
+	encoding := base64.RawStdEncoding
+	return []byte(strings.Join([]string{header, encoding.EncodeToString(salt), encoding.EncodeToString(nonce), encoding.EncodeToString(sealed)}, "$")), nil
+}
+
+// Decrypt opens the key sealed by Encrypt
+func Decrypt(data []byte, passphrase []byte) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(string(data)), "$")
+	if len(parts) != 6 || parts[0] != PREFIX || parts[1] != KDF {
+		return nil, ErrFormat
+	}
+	var t, m, p uint32
+	if _, err := fmt.Sscanf(parts[2], "t=%d,m=%d,p=%d", &t, &m, &p); err != nil || parts[2] != fmt.Sprintf("t=%d,m=%d,p=%d", t, m, p) {
+		return nil, ErrFormat
+	}
+	if t == 0 || t > MAX_TIME || m == 0 || m > MAX_MEMORY || p == 0 || p > MAX_THREADS {
+		return nil, ErrFormat
+	}
+	encoding := base64.RawStdEncoding
+	salt, err := encoding.DecodeString(parts[3])
+	if err != nil || len(salt) != SALTLEN {
+		return nil, ErrFormat
+	}
+	nonce, err := encoding.DecodeString(parts[4])
+	if err != nil || len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, ErrFormat
+	}
+	sealed, err := encoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, ErrFormat
+	}
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, t, m, uint8(p), chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	header := strings.Join(parts[:3], "$")
+	plain, err := aead.Open(nil, nonce, sealed, []byte(header))
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return plain, nil
+}
+
+// CheckFile refuses the key file accessible by group or others
+func CheckFile(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// unix permissions are meaningless on windows
+		return nil
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by group or others (%s), run chmod 600 %s", filename, info.Mode().Perm(), filename)
+	}
+	return nil
+}
+
+// ReadFile reads the key file once checked by CheckFile, the key may be encrypted
+func ReadFile(filename string) ([]byte, error) {
+	if err := CheckFile(filename); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filename)
+}
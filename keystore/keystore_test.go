@@ -0,0 +1,115 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package keystore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	plain := []byte("CAESQPrivateKeyInBase64")
+	data, err := Encrypt(plain, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(data) || IsEncrypted(plain) {
+		t.Fatal("IsEncrypted mismatched")
+	}
+	if bytes.Contains(data, plain) {
+		t.Fatal("the plain key is in the encrypted one")
+	}
+	// the trailing newline of the file is ignored
+	got, err := Decrypt(append(data, '\n'), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted %q, want %q", got, plain)
+	}
+	if _, err := Decrypt(data, []byte("wrong")); err != ErrPassphrase {
+		t.Fatalf("decrypted with the wrong passphrase: %v", err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	data, err := Encrypt([]byte("key"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(string(data), "$")
+	tamper := func(i int, v string) []byte {
+		tampered := append([]string(nil), parts...)
+		tampered[i] = v
+		return []byte(strings.Join(tampered, "$"))
+	}
+	// another base64 digit
+	ciphertext := []byte(parts[5])
+	if ciphertext[0] == 'A' {
+		ciphertext[0] = 'B'
+	} else {
+		ciphertext[0] = 'A'
+	}
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		// the header is authenticated
+		{"downgraded", tamper(2, "t=1,m=65536,p=4"), ErrPassphrase},
+		{"ciphertext", tamper(5, string(ciphertext)), ErrPassphrase},
+		{"time", tamper(2, "t=4294967295,m=65536,p=4"), ErrFormat},
+		{"memory", tamper(2, "t=3,m=4294967295,p=4"), ErrFormat},
+		{"threads", tamper(2, "t=3,m=65536,p=255"), ErrFormat},
+		{"zero", tamper(2, "t=0,m=65536,p=4"), ErrFormat},
+		{"trailing", tamper(2, "t=3,m=65536,p=4,x=1"), ErrFormat},
+		{"kdf", tamper(1, "scrypt"), ErrFormat},
+		{"version", tamper(0, "gvn-enc-v2"), ErrFormat},
+		{"salt", tamper(3, "c2FsdA"), ErrFormat},
+		{"nonce", tamper(4, "bm9uY2U"), ErrFormat},
+		{"parts", []byte(strings.Join(parts[:5], "$")), ErrFormat},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := Decrypt(c.data, []byte("secret")); err != c.err {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions only")
+	}
+	filename := filepath.Join(t.TempDir(), "gvn.key")
+	if err := os.WriteFile(filename, []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(filename); err == nil {
+		t.Fatal("read the key file accessible by others")
+	}
+	if err := os.Chmod(filename, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(filename); err != nil || string(data) != "key" {
+		t.Fatalf("read %q: %v", data, err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	NIC_ID = 1
+	// packets queued from the stack to the peers
+	QUEUE_SIZE = 1024
+)
+
+// Config runs the network in a userspace TCP/IP stack rather than the TUN device, so that root is not needed
+type Config struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// the listen address of the SOCKS5 proxy to the overlay, 127.0.0.1:1080 for example
+	Socks string `yaml:"socks,omitempty"`
+	// the listen address of the HTTP proxy to the overlay, 127.0.0.1:8080 for example
+	Http string `yaml:"http,omitempty"`
+}
+
+// Stack is a userspace TCP/IP stack holding the VIP, the forwarder reads the packets sent by it and writes the
+// packets received from the peers to it like the TUN device
+type Stack struct {
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	vip      tcpip.Address
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// the packets are never written once closed
+	closed bool
+	rw     sync.RWMutex
+}
+
+// New creates the stack holding vip in CIDR, the packets are no larger than mtu
+func New(vip string, mtu int) (*Stack, error) {
+	ip, network, err := net.ParseCIDR(vip)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 CIDR %q", vip)
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+		// the connections to the VIP itself never leave the stack
+		HandleLocal: true,
+	})
+	endpoint := channel.New(QUEUE_SIZE, uint32(mtu), "")
+	if err := s.CreateNIC(NIC_ID, endpoint); err != nil {
+		return nil, fmt.Errorf("create NIC error: %s", err)
+	}
+	prefix, _ := network.Mask.Size()
+	address := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: tcpip.Address(ip.To4()), PrefixLen: prefix},
+	}
+	if err := s.AddProtocolAddress(NIC_ID, address); err != nil {
+		return nil, fmt.Errorf("add address error: %s", err)
+	}
+	// all the destinations are reached via the peers
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: NIC_ID}})
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Stack{stack: s, endpoint: endpoint, vip: address.AddressWithPrefix.Address, ctx: ctx, cancel: cancel}, nil
+}
+
+// Read reads an IP packet sent by the stack into buff
+func (s *Stack) Read(buff []byte) (int, error) {
+	info, ok := s.endpoint.ReadContext(s.ctx)
+	// the queue yields nothing once closed
+	if !ok || info.Pkt == nil {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	for _, view := range info.Pkt.Views() {
+		n += copy(buff[n:], view)
+	}
+	return n, nil
+}
+
+// Write delivers an IP packet to the stack
+func (s *Stack) Write(packet []byte) (int, error) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewViewFromBytes(packet).ToVectorisedView(),
+	})
+	s.endpoint.InjectInbound(ipv4.ProtocolNumber, pkt)
+	return len(packet), nil
+}
+
+// Close resets the connections and stops the stack
+func (s *Stack) Close() error {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	// the connections are reset before the queue closed
+	s.stack.Close()
+	s.stack.Wait()
+	s.stack.RemoveNIC(NIC_ID)
+	s.endpoint.Close()
+	return nil
+}
+
+// DialContext connects to the IPv4 address via the stack, network is tcp or udp
+func (s *Stack) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	remote, err := s.fullAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "tcp4":
+		return gonet.DialContextTCP(ctx, s.stack, remote, ipv4.ProtocolNumber)
+	case "udp", "udp4":
+		return gonet.DialUDP(s.stack, nil, &remote, ipv4.ProtocolNumber)
+	}
+	return nil, fmt.Errorf("unsupported network %s", network)
+}
+
+// Listen accepts the TCP connections to the address of the VIP, the VIP is used if the host is empty
+func (s *Stack) Listen(network string, address string) (net.Listener, error) {
+	local, err := s.localAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	return gonet.ListenTCP(s.stack, local, ipv4.ProtocolNumber)
+}
+
+// ListenPacket receives the UDP packets to the address of the VIP, the VIP is used if the host is empty
+func (s *Stack) ListenPacket(network string, address string) (net.PacketConn, error) {
+	local, err := s.localAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network != "udp" && network != "udp4" {
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	return gonet.DialUDP(s.stack, &local, nil, ipv4.ProtocolNumber)
+}
+
+func (s *Stack) localAddress(address string) (tcpip.FullAddress, error) {
+	if host, _, err := net.SplitHostPort(address); err == nil && host == "" {
+		address = net.JoinHostPort(net.IP(s.vip).String(), address[1:])
+	}
+	local, err := s.fullAddress(address)
+	if err == nil && local.Addr != s.vip {
+		return local, fmt.Errorf("%s is not the VIP %s", net.IP(local.Addr), net.IP(s.vip))
+	}
+	return local, err
+}
+
+func (s *Stack) fullAddress(address string) (tcpip.FullAddress, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return tcpip.FullAddress{}, err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return tcpip.FullAddress{}, fmt.Errorf("%s is not an IPv4 address", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, fmt.Errorf("invalid port %q", port)
+	}
+	return tcpip.FullAddress{NIC: NIC_ID, Addr: tcpip.Address(ip), Port: uint16(p)}, nil
+}
+
+// Pipe copies the data between both sides until both closed, the write side is closed once the other side finished
+func Pipe(left net.Conn, right net.Conn) {
+	done := make(chan struct{}, 2)
+	copy := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		if conn, ok := dst.(interface{ CloseWrite() error }); ok {
+			conn.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copy(left, right)
+	go copy(right, left)
+	<-done
+	<-done
+	left.Close()
+	right.Close()
+}
@@ -0,0 +1,222 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package netstack
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// link the stacks as if the packets were forwarded by the peers
+func link(t *testing.T, a *Stack, b *Stack) {
+	relay := func(from *Stack, to *Stack) {
+		buff := make([]byte, 1500)
+		for {
+			n, err := from.Read(buff)
+			if err != nil {
+				return
+			}
+			to.Write(append([]byte{}, buff[:n]...))
+		}
+	}
+	go relay(a, b)
+	go relay(b, a)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+}
+
+func newStacks(t *testing.T) (*Stack, *Stack) {
+	a, err := New("10.10.0.2/24", 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("10.10.0.3/24", 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link(t, a, b)
+	return a, b
+}
+
+// echo serves the lines received with the prefix
+func echo(t *testing.T, prefix string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprintf(conn, "%s%s", prefix, line)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// forward the connections to port of the VIP to target
+func forward(t *testing.T, s *Stack, port int, target string) {
+	listener, err := s.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			local, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go Pipe(conn, local)
+		}
+	}()
+}
+
+func roundTrip(t *testing.T, conn net.Conn, line string) string {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, line+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestDial(t *testing.T) {
+	a, b := newStacks(t)
+	forward(t, b, 22, echo(t, "b:"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := a.DialContext(ctx, "tcp", "10.10.0.3:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reply := roundTrip(t, conn, "hello"); reply != "b:hello\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	// nothing listens on the port
+	if _, err := a.DialContext(ctx, "tcp", "10.10.0.3:23"); err == nil {
+		t.Fatal("connected to the port not forwarded")
+	}
+	// only the VIP is held by the stack
+	if _, err := b.Listen("tcp", "10.10.0.9:22"); err == nil {
+		t.Fatal("listened on the address other than VIP")
+	}
+}
+
+func TestSocks(t *testing.T) {
+	a, b := newStacks(t)
+	forward(t, b, 22, echo(t, "b:"))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ServeSocks(listener, a.DialContext)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// no authentication, then CONNECT 10.10.0.3:22
+	conn.Write([]byte{SOCKS_VERSION, 1, SOCKS_NO_AUTH})
+	conn.Write([]byte{SOCKS_VERSION, SOCKS_CONNECT, 0, SOCKS_IPV4, 10, 10, 0, 3, 0, 22})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != SOCKS_VERSION || reply[1] != SOCKS_NO_AUTH || reply[3] != SOCKS_SUCCEEDED {
+		t.Fatalf("unexpected SOCKS5 reply %v", reply)
+	}
+	if line := roundTrip(t, conn, "hello"); line != "b:hello\n" {
+		t.Fatalf("unexpected reply %q", line)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	a, b := newStacks(t)
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	go http.Serve(web, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "b:"+r.URL.Path)
+	}))
+	forward(t, b, 80, web.Addr().String())
+	forward(t, b, 22, echo(t, "b:"))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ServeHTTP(listener, a.DialContext)
+
+	proxy, _ := url.Parse("http://" + listener.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}, Timeout: 5 * time.Second}
+	res, err := client.Get("http://10.10.0.3/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "b:/index" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// CONNECT tunnels any TCP connection
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT 10.10.0.3:22 HTTP/1.1\r\nHost: 10.10.0.3:22\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", res, err)
+	}
+	io.WriteString(conn, "hello\n")
+	if line, _ := reader.ReadString('\n'); line != "b:hello\n" {
+		t.Fatalf("unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package netstack
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SOCKS_VERSION = 5
+	// no authentication required
+	SOCKS_NO_AUTH    = 0
+	SOCKS_NO_METHODS = 0xff
+	SOCKS_CONNECT    = 1
+	SOCKS_IPV4       = 1
+	SOCKS_DOMAIN     = 3
+	SOCKS_IPV6       = 4
+	// the replies
+	SOCKS_SUCCEEDED       = 0
+	SOCKS_FAILURE         = 1
+	SOCKS_REFUSED         = 5
+	SOCKS_UNSUPPORTED_CMD = 7
+	SOCKS_UNSUPPORTED_ATY = 8
+	// the requests must be sent in
+	PROXY_TIMEOUT = 30 * time.Second
+)
+
+// DialFunc connects to the address via the overlay or directly
+type DialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// ServeSocks serves the SOCKS5 CONNECT requests on listener until closed
+func ServeSocks(listener net.Listener, dial DialFunc) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := socks(conn, dial); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"ERROR":  err,
+					"Client": conn.RemoteAddr(),
+				}).Debug("SOCKS5 request error")
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func socks(conn net.Conn, dial DialFunc) error {
+	conn.SetDeadline(time.Now().Add(PROXY_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	// VER NMETHODS METHODS
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return err
+	}
+	if head[0] != SOCKS_VERSION {
+		return fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return err
+	}
+	method := byte(SOCKS_NO_METHODS)
+	for _, m := range methods {
+		if m == SOCKS_NO_AUTH {
+			method = SOCKS_NO_AUTH
+		}
+	}
+	if _, err := conn.Write([]byte{SOCKS_VERSION, method}); err != nil || method == SOCKS_NO_METHODS {
+		return errors.New("no acceptable authentication method")
+	}
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return err
+	}
+	var host string
+	switch request[3] {
+	case SOCKS_IPV4, SOCKS_IPV6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == SOCKS_IPV6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return err
+		}
+		host = ip.String()
+	case SOCKS_DOMAIN:
+		size, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, SOCKS_UNSUPPORTED_ATY)
+		return fmt.Errorf("unsupported address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return err
+	}
+	if request[1] != SOCKS_CONNECT {
+		socksReply(conn, SOCKS_UNSUPPORTED_CMD)
+		return fmt.Errorf("unsupported command %d", request[1])
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	ctx, cancel := context.WithTimeout(context.Background(), PROXY_TIMEOUT)
+	defer cancel()
+	remote, err := dial(ctx, "tcp", address)
+	if err != nil {
+		socksReply(conn, SOCKS_REFUSED)
+		return err
+	}
+	if err := socksReply(conn, SOCKS_SUCCEEDED); err != nil {
+		remote.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	// the data sent with the request
+	if n := reader.Buffered(); n > 0 {
+		buff, _ := reader.Peek(n)
+		if _, err := remote.Write(buff); err != nil {
+			remote.Close()
+			return err
+		}
+	}
+	Pipe(conn, remote)
+	return nil
+}
+
+// the bound address is never used by the clients
+func socksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{SOCKS_VERSION, reply, 0, SOCKS_IPV4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// ServeHTTP serves the HTTP proxy requests on listener until closed, both CONNECT and the plain requests
+func ServeHTTP(listener net.Listener, dial DialFunc) error {
+	transport := &http.Transport{DialContext: dial, Proxy: nil}
+	server := &http.Server{
+		Handler:           &httpProxy{dial: dial, transport: transport},
+		ReadHeaderTimeout: PROXY_TIMEOUT,
+	}
+	return server.Serve(listener)
+}
+
+type httpProxy struct {
+	dial      DialFunc
+	transport *http.Transport
+}
+
+// the hop-by-hop headers are never forwarded
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	res, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+	for k, values := range res.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), PROXY_TIMEOUT)
+	defer cancel()
+	remote, err := p.dial(ctx, "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, buff, err := hijacker.Hijack()
+	if err != nil {
+		remote.Close()
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+	if n := buff.Reader.Buffered(); n > 0 {
+		data, _ := buff.Reader.Peek(n)
+		remote.Write(data)
+	}
+	Pipe(conn, remote)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// the packets smaller than it are sent as is
+	COMPRESS_MIN_SIZE = 128
+	// the compressed packet must save 1/8 at least
+	COMPRESS_MIN_SAVING = 8
+	// skip the following packets after the incompressible ones, doubled every time up to COMPRESS_MAX_SKIP
+	COMPRESS_MIN_SKIP = 8
+	COMPRESS_MAX_SKIP = 256
+)
+
+var (
+	encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderCRC(false), zstd.WithEncoderConcurrency(1))
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(math.MaxUint16))
+)
+
+// compressor skips the payloads adaptively once they turn out to be compressed already
+type compressor struct {
+	// the packets to skip
+	skip int
+	// the packets to skip after the next incompressible one
+	backoff int
+}
+
+// compress returns the compressed payload, nil if it's not worth, should be called with wm locked
+func (c *compressor) compress(payload []byte) []byte {
+	if len(payload) < COMPRESS_MIN_SIZE {
+		return nil
+	}
+	if c.skip > 0 {
+		c.skip--
+		return nil
+	}
+	compressed := encoder.EncodeAll(payload, make([]byte, 0, len(payload)))
+	if len(compressed) > len(payload)-len(payload)/COMPRESS_MIN_SAVING {
+		if c.backoff < COMPRESS_MIN_SKIP {
+			c.backoff = COMPRESS_MIN_SKIP
+		}
+		c.skip = c.backoff
+		if c.backoff < COMPRESS_MAX_SKIP {
+			c.backoff *= 2
+		}
+		return nil
+	}
+	c.backoff = 0
+	return compressed
+}
+
+func decompress(payload []byte) ([]byte, error) {
+	packet, err := decoder.DecodeAll(payload, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompress packet error: %s", err)
+	}
+	return packet, nil
+}
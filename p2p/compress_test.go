@@ -0,0 +1,91 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	var c compressor
+	for _, size := range []int{COMPRESS_MIN_SIZE, 1400, FRAME_MAX_PAYLOAD} {
+		payload := bytes.Repeat([]byte("gvn packet "), size/11+1)[:size]
+		compressed := c.compress(payload)
+		if compressed == nil || len(compressed) >= len(payload) {
+			t.Fatalf("%d bytes not compressed", size)
+		}
+		packet, err := decompress(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packet, payload) {
+			t.Fatalf("%d bytes changed by the round trip", size)
+		}
+	}
+	if c.compress(make([]byte, COMPRESS_MIN_SIZE-1)) != nil {
+		t.Error("compressed the small packet")
+	}
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	var c compressor
+	random := make([]byte, 1400)
+	rand.New(rand.NewSource(1)).Read(random)
+	compressible := make([]byte, 1400)
+
+	// the skipped packets double after every incompressible one
+	for _, skip := range []int{COMPRESS_MIN_SKIP, COMPRESS_MIN_SKIP * 2, COMPRESS_MIN_SKIP * 4} {
+		if c.compress(random) != nil {
+			t.Fatal("compressed the random payload")
+		}
+		for i := 0; i < skip; i++ {
+			if c.compress(compressible) != nil {
+				t.Fatalf("packet %d of %d not skipped", i, skip)
+			}
+		}
+	}
+	// reset once compressed again
+	if c.compress(compressible) == nil {
+		t.Fatal("compressible payload not compressed after the skip")
+	}
+	c.compress(random)
+	if c.skip != COMPRESS_MIN_SKIP {
+		t.Errorf("skip %d after compressed, want %d", c.skip, COMPRESS_MIN_SKIP)
+	}
+
+	// capped at COMPRESS_MAX_SKIP
+	for i := 0; i < 16; i++ {
+		c.skip = 0
+		c.compress(random)
+	}
+	if c.skip != COMPRESS_MAX_SKIP {
+		t.Errorf("skip %d, want %d", c.skip, COMPRESS_MAX_SKIP)
+	}
+}
+
+func TestDecompressBomb(t *testing.T) {
+	// expands far beyond any frame
+	bomb := encoder.EncodeAll(make([]byte, 16*math.MaxUint16), nil)
+	if _, err := decompress(bomb); err == nil {
+		t.Fatal("decompressed beyond the frame size")
+	}
+	if _, err := decompress([]byte("not zstd")); err == nil {
+		t.Fatal("decompressed garbage")
+	}
+}
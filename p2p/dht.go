@@ -18,6 +18,7 @@ package p2p
 import (
 	"context"
 	"encoding/binary"
+	"fmt"
 	"time"
 
 	ds "github.com/ipfs/go-datastore"
@@ -31,14 +32,17 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	kdht             *dht.IpfsDHT
-	routingDiscovery *discovery.RoutingDiscovery
+const (
+	// the DHT protocols are /gvn/<network>/kad/1.0.0
+	DHT_PREFIX = "/gvn"
 )
 
-func NewDHT(host host.Host, zone string, bootstraps []string) *dht.IpfsDHT {
-	ctx := context.Background()
+// NewDHT joins the DHT of the network only, the records are never exchanged with the public IPFS DHT or the nodes of
+// other networks. The libp2p default DHT is joined if no network configured, as the older versions did. The zone is
+// advertised until ctx done, the DHT must be closed by the caller
+func NewDHT(ctx context.Context, host host.Host, zone string, network string, bootstraps []string) (*dht.IpfsDHT, error) {
 	addrs := make([]peer.AddrInfo, 0)
+	var kdht *dht.IpfsDHT
 	if len(bootstraps) > 0 {
 		for _, bootstrap := range bootstraps {
 			addr, err := peer.AddrInfoFromString(bootstrap)
@@ -48,9 +52,11 @@ func NewDHT(host host.Host, zone string, bootstraps []string) *dht.IpfsDHT {
 			addrs = append(addrs, *addr)
 		}
 
-		dstore := dsync.MutexWrap(ds.NewMapDatastore())
-
-		kdht = dht.NewDHT(ctx, host, dstore)
+		var err error
+		kdht, err = dht.New(ctx, host, dhtOptions(network, addrs)...)
+		if err != nil {
+			return nil, fmt.Errorf("create DHT error: %s", err)
+		}
 		if err := kdht.Bootstrap(ctx); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"ERROR": err,
@@ -75,17 +81,37 @@ func NewDHT(host host.Host, zone string, bootstraps []string) *dht.IpfsDHT {
 			}
 		}
 	}
-	routingDiscovery = discovery.NewRoutingDiscovery(kdht)
+	if kdht == nil {
+		return nil, fmt.Errorf("no bootstrap peer of network %q", network)
+	}
+	routingDiscovery := discovery.NewRoutingDiscovery(kdht)
 	discovery.Advertise(ctx, routingDiscovery, zone)
-	go FindPeerIdsViaDHT(host, zone)
+	go FindPeerIdsViaDHT(ctx, routingDiscovery, host, zone)
 	dht.RoutingTableRefreshPeriod(60 * time.Second)
-	return kdht
+	return kdht, nil
+}
+
+// DHTPrefix is the protocol prefix of the DHT of the network, the libp2p default if no network configured
+func DHTPrefix(network string) protocol.ID {
+	if network == "" {
+		return dht.DefaultPrefix
+	}
+	return protocol.ID(DHT_PREFIX + "/" + network)
+}
+
+// the prefix is set only if the network configured, so that the nodes without network still find the older ones
+func dhtOptions(network string, bootstraps []peer.AddrInfo) []dht.Option {
+	options := []dht.Option{dht.Datastore(dsync.MutexWrap(ds.NewMapDatastore())), dht.BootstrapPeers(bootstraps...)}
+	if network != "" {
+		options = append(options, dht.ProtocolPrefix(DHTPrefix(network)))
+	}
+	return options
 }
 
 func NewStreams(host host.Host, zone string, peerIds []string) map[string]network.Stream {
 	// TODO: streams := make(map[string][]network.Stream)
-	ctx, _ := context.WithCancel(context.Background())
-	// defer cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	streams := make(map[string]network.Stream)
 	conns := host.Network().Conns()
 	for _, conn := range conns {
@@ -152,8 +178,8 @@ func NewStreams(host host.Host, zone string, peerIds []string) map[string]networ
 }
 
 func NewStream(host host.Host, zone string, peerId string) network.Stream {
-	ctx, _ := context.WithCancel(context.Background())
-	// defer cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	if id, err := peer.Decode(peerId); err == nil {
 		stream, err := host.NewStream(ctx, id, protocol.ID(zone))
 		if err != nil {
@@ -168,12 +194,12 @@ func FindPeerIdsViaPubSub() []string {
 	return nil
 }
 
-func FindPeerIdsViaDHT(host host.Host, zone string) []string {
+func FindPeerIdsViaDHT(ctx context.Context, routingDiscovery *discovery.RoutingDiscovery, host host.Host, zone string) []string {
 	// TODO: check kdht nil
 	// TODO: multiplex the connection
 	peerIds := make([]string, 0)
 	if routingDiscovery != nil {
-		peers, err := routingDiscovery.FindPeers(context.Background(), zone)
+		peers, err := routingDiscovery.FindPeers(ctx, zone)
 		if err != nil {
 			return peerIds
 		}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestDHTIsolation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+	// two nodes of each network, the empty one is the libp2p default as the older versions
+	networks := []string{"home", "home", "office", "office", "", ""}
+	hosts := make([]host.Host, len(networks))
+	dhts := make([]*dht.IpfsDHT, len(networks))
+	for i, network := range networks {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the mock addresses are never public, so the server mode is forced
+		kdht, err := dht.New(ctx, h, append(dhtOptions(network, nil), dht.Mode(dht.ModeServer))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kdht.Close()
+		hosts[i], dhts[i] = h, kdht
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peers of the same network are added to the routing table once identified
+	deadline := time.Now().Add(5 * time.Second)
+	for i := range dhts {
+		for dhts[i].RoutingTable().Find(hosts[i^1].ID()) == "" {
+			if time.Now().After(deadline) {
+				t.Fatalf("%q peers never found each other", networks[i])
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	for i, kdht := range dhts {
+		peers := kdht.RoutingTable().ListPeers()
+		if len(peers) != 1 || peers[0] != hosts[i^1].ID() {
+			t.Errorf("%q peer %d has %v in the routing table, want only %s", networks[i], i, peers, hosts[i^1].ID())
+		}
+	}
+	if prefix := DHTPrefix(""); prefix != dht.DefaultPrefix {
+		t.Errorf("DHTPrefix(\"\") = %s, want the default %s", prefix, dht.DefaultPrefix)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/songgao/water/waterutil"
+)
+
+const (
+	// the broadcast and multicast packets flooded per second by default
+	FLOOD_RATE = 100
+	// the packets received are remembered in, the same ones read from the device are looped back
+	FLOOD_DEDUP_WINDOW = 2 * time.Second
+)
+
+var (
+	limitedBroadcast = net.IPv4bcast
+	multicastNet     = &net.IPNet{IP: net.IPv4(224, 0, 0, 0), Mask: net.CIDRMask(4, 32)}
+)
+
+// FloodConfig selects the broadcast and multicast packets forwarded to the peers in TUN mode
+type FloodConfig struct {
+	// the packets to the broadcast address of the VIP network
+	Broadcast bool `yaml:"broadcast,omitempty"`
+	// the multicast groups, 224.0.0.251 or 239.0.0.0/8 for example
+	Groups []string `yaml:"groups,omitempty"`
+	// send the multicast packets to the peers selected the group only rather than all the peers
+	Subscribed bool `yaml:"subscribed,omitempty"`
+	// packets per second, FLOOD_RATE if 0
+	Rate int `yaml:"rate,omitempty"`
+}
+
+// FieldError is an invalid field of the flood config
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Validate returns the FieldErrors of the groups and rate
+func (c FloodConfig) Validate() []error {
+	errs := make([]error, 0)
+	for i, group := range c.Groups {
+		if _, err := parseGroup(group); err != nil {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("flood.groups[%d]", i), Message: err.Error()})
+		}
+	}
+	if c.Rate < 0 {
+		errs = append(errs, FieldError{Field: "flood.rate", Message: fmt.Sprintf("invalid rate %d", c.Rate)})
+	}
+	return errs
+}
+
+// Empty reports nothing is flooded
+func (c FloodConfig) Empty() bool {
+	return !c.Broadcast && len(c.Groups) == 0
+}
+
+// FloodStats are the counters of the flooder
+type FloodStats struct {
+	// the packets flooded to the peers
+	Sent uint64 `json:"sent"`
+	// the packets received from the peers
+	Received uint64 `json:"received"`
+	// dropped since seen recently or from the overlay
+	Looped uint64 `json:"looped"`
+	// dropped by the rate limit
+	Limited uint64 `json:"limited"`
+}
+
+// Flooder decides which of the broadcast and multicast packets are flooded, the packets are never flooded twice so
+// that they don't loop among the peers
+type Flooder struct {
+	config FloodConfig
+	groups []*net.IPNet
+	// the broadcast address of the VIP network, nil if unknown yet
+	broadcast net.IP
+	// the token bucket in packets
+	rate   float64
+	tokens float64
+	last   time.Time
+	// the hash of the packets received -> when received
+	seen  map[uint64]time.Time
+	swept time.Time
+	stats FloodStats
+	mu    sync.Mutex
+}
+
+func NewFlooder(config FloodConfig) (*Flooder, error) {
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	f := &Flooder{config: config, seen: make(map[uint64]time.Time), last: time.Now(), swept: time.Now()}
+	for _, group := range config.Groups {
+		network, _ := parseGroup(group)
+		f.groups = append(f.groups, network)
+	}
+	f.rate = float64(config.Rate)
+	if f.rate == 0 {
+		f.rate = FLOOD_RATE
+	}
+	f.tokens = f.rate
+	return f, nil
+}
+
+// SetNetwork sets the VIP network of the device in CIDR, its broadcast address is flooded if enabled
+func (f *Flooder) SetNetwork(vip string) {
+	_, network, err := net.ParseCIDR(vip)
+	if err != nil || network.IP.To4() == nil {
+		return
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = network.IP.To4()[i] | ^network.Mask[i]
+	}
+	f.mu.Lock()
+	f.broadcast = broadcast
+	f.mu.Unlock()
+}
+
+// Groups are the multicast groups selected, the peers send them to self only in subscribed mode
+func (f *Flooder) Groups() []string {
+	return f.config.Groups
+}
+
+// Match reports whether the packet to dst is flooded
+func (f *Flooder) Match(dst net.IP) bool {
+	if dst.Equal(limitedBroadcast) {
+		return f.config.Broadcast
+	}
+	if multicastNet.Contains(dst) {
+		return f.group(dst)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.config.Broadcast && f.broadcast != nil && dst.Equal(f.broadcast)
+}
+
+// Wanted reports whether the peer of session wants the packet to dst
+func (f *Flooder) Wanted(session *Session, dst net.IP) bool {
+	if !f.config.Subscribed || !multicastNet.Contains(dst) {
+		return true
+	}
+	for _, group := range session.Groups {
+		if network, err := parseGroup(group); err == nil && network.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// Outgoing reports whether the packet read from the device is flooded, false if it's received from the peers
+// recently or exceeds the rate
+func (f *Flooder) Outgoing(packet []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.received(packet, now) {
+		f.stats.Looped++
+		return false
+	}
+	f.tokens += now.Sub(f.last).Seconds() * f.rate
+	if f.tokens > f.rate {
+		f.tokens = f.rate
+	}
+	f.last = now
+	if f.tokens < 1 {
+		f.stats.Limited++
+		return false
+	}
+	f.tokens--
+	f.stats.Sent++
+	return true
+}
+
+// Incoming reports whether the packet received from the peers is written to the device, the packet is remembered so
+// that it's never flooded again if the system sends it back
+func (f *Flooder) Incoming(packet []byte) bool {
+	if !f.Match(waterutil.IPv4Destination(packet)) {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.sweep(now)
+	f.seen[packetHash(packet)] = now
+	f.stats.Received++
+	return true
+}
+
+// Looped counts the packet dropped since it's from the overlay
+func (f *Flooder) Looped() {
+	f.mu.Lock()
+	f.stats.Looped++
+	f.mu.Unlock()
+}
+
+func (f *Flooder) Stats() FloodStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+func (f *Flooder) group(dst net.IP) bool {
+	for _, network := range f.groups {
+		if network.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// received reports whether the packet is received in FLOOD_DEDUP_WINDOW, should be called with mu locked
+func (f *Flooder) received(packet []byte, now time.Time) bool {
+	seen, ok := f.seen[packetHash(packet)]
+	return ok && now.Sub(seen) <= FLOOD_DEDUP_WINDOW
+}
+
+// forget the packets received before FLOOD_DEDUP_WINDOW, should be called with mu locked
+func (f *Flooder) sweep(now time.Time) {
+	if now.Sub(f.swept) <= FLOOD_DEDUP_WINDOW {
+		return
+	}
+	for sum, seen := range f.seen {
+		if now.Sub(seen) > FLOOD_DEDUP_WINDOW {
+			delete(f.seen, sum)
+		}
+	}
+	f.swept = now
+}
+
+// the hash of the IPv4 packet without TTL and checksum, which are changed once the packet is forwarded
+func packetHash(packet []byte) uint64 {
+	h := fnv.New64a()
+	if len(packet) < 20 {
+		h.Write(packet)
+		return h.Sum64()
+	}
+	h.Write(packet[:8])
+	h.Write(packet[9:10])
+	h.Write(packet[12:])
+	return h.Sum64()
+}
+
+// a group is a multicast address or network
+func parseGroup(group string) (*net.IPNet, error) {
+	if !strings.Contains(group, "/") {
+		group += "/32"
+	}
+	ip, network, err := net.ParseCIDR(group)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil || !multicastNet.Contains(network.IP) {
+		return nil, fmt.Errorf("%s is not an IPv4 multicast group", group)
+	}
+	return network, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"net"
+	"testing"
+)
+
+// udp builds an IPv4 header good enough to be hashed
+func udp(src string, dst string, payload string) []byte {
+	buff := make([]byte, 28+len(payload))
+	buff[0] = 0x45
+	buff[8] = 64
+	buff[9] = 17
+	copy(buff[12:16], net.ParseIP(src).To4())
+	copy(buff[16:20], net.ParseIP(dst).To4())
+	copy(buff[28:], payload)
+	return buff
+}
+
+func TestFloodMatch(t *testing.T) {
+	if _, err := NewFlooder(FloodConfig{Groups: []string{"10.0.0.1"}}); err == nil {
+		t.Fatal("unicast group accepted")
+	}
+	f, err := NewFlooder(FloodConfig{Broadcast: true, Groups: []string{"224.0.0.251", "239.0.0.0/8"}, Subscribed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetNetwork("10.1.0.2/24")
+	for dst, flooded := range map[string]bool{
+		"10.1.0.255":      true,
+		"255.255.255.255": true,
+		"224.0.0.251":     true,
+		"239.255.255.250": true,
+		"224.0.0.252":     false,
+		"10.1.0.3":        false,
+	} {
+		if f.Match(net.ParseIP(dst)) != flooded {
+			t.Errorf("%s flooded %t", dst, !flooded)
+		}
+	}
+	session := &Session{Groups: []string{"239.0.0.0/8"}}
+	if f.Wanted(session, net.ParseIP("224.0.0.251")) || !f.Wanted(session, net.ParseIP("239.1.2.3")) || !f.Wanted(session, net.ParseIP("10.1.0.255")) {
+		t.Fatal("the packets not sent to the subscribed peers only")
+	}
+}
+
+func TestFloodLoopAndRate(t *testing.T) {
+	f, _ := NewFlooder(FloodConfig{Groups: []string{"224.0.0.251"}, Rate: 2})
+	received := udp("10.1.0.3", "224.0.0.251", "query")
+	if !f.Incoming(received) {
+		t.Fatal("packet of the group not received")
+	}
+	// sent back by the system with TTL decreased
+	looped := append([]byte{}, received...)
+	looped[8]--
+	if f.Outgoing(looped) {
+		t.Fatal("packet received flooded again")
+	}
+	if f.Incoming(udp("10.1.0.3", "224.0.0.252", "query")) {
+		t.Fatal("packet of other group received")
+	}
+	sent := 0
+	for i := 0; i < 5; i++ {
+		if f.Outgoing(udp("10.1.0.2", "224.0.0.251", "query")) {
+			sent++
+		}
+	}
+	if stats := f.Stats(); sent != 2 || stats.Limited != 3 || stats.Looped != 1 || stats.Received != 1 {
+		t.Fatalf("unexpected %d sent, stats %+v", sent, stats)
+	}
+}
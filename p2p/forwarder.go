@@ -0,0 +1,515 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/route"
+	"github.com/liloew/gvn/tun"
+	"github.com/sirupsen/logrus"
+	"github.com/songgao/water/waterutil"
+)
+
+const (
+	KEEPALIVE_INTERVAL = 10 * time.Second
+	// the session is reset and the peer disconnected if nothing read in
+	KEEPALIVE_TIMEOUT = 30 * time.Second
+	// the read from the device is retried after READ_RETRY_MIN once failed, doubled every time up to READ_RETRY_MAX
+	READ_RETRY_MIN = 10 * time.Millisecond
+	READ_RETRY_MAX = time.Second
+)
+
+// PacketTooBigError reports the packet exceeds the path MTU and can't be fragmented
+type PacketTooBigError struct {
+	Size int
+	Mtu  int
+}
+
+func (e PacketTooBigError) Error() string {
+	return fmt.Sprintf("packet size %d exceeds the path MTU %d", e.Size, e.Mtu)
+}
+
+// Forwarder forwards the packets between the TUN device and the peers owning the destinations
+type Forwarder struct {
+	host host.Host
+	// the legacy protocol of the data stream
+	zone   string
+	routes *route.RouteTable
+	device tun.Interface
+	// the source of the ICMP messages written back to the device
+	Vip net.IP
+	// clamp the MSS of TCP SYN packets to fit in the MTU
+	MssClamp bool
+	// Send sends the packets read from the device, Forward by default
+	Send func(packet []byte)
+	// Filter drops the packets received from the session if returns false
+	Filter func(session *Session, packet []byte) bool
+	// the keepalive frames are sent every Keepalive on the sessions negotiated keepalive
+	Keepalive        time.Duration
+	KeepaliveTimeout time.Duration
+	// the id of the gvn network, the sessions with the nodes of other networks are refused
+	Network string
+	// offered to the peers by handshake, Capabilities by default
+	Capabilities []string
+	// the virtual switch in TAP mode, the device reads and writes the Ethernet frames rather than IP packets
+	Switch *Switch
+	// floods the broadcast and multicast packets selected in TUN mode, they are discarded if nil
+	Flooder *Flooder
+	// the stats and the incompatibility of the peers
+	Peers *Peers
+	// the MTU of the device, 0 if unknown yet
+	mtu int
+	// peer id -> session
+	sessions map[string]*Session
+	mu       sync.RWMutex
+}
+
+func NewForwarder(host host.Host, zone string, routes *route.RouteTable) *Forwarder {
+	f := &Forwarder{
+		host:         host,
+		zone:         zone,
+		routes:       routes,
+		sessions:     make(map[string]*Session),
+		Peers:        NewPeers(),
+		Capabilities: append([]string{}, Capabilities...),
+		// the zero values disable keepalive
+		Keepalive:        KEEPALIVE_INTERVAL,
+		KeepaliveTimeout: KEEPALIVE_TIMEOUT,
+	}
+	f.Send = f.Forward
+	return f
+}
+
+// HandleStream negotiates the session on the incoming stream and writes the packets to the device
+func (f *Forwarder) HandleStream(stream network.Stream) {
+	logrus.WithFields(logrus.Fields{
+		"LocalPeer":  stream.Conn().LocalPeer(),
+		"RemotePeer": stream.Conn().RemotePeer(),
+		"LocalAddr":  stream.Conn().LocalMultiaddr(),
+		"RemoteAddr": stream.Conn().RemoteMultiaddr(),
+		"Protocol":   stream.Protocol(),
+	}).Info("handler new stream")
+	session, err := Handshake(stream, f.Hello())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR":      err,
+			"RemotePeer": stream.Conn().RemotePeer(),
+		}).Error("Handshake with peer error")
+		closeRejected(stream, err)
+		if _, ok := err.(IncompatibleError); ok {
+			f.Peers.SetIncompatible(stream.Conn().RemotePeer())
+		}
+		return
+	}
+	f.Peers.attach(session)
+	go f.readData(session)
+	go f.keepalive(session)
+}
+
+// Serve reads the packets from device and sends them until the device closed
+func (f *Forwarder) Serve(device tun.Interface) error {
+	f.mu.Lock()
+	f.device = device
+	size := f.mtu
+	f.mu.Unlock()
+	if size <= 0 {
+		size = 65535
+	} else if f.Switch != nil {
+		// the Ethernet header and a VLAN tag
+		size += ETHERNET_HEADER + 4
+	}
+	var retry time.Duration
+	for {
+		frame := make([]byte, size)
+		n, err := device.Read(frame)
+		if err != nil {
+			// the device is gone
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, io.EOF) {
+				return err
+			}
+			if retry = retry * 2; retry < READ_RETRY_MIN {
+				retry = READ_RETRY_MIN
+			} else if retry > READ_RETRY_MAX {
+				retry = READ_RETRY_MAX
+			}
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"Retry": retry,
+			}).Error("Read packet from TUN error")
+			time.Sleep(retry)
+			continue
+		}
+		retry = 0
+		frame = frame[:n]
+		if f.Switch != nil {
+			if len(frame) >= ETHERNET_HEADER {
+				f.SwitchFrame(frame)
+			}
+			continue
+		}
+		if len(frame) == 0 || waterutil.IsIPv6(frame) {
+			// Only process IPv4 packet
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"SRC": waterutil.IPv4Source(frame).String(),
+			"DST": waterutil.IPv4Destination(frame).String(),
+		}).Debug("TUN - Packet SRC and DST")
+		if waterutil.IPv4Source(frame).Equal(waterutil.IPv4Destination(frame)) {
+			continue
+		}
+		if f.MssClamp {
+			tun.ClampMSS(frame, size)
+		}
+		f.Send(frame)
+	}
+}
+
+// Forward sends the packet to the peer, the ICMP is written back to the device if the packet is too big
+func (f *Forwarder) Forward(packet []byte) {
+	if err := f.ForwardPacket(packet); err != nil {
+		if e, ok := err.(PacketTooBigError); ok {
+			f.replyTooBig(packet, e.Mtu)
+		}
+	}
+}
+
+// ForwardPacket sends the packet to the peer owns the destination, PacketTooBigError is returned if the packet
+// exceeds the path MTU and has DF set, the other errors are logged only
+func (f *Forwarder) ForwardPacket(packets []byte) error {
+	dst := waterutil.IPv4Destination(packets)
+	if f.Flooder != nil && f.Flooder.Match(dst) {
+		f.flood(packets)
+		return nil
+	}
+	if entry, found := f.routes.Get(dst.String()); found {
+		peerId := entry.Peer
+		session, err := f.session(peerId)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"Peer":  peerId,
+			}).Error("Forward to stream error")
+			return nil
+		}
+		if session.Mtu > 0 && len(packets) > session.Mtu {
+			if tun.DontFragment(packets) {
+				return PacketTooBigError{Size: len(packets), Mtu: session.Mtu}
+			}
+			for _, fragment := range tun.Fragment(packets, session.Mtu) {
+				if err := f.ForwardPacket(fragment); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		f.writeFrame(peerId, session, FrameTypePacket, packets)
+	} else {
+		// discard
+		logrus.WithFields(logrus.Fields{
+			"SRC": waterutil.IPv4Source(packets).String(),
+			"DST": dst,
+		}).Error("Discard")
+	}
+	return nil
+}
+
+// flood sends the broadcast or multicast packet to all the peers want it, the packets from the overlay are never
+// flooded again so that they don't loop among the peers
+func (f *Forwarder) flood(packet []byte) {
+	self := f.host.ID().Pretty()
+	if entry, found := f.routes.Get(waterutil.IPv4Source(packet).String()); found && entry.Peer != self {
+		f.Flooder.Looped()
+		return
+	}
+	if !f.Flooder.Outgoing(packet) {
+		return
+	}
+	dst := waterutil.IPv4Destination(packet)
+	for _, peerId := range f.routes.Peers() {
+		if peerId == self {
+			continue
+		}
+		session, err := f.session(peerId)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+				"Peer":  peerId,
+			}).Debug("Flood to stream error")
+			continue
+		}
+		// the broadcast and multicast packets are never fragmented
+		if !f.Flooder.Wanted(session, dst) || (session.Mtu > 0 && len(packet) > session.Mtu) {
+			continue
+		}
+		f.writeFrame(peerId, session, FrameTypePacket, packet)
+	}
+}
+
+// whether the packet to dst is a broadcast or multicast one
+func (f *Forwarder) flooded(dst net.IP) bool {
+	return dst.Equal(limitedBroadcast) || multicastNet.Contains(dst) || (f.Flooder != nil && f.Flooder.Match(dst))
+}
+
+// SwitchFrame sends the Ethernet frame to the peer behind the destination, or floods it to all the peers but self
+// if the destination is unknown, broadcast or multicast. The frames received are never flooded again, so that they
+// don't loop among the peers
+func (f *Forwarder) SwitchFrame(frame []byte) {
+	if peerId, ok := f.Switch.Lookup(frame); ok {
+		f.sendFrame(peerId, frame)
+		return
+	}
+	self := f.host.ID().Pretty()
+	for _, peerId := range f.routes.Peers() {
+		if peerId != self {
+			f.sendFrame(peerId, frame)
+		}
+	}
+}
+
+func (f *Forwarder) sendFrame(peerId string, frame []byte) {
+	session, err := f.session(peerId)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+			"Peer":  peerId,
+		}).Debug("Switch to stream error")
+		return
+	}
+	if !session.Has(CapTap) {
+		logrus.WithFields(logrus.Fields{
+			"Peer": peerId,
+		}).Debug("Peer not in TAP mode, drop the frame")
+		return
+	}
+	f.writeFrame(peerId, session, FrameTypeEthernet, frame)
+}
+
+// session returns the session with the peer, a new one is negotiated if none
+func (f *Forwarder) session(peerId string) (*Session, error) {
+	f.mu.RLock()
+	session, ok := f.sessions[peerId]
+	f.mu.RUnlock()
+	if ok {
+		return session, nil
+	}
+	id, err := peer.Decode(peerId)
+	if err != nil {
+		return nil, err
+	}
+	if f.Peers.Incompatible(id) {
+		return nil, fmt.Errorf("peer %s is incompatible, retry after %s", peerId, INCOMPATIBLE_BACKOFF)
+	}
+	// make new stream
+	session, err = NewSession(f.host, f.zone, peerId, f.Hello())
+	if err != nil {
+		if _, ok := err.(IncompatibleError); ok {
+			f.Peers.SetIncompatible(id)
+		}
+		return nil, err
+	}
+	f.Peers.attach(session)
+	f.AddSession(peerId, session)
+	if session.Has(CapKeepalive) {
+		// the keepalives of the peer are read from the outgoing session as well
+		go f.readData(session)
+		go f.keepalive(session)
+	}
+	return session, nil
+}
+
+// write the frame to the session, the session is removed once reset
+func (f *Forwarder) writeFrame(peerId string, session *Session, typ FrameType, payload []byte) {
+	if err := session.WriteFrame(typ, payload); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+			"SIZE":  len(payload),
+		}).Error("Forward to stream error")
+		if err == ErrFrameTooLarge {
+			// nothing written so the session is still usable
+			return
+		}
+		// reset, closed, timed out or half-open, the session is renegotiated by the next packet
+		session.Reset()
+		f.RemoveSession(peerId, session)
+	}
+}
+
+// SetMtu sets the MTU of the device negotiated with the peers
+func (f *Forwarder) SetMtu(mtu int) {
+	f.mu.Lock()
+	f.mtu = mtu
+	f.mu.Unlock()
+}
+
+func (f *Forwarder) Mtu() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mtu
+}
+
+// Hello is sent to the peers by handshake
+func (f *Forwarder) Hello() Hello {
+	hello := Hello{
+		Version:      PROTOCOL_VERSION,
+		MinVersion:   MIN_PROTOCOL_VERSION,
+		Capabilities: f.Capabilities,
+		Mtu:          f.Mtu(),
+		Network:      f.Network,
+	}
+	if f.Flooder != nil {
+		hello.Groups = f.Flooder.Groups()
+	}
+	return hello
+}
+
+func (f *Forwarder) AddSession(peerId string, session *Session) {
+	f.mu.Lock()
+	f.sessions[peerId] = session
+	f.mu.Unlock()
+}
+
+// RemoveSession removes the session only if it's still the current one of the peer
+func (f *Forwarder) RemoveSession(peerId string, session *Session) {
+	f.mu.Lock()
+	if current, ok := f.sessions[peerId]; ok && current == session {
+		delete(f.sessions, peerId)
+	}
+	f.mu.Unlock()
+	if f.Switch != nil {
+		// the addresses may be behind another peer once it's back
+		f.Switch.Forget(peerId)
+	}
+}
+
+func (f *Forwarder) readData(session *Session) {
+	for {
+		typ, bytes, err := session.ReadFrame()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR":      err,
+				"RemotePeer": session.Conn().RemotePeer().Pretty(),
+			}).Error("Read data error")
+			session.Close()
+			f.RemoveSession(session.Conn().RemotePeer().Pretty(), session)
+			break
+		}
+		logrus.WithFields(logrus.Fields{
+			"LocalPeer":  session.Conn().LocalPeer().Pretty(),
+			"RemotePeer": session.Conn().RemotePeer().Pretty(),
+			"Type":       typ,
+		}).Debug("Read data from stream")
+		if typ == FrameTypeEthernet {
+			if f.Switch != nil && len(bytes) >= ETHERNET_HEADER {
+				f.Switch.Learn(bytes, session.Conn().RemotePeer().Pretty())
+				f.write(bytes)
+			}
+			continue
+		}
+		if typ != FrameTypePacket || f.Switch != nil {
+			continue
+		}
+		if waterutil.IsIPv4(bytes) && f.flooded(waterutil.IPv4Destination(bytes)) {
+			if f.Flooder == nil || !f.Flooder.Incoming(bytes) {
+				continue
+			}
+		} else if f.Filter != nil && !f.Filter(session, bytes) {
+			continue
+		}
+		if f.MssClamp {
+			tun.ClampMSS(bytes, minMtu(session.Mtu, f.Mtu()))
+		}
+		f.write(bytes)
+	}
+}
+
+// keepalive writes the keepalive frames until the session closed, the session is reset and the peer disconnected
+// once nothing read in KeepaliveTimeout, so that the half-open connections are noticed
+func (f *Forwarder) keepalive(session *Session) {
+	if !session.Has(CapKeepalive) || f.Keepalive <= 0 || f.KeepaliveTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(f.Keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-session.Done():
+			return
+		}
+		remote := session.Conn().RemotePeer()
+		if idle := session.Idle(); idle > f.KeepaliveTimeout {
+			logrus.WithFields(logrus.Fields{
+				"RemotePeer": remote.Pretty(),
+				"Idle":       idle,
+			}).Warn("Peer keepalive timeout, disconnect it")
+			session.Reset()
+			f.RemoveSession(remote.Pretty(), session)
+			f.host.Network().ClosePeer(remote)
+			return
+		}
+		// the write may block on the half-open connection
+		session.SetWriteDeadline(time.Now().Add(f.KeepaliveTimeout))
+		err := session.WriteFrame(FrameTypeKeepalive, nil)
+		session.SetWriteDeadline(time.Time{})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR":      err,
+				"RemotePeer": remote.Pretty(),
+			}).Debug("Write keepalive error")
+		}
+	}
+}
+
+// write the packet to the device, dropped if the device is not ready
+func (f *Forwarder) write(packet []byte) {
+	f.mu.RLock()
+	device := f.device
+	f.mu.RUnlock()
+	if device == nil {
+		return
+	}
+	// Write to TUN
+	if n, err := device.Write(packet); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+			"SIZE":  n,
+		}).Error("Write to TUN error")
+	}
+}
+
+// tell the source the packet is too big via ICMP, so that it lowers the path MTU
+func (f *Forwarder) replyTooBig(packet []byte, mtu int) {
+	logrus.WithFields(logrus.Fields{
+		"SRC":  waterutil.IPv4Source(packet).String(),
+		"DST":  waterutil.IPv4Destination(packet).String(),
+		"SIZE": len(packet),
+		"MTU":  mtu,
+	}).Debug("Packet too big")
+	if message := tun.PacketTooBig(packet, mtu, f.Vip); message != nil {
+		f.write(message)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// failingDevice fails every read with err until failures run out, then reports closed
+type failingDevice struct {
+	err      error
+	failures int
+	reads    []time.Time
+}
+
+func (d *failingDevice) Read(buff []byte) (int, error) {
+	d.reads = append(d.reads, time.Now())
+	if len(d.reads) > d.failures {
+		return 0, os.ErrClosed
+	}
+	return 0, d.err
+}
+
+func (d *failingDevice) Write(packet []byte) (int, error) {
+	return len(packet), nil
+}
+
+func (d *failingDevice) Close() error {
+	return nil
+}
+
+func TestServeBacksOff(t *testing.T) {
+	f := NewForwarder(nil, "", nil)
+	device := &failingDevice{err: errors.New("temporary"), failures: 4}
+	if err := f.Serve(device); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Serve returned %v, want %v", err, os.ErrClosed)
+	}
+	// 10, 20, 40 and 80ms
+	for i := 1; i < len(device.reads); i++ {
+		want := READ_RETRY_MIN << (i - 1)
+		if wait := device.reads[i].Sub(device.reads[i-1]); wait < want {
+			t.Errorf("read %d retried after %s, want %s at least", i, wait, want)
+		}
+	}
+
+	device = &failingDevice{err: io.EOF, failures: 100}
+	if err := f.Serve(device); err != io.EOF || len(device.reads) != 1 {
+		t.Fatalf("Serve returned %v after %d reads, want %v at once", err, len(device.reads), io.EOF)
+	}
+}
+
+func TestWriteErrorRemovesSession(t *testing.T) {
+	f := NewForwarder(nil, "", nil)
+	local, _ := sessionPair(t, CapFraming)
+	f.sessions["a"] = local
+	f.writeFrame("a", local, FrameTypePacket, make([]byte, FRAME_MAX_PAYLOAD+1))
+	if _, ok := f.sessions["a"]; !ok {
+		t.Fatal("session removed by an oversized frame")
+	}
+	// any failure rather than the reset only
+	local.CloseWrite()
+	f.writeFrame("a", local, FrameTypePacket, []byte{0x45})
+	if _, ok := f.sessions["a"]; ok {
+		t.Fatal("session kept after the write failed")
+	}
+	select {
+	case <-local.Done():
+	default:
+		t.Error("failed session not closed")
+	}
+}
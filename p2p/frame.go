@@ -0,0 +1,124 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+type FrameType uint8
+
+const (
+	FrameTypePacket FrameType = iota
+	// the packet compressed by zstd, only sent if compression negotiated
+	FrameTypeCompressed
+	// sent periodically without payload, only sent if keepalive negotiated
+	FrameTypeKeepalive
+	// the Ethernet frame of the TAP mode, only sent if tap negotiated
+	FrameTypeEthernet
+)
+
+const (
+	// the largest payload fits in the 16 bits length along with the type byte
+	FRAME_MAX_PAYLOAD = math.MaxUint16 - 1
+	// the largest MTU fits in a frame, leaves room for the Ethernet header and a VLAN tag of the TAP mode
+	MAX_MTU = FRAME_MAX_PAYLOAD - ETHERNET_HEADER - 4
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes [length][type][payload] if framing negotiated, otherwise the legacy [length][payload]
+func (s *Session) WriteFrame(typ FrameType, payload []byte) error {
+	// checked before compression since the peer refuses to decompress beyond the limit either
+	if len(payload) > FRAME_MAX_PAYLOAD {
+		return ErrFrameTooLarge
+	}
+	s.wm.Lock()
+	defer s.wm.Unlock()
+	size, compressed := len(payload), false
+	if typ == FrameTypePacket && s.compression() {
+		if buff := s.compressor.compress(payload); buff != nil {
+			typ, payload, compressed = FrameTypeCompressed, buff, true
+		}
+	}
+	var frame []byte
+	if s.Has(CapFraming) {
+		frame = make([]byte, 3, 3+len(payload))
+		binary.LittleEndian.PutUint16(frame, uint16(len(payload)+1))
+		frame[2] = byte(typ)
+	} else {
+		if typ != FrameTypePacket {
+			// the legacy peer only understands packets
+			return nil
+		}
+		frame = make([]byte, 2, 2+len(payload))
+		binary.LittleEndian.PutUint16(frame, uint16(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := s.Write(frame)
+	if err == nil && (typ == FrameTypePacket || typ == FrameTypeCompressed || typ == FrameTypeEthernet) {
+		s.stats.sent(size, len(payload), compressed, !compressed && s.compression())
+	}
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame
+func (s *Session) ReadFrame() (FrameType, []byte, error) {
+	var size uint16
+	if err := binary.Read(s, binary.LittleEndian, &size); err != nil {
+		return 0, nil, err
+	}
+	buff := make([]byte, size)
+	if _, err := io.ReadFull(s, buff); err != nil {
+		return 0, nil, err
+	}
+	atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+	if !s.Has(CapFraming) {
+		s.stats.received(len(buff), len(buff), false)
+		return FrameTypePacket, buff, nil
+	}
+	if len(buff) == 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	typ, payload := FrameType(buff[0]), buff[1:]
+	switch typ {
+	case FrameTypeCompressed:
+		packet, err := decompress(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		s.stats.received(len(packet), len(payload), true)
+		return FrameTypePacket, packet, nil
+	case FrameTypePacket, FrameTypeEthernet:
+		s.stats.received(len(payload), len(payload), false)
+	}
+	return typ, payload, nil
+}
+
+// Idle returns the time since the last frame read
+func (s *Session) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRead)))
+}
+
+// the compressed frames need the type byte
+func (s *Session) compression() bool {
+	return s.Has(CapFraming) && s.Has(CapCompression)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// two ends of a session over linked hosts negotiated with capabilities
+func sessionPair(t *testing.T, capabilities ...string) (*Session, *Session) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mn := mocknet.New(ctx)
+	local, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *Session, 1)
+	remote.SetStreamHandler(protocol.ID(PROTOCOL_ID), func(stream network.Stream) {
+		accepted <- newSession(stream, PROTOCOL_VERSION, capabilities, 0)
+	})
+	stream, err := local.NewStream(ctx, remote.ID(), protocol.ID(PROTOCOL_ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := newSession(stream, PROTOCOL_VERSION, capabilities, 0)
+	t.Cleanup(func() { session.Reset() })
+	// the protocol is negotiated lazily, so the handler runs only once written
+	go session.Write(nil)
+	select {
+	case peer := <-accepted:
+		t.Cleanup(func() { peer.Reset() })
+		return session, peer
+	case <-ctx.Done():
+	}
+	return session, nil
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte{1}, FRAME_MAX_PAYLOAD)
+	cases := []struct {
+		name         string
+		capabilities []string
+		typ          FrameType
+		payload      []byte
+	}{
+		{name: "legacy", payload: []byte{0x45, 1, 2, 3}},
+		{name: "packet", capabilities: []string{CapFraming}, typ: FrameTypePacket, payload: []byte{0x45, 1, 2, 3}},
+		{name: "keepalive", capabilities: []string{CapFraming}, typ: FrameTypeKeepalive, payload: []byte{}},
+		{name: "largest", capabilities: []string{CapFraming}, typ: FrameTypeEthernet, payload: make([]byte, FRAME_MAX_PAYLOAD)},
+		{name: "largest legacy", payload: make([]byte, FRAME_MAX_PAYLOAD)},
+		{name: "largest compressed", capabilities: []string{CapFraming, CapCompression}, typ: FrameTypePacket, payload: compressible},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			local, remote := sessionPair(t, c.capabilities...)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- local.WriteFrame(c.typ, c.payload)
+			}()
+			typ, payload, err := remote.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			if typ != c.typ || !bytes.Equal(payload, c.payload) {
+				t.Fatalf("read frame type %d of %d bytes, want type %d of %d bytes", typ, len(payload), c.typ, len(c.payload))
+			}
+		})
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	for _, capabilities := range [][]string{nil, {CapFraming}, {CapFraming, CapCompression}} {
+		local, _ := sessionPair(t, capabilities...)
+		// compressed well below the limit, but the peer can't decompress it
+		payload := make([]byte, FRAME_MAX_PAYLOAD+1)
+		if err := local.WriteFrame(FrameTypePacket, payload); err != ErrFrameTooLarge {
+			t.Errorf("wrote %d bytes frame with %v: %v", len(payload), capabilities, err)
+		}
+	}
+}
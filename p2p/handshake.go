@@ -0,0 +1,274 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/liloew/gvn/internal/strslice"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the protocol IDs never change, the version is negotiated by handshake
+	PROTOCOL_ID     = "/gvn/data"
+	RPC_PROTOCOL_ID = "/gvn/rpc"
+	// version 1 is the legacy /gvn/<version> protocol without handshake
+	PROTOCOL_VERSION     = 2
+	MIN_PROTOCOL_VERSION = 1
+	HANDSHAKE_TIMEOUT    = 10 * time.Second
+	// retry the incompatible peer after
+	INCOMPATIBLE_BACKOFF = time.Minute
+)
+
+const (
+	// the frames carry a type byte after the length
+	CapFraming     = "framing"
+	CapCompression = "compression"
+	CapKeepalive   = "keepalive"
+	// the Ethernet frames are exchanged by the networks in TAP mode
+	CapTap = "tap"
+)
+
+var (
+	// the capabilities supported by default
+	Capabilities = []string{CapFraming, CapKeepalive}
+)
+
+// Hello is exchanged by both sides once the stream opened
+type Hello struct {
+	Version      uint16   `json:"version"`
+	MinVersion   uint16   `json:"minVersion"`
+	Capabilities []string `json:"capabilities"`
+	Mtu          int      `json:"mtu,omitempty"`
+	Network      string   `json:"network,omitempty"`
+	// the multicast groups flooded to self
+	Groups []string `json:"groups,omitempty"`
+}
+
+// IncompatibleError reports the peer speaks no protocol version in common
+type IncompatibleError struct {
+	Peer   peer.ID
+	Local  Hello
+	Remote Hello
+}
+
+func (e IncompatibleError) Error() string {
+	return fmt.Sprintf("peer %s speaks protocol version %d-%d but %d-%d required, upgrade the older one",
+		e.Peer.Pretty(), e.Remote.MinVersion, e.Remote.Version, e.Local.MinVersion, e.Local.Version)
+}
+
+// NetworkError reports the peer is of another gvn network
+type NetworkError struct {
+	Peer   peer.ID
+	Local  string
+	Remote string
+}
+
+func (e NetworkError) Error() string {
+	return fmt.Sprintf("peer %s is of network %q rather than %q", e.Peer.Pretty(), e.Remote, e.Local)
+}
+
+// Session is a data stream with the negotiated version and capabilities
+type Session struct {
+	network.Stream
+	Version      uint16
+	Capabilities []string
+	// the path MTU agreed by both sides, 0 if unknown
+	Mtu int
+	// the multicast groups selected by the peer
+	Groups     []string
+	stats      *Stats
+	compressor compressor
+	// unix nano of the last frame read
+	lastRead int64
+	done     chan struct{}
+	once     sync.Once
+	wm       sync.Mutex
+}
+
+func (s *Session) Has(capability string) bool {
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Handshake exchanges the local Hello on the stream and negotiates the session
+func Handshake(stream network.Stream, local Hello) (*Session, error) {
+	if stream.Protocol() != protocol.ID(PROTOCOL_ID) {
+		if local.Network != "" {
+			return nil, NetworkError{Peer: stream.Conn().RemotePeer(), Local: local.Network}
+		}
+		legacy := Hello{Version: 1, MinVersion: 1}
+		if local.MinVersion > legacy.Version {
+			return nil, IncompatibleError{Peer: stream.Conn().RemotePeer(), Local: local, Remote: legacy}
+		}
+		// the legacy protocol has neither handshake nor capabilities
+		return newSession(stream, legacy.Version, nil, local.Mtu), nil
+	}
+	stream.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer stream.SetDeadline(time.Time{})
+	// both sides write first, so the write can't block the read on the unbuffered streams
+	written := make(chan error, 1)
+	go func() {
+		written <- writeHello(stream, local)
+	}()
+	remote, err := readHello(stream)
+	if err != nil {
+		return nil, err
+	}
+	if err := <-written; err != nil {
+		return nil, err
+	}
+	if remote.Network != local.Network {
+		return nil, NetworkError{Peer: stream.Conn().RemotePeer(), Local: local.Network, Remote: remote.Network}
+	}
+	version := local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if version < local.MinVersion || version < remote.MinVersion {
+		return nil, IncompatibleError{Peer: stream.Conn().RemotePeer(), Local: local, Remote: remote}
+	}
+	capabilities := make([]string, 0)
+	for _, c := range remote.Capabilities {
+		if strslice.Contains(local.Capabilities, c) {
+			capabilities = append(capabilities, c)
+		}
+	}
+	session := newSession(stream, version, capabilities, minMtu(local.Mtu, remote.Mtu))
+	session.Groups = remote.Groups
+	logrus.WithFields(logrus.Fields{
+		"Peer":         stream.Conn().RemotePeer().Pretty(),
+		"Version":      session.Version,
+		"Capabilities": session.Capabilities,
+		"MTU":          session.Mtu,
+	}).Info("Negotiated session")
+	return session, nil
+}
+
+func writeHello(stream network.Stream, hello Hello) error {
+	buff, _ := json.Marshal(hello)
+	frame := make([]byte, 2+len(buff))
+	binary.LittleEndian.PutUint16(frame, uint16(len(buff)))
+	copy(frame[2:], buff)
+	_, err := stream.Write(frame)
+	return err
+}
+
+func readHello(stream network.Stream) (Hello, error) {
+	var hello Hello
+	var size uint16
+	if err := binary.Read(stream, binary.LittleEndian, &size); err != nil {
+		return hello, err
+	}
+	buff := make([]byte, size)
+	if _, err := io.ReadFull(stream, buff); err != nil {
+		return hello, err
+	}
+	err := json.Unmarshal(buff, &hello)
+	return hello, err
+}
+
+func newSession(stream network.Stream, version uint16, capabilities []string, mtu int) *Session {
+	session := &Session{Stream: stream, Version: version, Capabilities: capabilities, Mtu: mtu, lastRead: time.Now().UnixNano(), done: make(chan struct{})}
+	// counted by the session only unless attached to the peers of a network
+	session.stats = &Stats{Peer: stream.Conn().RemotePeer().Pretty(), Compression: session.compression()}
+	return session
+}
+
+// Close closes the stream and stops the keepalives
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return s.Stream.Close()
+}
+
+// Reset resets the stream and stops the keepalives
+func (s *Session) Reset() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return s.Stream.Reset()
+}
+
+// Done is closed once the session closed or reset
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// NewSession opens a stream to the peer, the legacy protocol is used if the peer doesn't support handshake
+func NewSession(host host.Host, legacy string, peerId string, local Hello) (*Session, error) {
+	id, err := peer.Decode(peerId)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HANDSHAKE_TIMEOUT)
+	defer cancel()
+	stream, err := host.NewStream(ctx, id, protocol.ID(PROTOCOL_ID), protocol.ID(legacy))
+	if err != nil {
+		return nil, err
+	}
+	session, err := Handshake(stream, local)
+	if err != nil {
+		stream.Reset()
+		if _, ok := err.(IncompatibleError); ok || stream.Protocol() != protocol.ID(PROTOCOL_ID) {
+			return nil, err
+		}
+		if _, ok := err.(NetworkError); ok {
+			return nil, err
+		}
+		// the peerstore may be stale after the peer downgraded, try the legacy protocol only
+		if stream, err = host.NewStream(ctx, id, protocol.ID(legacy)); err != nil {
+			return nil, err
+		}
+		return Handshake(stream, local)
+	}
+	return session, nil
+}
+
+// closeRejected closes the stream of the peer rejected by handshake, the stream is closed rather than reset so that
+// the peer reads the hello and learns the reason itself
+func closeRejected(stream network.Stream, err error) {
+	switch err.(type) {
+	case IncompatibleError, NetworkError:
+		stream.Close()
+	default:
+		stream.Reset()
+	}
+}
+
+// the smaller one of the known MTUs
+func minMtu(left, right int) int {
+	if left <= 0 || (right > 0 && right < left) {
+		return right
+	}
+	return left
+}
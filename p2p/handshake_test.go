@@ -0,0 +1,108 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+const LEGACY_ZONE = "/gvn/legacy"
+
+// two linked hosts, the remote one negotiates with hello on PROTOCOL_ID or serves the legacy protocol only if nil
+func handshakePeers(t *testing.T, hello *Hello) (host.Host, host.Host) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mn := mocknet.New(ctx)
+	local, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	// the same as Forwarder.HandleStream
+	handler := func(stream network.Stream) {
+		if _, err := Handshake(stream, *hello); err != nil {
+			closeRejected(stream, err)
+		}
+	}
+	if hello == nil {
+		handler = func(stream network.Stream) {}
+	} else {
+		remote.SetStreamHandler(protocol.ID(PROTOCOL_ID), handler)
+	}
+	remote.SetStreamHandler(protocol.ID(LEGACY_ZONE), handler)
+	return local, remote
+}
+
+func TestNegotiation(t *testing.T) {
+	local := Hello{Version: PROTOCOL_VERSION, MinVersion: MIN_PROTOCOL_VERSION, Capabilities: []string{CapFraming, CapKeepalive, CapCompression}, Mtu: 1400}
+	cases := []struct {
+		name         string
+		remote       *Hello
+		version      uint16
+		capabilities []string
+		mtu          int
+		incompatible bool
+	}{
+		{name: "same", remote: &local, version: PROTOCOL_VERSION, capabilities: local.Capabilities, mtu: 1400},
+		{name: "common capabilities", remote: &Hello{Version: PROTOCOL_VERSION, MinVersion: 1, Capabilities: []string{CapKeepalive, CapTap}, Mtu: 1300}, version: PROTOCOL_VERSION, capabilities: []string{CapKeepalive}, mtu: 1300},
+		{name: "disjoint capabilities", remote: &Hello{Version: PROTOCOL_VERSION, MinVersion: 1, Capabilities: []string{CapTap}}, version: PROTOCOL_VERSION, capabilities: []string{}, mtu: 1400},
+		{name: "newer peer", remote: &Hello{Version: PROTOCOL_VERSION + 1, MinVersion: 1, Capabilities: []string{CapFraming}}, version: PROTOCOL_VERSION, capabilities: []string{CapFraming}, mtu: 1400},
+		{name: "legacy peer without handshake", version: 1, mtu: 1400},
+		{name: "too new peer", remote: &Hello{Version: PROTOCOL_VERSION + 2, MinVersion: PROTOCOL_VERSION + 1}, incompatible: true},
+	}
+	// the legacy peer is refused once version 1 dropped
+	a, b := handshakePeers(t, nil)
+	if _, err := NewSession(a, LEGACY_ZONE, b.ID().Pretty(), Hello{Version: PROTOCOL_VERSION, MinVersion: 2}); err == nil {
+		t.Error("negotiated with legacy peer below the min version")
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := handshakePeers(t, c.remote)
+			session, err := NewSession(a, LEGACY_ZONE, b.ID().Pretty(), local)
+			if c.incompatible {
+				if _, ok := err.(IncompatibleError); !ok {
+					t.Fatalf("negotiated with incompatible peer: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			if session.Version != c.version || session.Mtu != c.mtu || len(session.Capabilities) != len(c.capabilities) {
+				t.Fatalf("unexpected session version %d, MTU %d, capabilities %v", session.Version, session.Mtu, session.Capabilities)
+			}
+			for _, capability := range c.capabilities {
+				if !session.Has(capability) {
+					t.Errorf("capability %s not negotiated in %v", capability, session.Capabilities)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/liloew/gvn/route"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HEALTH_INTERVAL = 2 * time.Second
+	HEALTH_TIMEOUT  = time.Second
+	// the peer is down after failed in a row
+	HEALTH_FAILURES = 2
+)
+
+// HealthChecker pings the peers advertise the same subnets and switches the routes once they fail or recover
+type HealthChecker struct {
+	host   host.Host
+	routes *route.RouteTable
+	// the peers are pinged every Interval and fail after Timeout
+	Interval time.Duration
+	Timeout  time.Duration
+	// peer id -> the failures in a row
+	failures map[string]int
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func NewHealthChecker(host host.Host, routes *route.RouteTable) *HealthChecker {
+	return &HealthChecker{
+		host:     host,
+		routes:   routes,
+		Interval: HEALTH_INTERVAL,
+		Timeout:  HEALTH_TIMEOUT,
+		failures: make(map[string]int),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start checks the peers in background until stopped
+func (h *HealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.check()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *HealthChecker) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+}
+
+// ping all the redundant peers at once and mark the ones failed HEALTH_FAILURES times down
+func (h *HealthChecker) check() {
+	peers := h.routes.Redundant()
+	failed := make([]bool, len(peers))
+	var wg sync.WaitGroup
+	for i, id := range peers {
+		if id == h.host.ID().Pretty() {
+			continue
+		}
+		pid, err := peer.Decode(id)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pid peer.ID) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+			defer cancel()
+			result, ok := <-ping.Ping(ctx, h.host, pid)
+			failed[i] = !ok || result.Error != nil
+		}(i, pid)
+	}
+	wg.Wait()
+
+	checked := make(map[string]bool, len(peers))
+	for i, id := range peers {
+		checked[id] = true
+		if failed[i] {
+			h.failures[id]++
+			logrus.WithFields(logrus.Fields{
+				"Peer":     id,
+				"Failures": h.failures[id],
+			}).Debug("Health check failed")
+		} else {
+			h.failures[id] = 0
+		}
+		h.routes.SetDown(id, h.failures[id] >= HEALTH_FAILURES)
+	}
+	// the peers no longer redundant are not checked anymore
+	for id := range h.failures {
+		if !checked[id] {
+			delete(h.failures, id)
+			h.routes.SetDown(id, false)
+		}
+	}
+}
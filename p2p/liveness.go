@@ -0,0 +1,87 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/eventbus"
+	"github.com/liloew/gvn/route"
+	"github.com/sirupsen/logrus"
+)
+
+// Liveness follows the connections of the peers and publishes ONLINE_TOPIC or OFFLINE_TOPIC once they changed, the
+// peers timed out by keepalive are disconnected by the forwarder and go offline as well
+type Liveness struct {
+	host  host.Host
+	bus   *eventbus.EventBus
+	peers *Peers
+	// peer id -> online
+	online map[string]bool
+	// serializes the events so that the last one published is the current state
+	mu sync.Mutex
+}
+
+// NewLiveness marks the peers online or offline in peers as well
+func NewLiveness(host host.Host, bus *eventbus.EventBus, peers *Peers) *Liveness {
+	l := &Liveness{host: host, bus: bus, peers: peers, online: make(map[string]bool)}
+	host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			l.update(conn.RemotePeer())
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			l.update(conn.RemotePeer())
+		},
+	})
+	return l
+}
+
+// the peer is online as long as any connection to it is left
+func (l *Liveness) update(id peer.ID) {
+	online := l.host.Network().Connectedness(id) == network.Connected
+	peerId := id.Pretty()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, ok := l.online[peerId]; ok && current == online {
+		return
+	}
+	l.online[peerId] = online
+	l.peers.SetOnline(peerId, online)
+	topic := route.OFFLINE_TOPIC
+	if online {
+		topic = route.ONLINE_TOPIC
+	}
+	logrus.WithFields(logrus.Fields{
+		"Peer":  peerId,
+		"Topic": topic,
+	}).Info("Peer liveness changed")
+	if err := l.bus.Publish(topic, peerId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+			"Peer":  peerId,
+		}).Error("Publish liveness error")
+	}
+}
+
+// Online reports whether the peer is connected, false if never seen
+func (l *Liveness) Online(peerId string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.online[peerId]
+}
@@ -0,0 +1,285 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/liloew/gvn/route"
+	"github.com/miekg/dns"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	MDNS_GROUP = "224.0.0.251:5353"
+	// the peers are queried every
+	MDNS_INTERVAL = 10 * time.Second
+	// seconds the addresses announced are valid
+	MDNS_TTL     = 120
+	MDNS_DNSADDR = "dnsaddr="
+)
+
+// MDNS discovers the peers of the same gvn network on the LAN, and connects to them via the LAN addresses so that
+// the packets between them never leave the LAN
+type MDNS struct {
+	host   host.Host
+	routes *route.RouteTable
+	// _gvn-<network hash>._udp.local.
+	service  string
+	Interval time.Duration
+	conn     *net.UDPConn
+	// the multicast loopback is disabled on conn, so the messages are sent from sender to reach the peers on the
+	// same host as well
+	sender *net.UDPConn
+	group  *net.UDPAddr
+	// the peers being connected
+	connecting map[peer.ID]bool
+	mu         sync.Mutex
+	stop       chan struct{}
+	once       sync.Once
+}
+
+// NewMDNS discovers the peers of network only, the peers are connected if the routes via them are known, that is they
+// hold the leases of the network
+func NewMDNS(host host.Host, routes *route.RouteTable, network string) *MDNS {
+	return &MDNS{
+		host:       host,
+		routes:     routes,
+		service:    MdnsService(network),
+		Interval:   MDNS_INTERVAL,
+		connecting: make(map[peer.ID]bool),
+		stop:       make(chan struct{}),
+	}
+}
+
+// MdnsService is the service name of the network, the peers of other networks never answer the queries
+func MdnsService(network string) string {
+	sum := sha256.Sum256([]byte(network))
+	return "_gvn-" + hex.EncodeToString(sum[:])[:8] + "._udp.local."
+}
+
+// Start answers and queries the service on the multicast group until closed
+func (m *MDNS) Start() error {
+	group, err := net.ResolveUDPAddr("udp4", MDNS_GROUP)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	m.conn, m.sender, m.group = conn, sender, group
+	go m.serve()
+	go func() {
+		ticker := time.NewTicker(m.Interval)
+		defer ticker.Stop()
+		for {
+			m.query()
+			select {
+			case <-ticker.C:
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	logrus.WithFields(logrus.Fields{
+		"Service": m.service,
+	}).Info("mDNS discovery started")
+	return nil
+}
+
+func (m *MDNS) Close() {
+	m.once.Do(func() {
+		close(m.stop)
+		if m.conn != nil {
+			m.conn.Close()
+			m.sender.Close()
+		}
+	})
+}
+
+func (m *MDNS) query() {
+	msg := new(dns.Msg)
+	msg.SetQuestion(m.service, dns.TypePTR)
+	msg.RecursionDesired = false
+	m.send(msg)
+}
+
+func (m *MDNS) send(msg *dns.Msg) {
+	buff, err := msg.Pack()
+	if err == nil {
+		_, err = m.sender.WriteToUDP(buff, m.group)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+		}).Debug("mDNS send error")
+	}
+}
+
+func (m *MDNS) serve() {
+	buff := make([]byte, 65536)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buff)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buff[:n]); err != nil {
+			continue
+		}
+		if !msg.Response {
+			for _, q := range msg.Question {
+				if q.Name == m.service && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) {
+					m.send(m.response())
+					break
+				}
+			}
+			continue
+		}
+		for _, info := range m.peers(msg, from.IP) {
+			go m.found(info)
+		}
+	}
+}
+
+// the response announces the addresses of the host
+func (m *MDNS) response() *dns.Msg {
+	instance := m.host.ID().Pretty() + "." + m.service
+	txt := make([]string, 0)
+	for _, addr := range m.host.Addrs() {
+		if manet.IsIPLoopback(addr) || manet.IsIPUnspecified(addr) {
+			continue
+		}
+		txt = append(txt, MDNS_DNSADDR+addr.String()+"/p2p/"+m.host.ID().Pretty())
+	}
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Authoritative = true
+	msg.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: m.service, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: MDNS_TTL},
+		Ptr: instance,
+	}}
+	msg.Extra = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: MDNS_TTL},
+		Txt: txt,
+	}}
+	return msg
+}
+
+// the peers announced by the response from ip, only the addresses of ip are kept since it's reachable on the LAN
+func (m *MDNS) peers(msg *dns.Msg, ip net.IP) []peer.AddrInfo {
+	infos := make([]peer.AddrInfo, 0)
+	for _, rr := range append(append([]dns.RR{}, msg.Answer...), msg.Extra...) {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || !strings.HasSuffix(txt.Hdr.Name, "."+m.service) {
+			continue
+		}
+		addrs := make([]ma.Multiaddr, 0)
+		for _, s := range txt.Txt {
+			if !strings.HasPrefix(s, MDNS_DNSADDR) {
+				continue
+			}
+			addr, err := ma.NewMultiaddr(strings.TrimPrefix(s, MDNS_DNSADDR))
+			if err != nil {
+				continue
+			}
+			if addrIP, err := manet.ToIP(addr); err == nil && addrIP.Equal(ip) {
+				addrs = append(addrs, addr)
+			}
+		}
+		if found, err := peer.AddrInfosFromP2pAddrs(addrs...); err == nil {
+			infos = append(infos, found...)
+		}
+	}
+	return infos
+}
+
+// connect to the peer via the LAN addresses unless connected already
+func (m *MDNS) found(info peer.AddrInfo) {
+	if info.ID == m.host.ID() || !m.routes.Known(info.ID.Pretty()) {
+		return
+	}
+	m.mu.Lock()
+	if m.connecting[info.ID] {
+		m.mu.Unlock()
+		return
+	}
+	m.connecting[info.ID] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.connecting, info.ID)
+		m.mu.Unlock()
+	}()
+
+	m.host.Peerstore().AddAddrs(info.ID, info.Addrs, MDNS_TTL*time.Second)
+	conns := m.host.Network().ConnsToPeer(info.ID)
+	for _, conn := range conns {
+		if sameIP(info.Addrs, conn.RemoteMultiaddr()) {
+			return
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"Peer":  info.ID.Pretty(),
+		"Addrs": info.Addrs,
+	}).Info("Peer found on LAN, connect via the LAN addresses")
+	if len(conns) > 0 {
+		// the existing connections are reused otherwise
+		m.host.Network().ClosePeer(info.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HANDSHAKE_TIMEOUT)
+	defer cancel()
+	if err := m.host.Connect(ctx, info); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+			"Peer":  info.ID.Pretty(),
+		}).Error("Connect to peer on LAN error")
+	}
+}
+
+// whether addr is of the same IP as any of addrs, the port differs if the connection is dialed by the peer
+func sameIP(addrs []ma.Multiaddr, addr ma.Multiaddr) bool {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if other, err := manet.ToIP(a); err == nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const PEER_ID = "QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"
+
+func txt(name string, addrs ...string) dns.RR {
+	txt := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		txt = append(txt, MDNS_DNSADDR+addr+"/p2p/"+PEER_ID)
+	}
+	return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: txt}
+}
+
+func TestMdnsPeers(t *testing.T) {
+	if MdnsService("a") == MdnsService("b") {
+		t.Fatal("the networks share the same service")
+	}
+	m := &MDNS{service: MdnsService("a")}
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Extra = []dns.RR{
+		txt(PEER_ID+"."+m.service, "/ip4/192.168.1.7/tcp/6543", "/ip4/1.2.3.4/tcp/6543", "/ip4/192.168.1.7/udp/6543/quic"),
+		// other network
+		txt(PEER_ID+"."+MdnsService("b"), "/ip4/192.168.1.7/tcp/6544"),
+	}
+	// pack and unpack as received
+	buff, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := new(dns.Msg)
+	if err := received.Unpack(buff); err != nil {
+		t.Fatal(err)
+	}
+	infos := m.peers(received, net.ParseIP("192.168.1.7"))
+	if len(infos) != 1 || infos[0].ID.Pretty() != PEER_ID || len(infos[0].Addrs) != 2 {
+		t.Fatalf("unexpected peers %v", infos)
+	}
+	for _, addr := range infos[0].Addrs {
+		if ip, _ := addr.ValueForProtocol(4); ip != "192.168.1.7" {
+			t.Errorf("address %s out of LAN", addr)
+		}
+	}
+}
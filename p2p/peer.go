@@ -16,17 +16,14 @@ limitations under the License.
 package p2p
 
 import (
-	"encoding/binary"
 	"fmt"
-	"net"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
-	"github.com/libp2p/go-libp2p-core/network"
-	"github.com/liloew/gvn/route"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	tcp "github.com/libp2p/go-tcp-transport"
 	"github.com/sirupsen/logrus"
-	"github.com/songgao/water/waterutil"
 )
 
 type MessageType uint
@@ -45,29 +42,34 @@ type Message struct {
 	Id          string      `json:"id"`
 	MessageType MessageType `json:"messageType"`
 	Vip         string      `json:"vip"`
-	Subnets     []string    `json:subnets`
+	Subnets     []string    `json:"subnets"`
 }
 
 var (
-	Streams = make(map[string]network.Stream)
-	VIP     string
+	VIP string
 )
 
 func init() {
 
 }
 
-func NewPeer(priKey string, port uint) (host.Host, error) {
+// NewPeer creates the host listening on port, only the peers holding the same psk are connected if given
+func NewPeer(priKey string, port uint, psk pnet.PSK) (host.Host, error) {
 	pk, err := crypto.UnmarshalPrivateKey([]byte(priKey))
 	if err != nil {
 		return nil, err
 	}
-	host, err := libp2p.New(
+	options := []libp2p.Option{
 		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port)),
 		libp2p.Identity(pk),
 		libp2p.ForceReachabilityPublic(),
-		libp2p.FallbackDefaults,
-	)
+	}
+	if len(psk) > 0 {
+		// QUIC doesn't support the private networks
+		options = append(options, libp2p.PrivateNetwork(psk), libp2p.Transport(tcp.NewTCPTransport))
+	}
+	options = append(options, libp2p.FallbackDefaults)
+	host, err := libp2p.New(options...)
 	if err != nil {
 		return host, err
 	}
@@ -79,38 +81,3 @@ func NewPeer(priKey string, port uint) (host.Host, error) {
 	}).Debug("create Peer successful")
 	return host, nil
 }
-
-func ForwardPacket(host host.Host, zone string, packets []byte, vipNet *net.IPNet) {
-	dst := waterutil.IPv4Destination(packets)
-	if peerId, found, err := route.Route.Get(dst.String()); err == nil && found {
-		if stream, ok := Streams[peerId.(string)]; ok {
-			binary.Write(stream, binary.LittleEndian, uint16(len(packets)))
-			if n, err := stream.Write(packets); n != len(packets) || err != nil {
-				logrus.WithFields(logrus.Fields{
-					"ERROR": err,
-					"SIZE":  n,
-				}).Error("Forward to stream error")
-				if err.Error() == "stream reset" {
-					stream.Close()
-					delete(Streams, peerId.(string))
-				}
-			}
-		} else {
-			// make new stream
-			if s := NewStream(host, zone, peerId.(string)); s != nil {
-				Streams[peerId.(string)] = s
-				ForwardPacket(host, zone, packets, vipNet)
-			} else {
-				logrus.WithFields(logrus.Fields{
-					"ERROR": err,
-				}).Error("Forward to stream error")
-			}
-		}
-	} else {
-		// discard
-		logrus.WithFields(logrus.Fields{
-			"SRC": waterutil.IPv4Source(packets).String(),
-			"DST": dst,
-		}).Error("Discard")
-	}
-}
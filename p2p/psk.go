@@ -0,0 +1,49 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+const (
+	// the header of the swarm key file compatible with IPFS
+	PSK_HEADER = "/key/swarm/psk/1.0.0/\n/base16/\n"
+	PSK_SIZE   = 32
+)
+
+// GeneratePSK returns a new pre-shared key in the swarm key format
+func GeneratePSK() ([]byte, error) {
+	key := make([]byte, PSK_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return []byte(PSK_HEADER + hex.EncodeToString(key) + "\n"), nil
+}
+
+// LoadPSK reads the pre-shared key from the swarm key file
+func LoadPSK(filename string) (pnet.PSK, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return pnet.DecodeV1PSK(file)
+}
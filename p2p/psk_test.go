@@ -0,0 +1,52 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPSK(t *testing.T) {
+	buff, err := GeneratePSK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "swarm.key")
+	if err := os.WriteFile(filename, buff, 0600); err != nil {
+		t.Fatal(err)
+	}
+	psk, err := LoadPSK(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(psk) != PSK_SIZE {
+		t.Errorf("psk size = %d, want %d", len(psk), PSK_SIZE)
+	}
+	other, _ := GeneratePSK()
+	if bytes.Equal(buff, other) {
+		t.Error("psk generated twice are the same")
+	}
+
+	if err := os.WriteFile(filename, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPSK(filename); err == nil {
+		t.Error("invalid psk loaded")
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Stats are the traffic counters of a peer, the bytes are counted before compression and the wire bytes after
+type Stats struct {
+	Peer         string `json:"peer"`
+	TxPackets    uint64 `json:"txPackets"`
+	TxBytes      uint64 `json:"txBytes"`
+	TxWireBytes  uint64 `json:"txWireBytes"`
+	RxPackets    uint64 `json:"rxPackets"`
+	RxBytes      uint64 `json:"rxBytes"`
+	RxWireBytes  uint64 `json:"rxWireBytes"`
+	TxCompressed uint64 `json:"txCompressed"`
+	TxSkipped    uint64 `json:"txSkipped"`
+	RxCompressed uint64 `json:"rxCompressed"`
+	Compression  bool   `json:"compression"`
+	// connected to the peer, updated by Liveness
+	Online bool `json:"online"`
+}
+
+// Peers are the stats and the incompatibility of the peers of one network, the networks in one process never share
+// them
+type Peers struct {
+	// peer id -> stats
+	stats map[string]*Stats
+	// peer -> when the handshake failed because of incompatible versions
+	incompatible map[peer.ID]time.Time
+	mu           sync.Mutex
+}
+
+func NewPeers() *Peers {
+	return &Peers{stats: make(map[string]*Stats), incompatible: make(map[peer.ID]time.Time)}
+}
+
+// TxRatio is the wire bytes per byte sent, 1 if nothing sent
+func (s Stats) TxRatio() float64 {
+	return ratio(s.TxWireBytes, s.TxBytes)
+}
+
+// RxRatio is the wire bytes per byte received, 1 if nothing received
+func (s Stats) RxRatio() float64 {
+	return ratio(s.RxWireBytes, s.RxBytes)
+}
+
+func ratio(wire, raw uint64) float64 {
+	if raw == 0 {
+		return 1
+	}
+	return float64(wire) / float64(raw)
+}
+
+// the stats of the peer, created once first seen
+func (p *Peers) peer(peerId string) *Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.stats[peerId]
+	if !ok {
+		s = &Stats{Peer: peerId}
+		p.stats[peerId] = s
+	}
+	return s
+}
+
+// attach counts the traffic of the session to its peer
+func (p *Peers) attach(session *Session) {
+	s := p.peer(session.Conn().RemotePeer().Pretty())
+	p.mu.Lock()
+	s.Compression = session.compression()
+	p.mu.Unlock()
+	session.stats = s
+}
+
+// SetOnline updates whether the peer is connected
+func (p *Peers) SetOnline(peerId string, online bool) {
+	s := p.peer(peerId)
+	p.mu.Lock()
+	s.Online = online
+	p.mu.Unlock()
+}
+
+// SetIncompatible backs off the sessions with the peer for INCOMPATIBLE_BACKOFF
+func (p *Peers) SetIncompatible(id peer.ID) {
+	p.mu.Lock()
+	p.incompatible[id] = time.Now()
+	p.mu.Unlock()
+}
+
+// Incompatible reports whether the peer failed the handshake within INCOMPATIBLE_BACKOFF
+func (p *Peers) Incompatible(id peer.ID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.incompatible[id]
+	return ok && time.Since(t) < INCOMPATIBLE_BACKOFF
+}
+
+func (s *Stats) sent(raw, wire int, compressed, skipped bool) {
+	atomic.AddUint64(&s.TxPackets, 1)
+	atomic.AddUint64(&s.TxBytes, uint64(raw))
+	atomic.AddUint64(&s.TxWireBytes, uint64(wire))
+	if compressed {
+		atomic.AddUint64(&s.TxCompressed, 1)
+	}
+	if skipped {
+		atomic.AddUint64(&s.TxSkipped, 1)
+	}
+}
+
+func (s *Stats) received(raw, wire int, compressed bool) {
+	atomic.AddUint64(&s.RxPackets, 1)
+	atomic.AddUint64(&s.RxBytes, uint64(raw))
+	atomic.AddUint64(&s.RxWireBytes, uint64(wire))
+	if compressed {
+		atomic.AddUint64(&s.RxCompressed, 1)
+	}
+}
+
+// Stats returns a snapshot of the stats of all peers ever connected
+func (p *Peers) Stats() []Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot := make([]Stats, 0, len(p.stats))
+	for _, s := range p.stats {
+		snapshot = append(snapshot, Stats{
+			Peer:         s.Peer,
+			TxPackets:    atomic.LoadUint64(&s.TxPackets),
+			TxBytes:      atomic.LoadUint64(&s.TxBytes),
+			TxWireBytes:  atomic.LoadUint64(&s.TxWireBytes),
+			RxPackets:    atomic.LoadUint64(&s.RxPackets),
+			RxBytes:      atomic.LoadUint64(&s.RxBytes),
+			RxWireBytes:  atomic.LoadUint64(&s.RxWireBytes),
+			TxCompressed: atomic.LoadUint64(&s.TxCompressed),
+			TxSkipped:    atomic.LoadUint64(&s.TxSkipped),
+			RxCompressed: atomic.LoadUint64(&s.RxCompressed),
+			Compression:  s.Compression,
+			Online:       s.Online,
+		})
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Peer < snapshot[j].Peer
+	})
+	return snapshot
+}
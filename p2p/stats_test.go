@@ -0,0 +1,39 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestPeersIsolation(t *testing.T) {
+	home, office := NewPeers(), NewPeers()
+	id := peer.ID("peer")
+	home.SetIncompatible(id)
+	home.SetOnline(id.Pretty(), true)
+	home.peer(id.Pretty()).sent(100, 50, true, false)
+	if !home.Incompatible(id) || office.Incompatible(id) {
+		t.Error("the incompatibility shared between networks")
+	}
+	if stats := office.Stats(); len(stats) != 0 {
+		t.Errorf("the stats shared between networks %+v", stats)
+	}
+	if stats := home.Stats(); len(stats) != 1 || !stats[0].Online || stats[0].TxBytes != 100 || stats[0].TxWireBytes != 50 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/songgao/packets/ethernet"
+)
+
+const (
+	// the MAC addresses learned are forgotten if no frame received from them in
+	SWITCH_AGING = 5 * time.Minute
+	// the least bytes of an Ethernet frame, both addresses and the ethertype
+	ETHERNET_HEADER = 14
+)
+
+// Switch is the virtual switch of a network in TAP mode, it learns the peers behind the MAC addresses from the
+// frames received, the broadcast, multicast and unknown unicast frames are flooded to all the peers
+type Switch struct {
+	// the entries not refreshed in Aging are removed
+	Aging time.Duration
+	// MAC -> the peer behind it
+	table map[string]macEntry
+	mu    sync.RWMutex
+	stop  chan struct{}
+	once  sync.Once
+}
+
+type macEntry struct {
+	peer string
+	seen time.Time
+}
+
+// SwitchEntry is a MAC address learned by the switch
+type SwitchEntry struct {
+	Mac  string    `json:"mac"`
+	Peer string    `json:"peer"`
+	Seen time.Time `json:"seen"`
+}
+
+func NewSwitch() *Switch {
+	return &Switch{
+		Aging: SWITCH_AGING,
+		table: make(map[string]macEntry),
+		stop:  make(chan struct{}),
+	}
+}
+
+// Start ages out the entries in background until stopped
+func (s *Switch) Start() {
+	go func() {
+		ticker := time.NewTicker(s.Aging / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.age(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Switch) Stop() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Learn records the peer is behind the source of the frame received from it
+func (s *Switch) Learn(frame ethernet.Frame, peerId string) {
+	src := frame.Source()
+	if isGroup(src) {
+		// the group addresses are never the source of valid frames
+		return
+	}
+	s.mu.Lock()
+	s.table[src.String()] = macEntry{peer: peerId, seen: time.Now()}
+	s.mu.Unlock()
+}
+
+// Lookup returns the peer behind the destination of the frame, false if the frame should be flooded
+func (s *Switch) Lookup(frame ethernet.Frame) (string, bool) {
+	dst := frame.Destination()
+	if isGroup(dst) {
+		return "", false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.table[dst.String()]
+	if !ok || time.Since(entry.seen) > s.Aging {
+		return "", false
+	}
+	return entry.peer, true
+}
+
+// Forget removes the addresses behind the peer, the frames to them are flooded until learned again
+func (s *Switch) Forget(peerId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for mac, entry := range s.table {
+		if entry.peer == peerId {
+			delete(s.table, mac)
+		}
+	}
+}
+
+// Entries returns the addresses learned
+func (s *Switch) Entries() []SwitchEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]SwitchEntry, 0, len(s.table))
+	for mac, entry := range s.table {
+		entries = append(entries, SwitchEntry{Mac: mac, Peer: entry.peer, Seen: entry.seen})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Mac < entries[j].Mac
+	})
+	return entries
+}
+
+// remove the entries not refreshed in Aging
+func (s *Switch) age(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for mac, entry := range s.table {
+		if now.Sub(entry.seen) > s.Aging {
+			delete(s.table, mac)
+		}
+	}
+}
+
+// the broadcast address is a group address as well
+func isGroup(mac net.HardwareAddr) bool {
+	return len(mac) == 0 || mac[0]&0x01 != 0
+}
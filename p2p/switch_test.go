@@ -0,0 +1,66 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/songgao/packets/ethernet"
+)
+
+func frame(dst string, src string) ethernet.Frame {
+	d, _ := net.ParseMAC(dst)
+	s, _ := net.ParseMAC(src)
+	var f ethernet.Frame
+	f.Prepare(d, s, ethernet.NotTagged, ethernet.ARP, 28)
+	return f
+}
+
+func TestSwitch(t *testing.T) {
+	s := NewSwitch()
+	s.Learn(frame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:01"), "a")
+	// the group addresses are never learned
+	s.Learn(frame("02:00:00:00:00:01", "01:00:5e:00:00:01"), "b")
+	if peer, ok := s.Lookup(frame("02:00:00:00:00:01", "02:00:00:00:00:02")); !ok || peer != "a" {
+		t.Fatalf("learned address switched to %q", peer)
+	}
+	for _, dst := range []string{"ff:ff:ff:ff:ff:ff", "01:00:5e:00:00:01", "33:33:00:00:00:01", "02:00:00:00:00:09"} {
+		if peer, ok := s.Lookup(frame(dst, "02:00:00:00:00:02")); ok {
+			t.Errorf("%s switched to %q rather than flooded", dst, peer)
+		}
+	}
+	if entries := s.Entries(); len(entries) != 1 || entries[0].Mac != "02:00:00:00:00:01" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	// the address moved to another peer
+	s.Learn(frame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:01"), "b")
+	if peer, _ := s.Lookup(frame("02:00:00:00:00:01", "02:00:00:00:00:02")); peer != "b" {
+		t.Fatalf("moved address switched to %q", peer)
+	}
+	s.Forget("b")
+	if _, ok := s.Lookup(frame("02:00:00:00:00:01", "02:00:00:00:00:02")); ok {
+		t.Fatal("address of the peer forgotten still switched")
+	}
+
+	s.Learn(frame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:01"), "a")
+	s.age(time.Now().Add(s.Aging + time.Second))
+	if len(s.Entries()) != 0 {
+		t.Fatal("address not aged out")
+	}
+}
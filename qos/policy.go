@@ -0,0 +1,160 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qos
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// the priorities range from 0 (highest) to MAX_PRIORITY
+	MAX_PRIORITY = 7
+	// the priority of packets matched no class
+	DEFAULT_PRIORITY = 4
+	// the burst defaults to the bytes sent in 1/BURST_DIVISOR second
+	BURST_DIVISOR = 4
+	MIN_BURST     = 16 * 1024
+
+	protocolTCP = 6
+	protocolUDP = 17
+)
+
+// Policy is configured on server and pushed to all the nodes
+type Policy struct {
+	Limits  []Limit `yaml:"limits,omitempty" json:"limits,omitempty"`
+	Classes []Class `yaml:"classes,omitempty" json:"classes,omitempty"`
+}
+
+// Limit is a token bucket applied to the traffic of a peer or from/to a subnet
+type Limit struct {
+	// the traffic sent by the peer and sent to the peer
+	Peer string `yaml:"peer,omitempty" json:"peer,omitempty"`
+	// the traffic from or to the subnet
+	Subnet string `yaml:"subnet,omitempty" json:"subnet,omitempty"`
+	// kbit per second
+	Rate uint64 `yaml:"rate" json:"rate"`
+	// bytes, defaults to 1/4 second of rate
+	Burst uint64 `yaml:"burst,omitempty" json:"burst,omitempty"`
+}
+
+// Class assigns the priority to packets matched the DSCP or ports
+type Class struct {
+	Name     string `yaml:"name" json:"name"`
+	Priority int    `yaml:"priority" json:"priority"`
+	Dscp     []int  `yaml:"dscp,omitempty" json:"dscp,omitempty"`
+	// the source or destination ports of TCP and UDP
+	Ports []int `yaml:"ports,omitempty" json:"ports,omitempty"`
+}
+
+func (p Policy) Empty() bool {
+	return len(p.Limits) == 0 && len(p.Classes) == 0
+}
+
+// FieldError is an invalid field of the policy
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Validate returns the FieldErrors of the policy
+func (p Policy) Validate() []error {
+	errs := make([]error, 0)
+	for i, l := range p.Limits {
+		field := fmt.Sprintf("qos.limits[%d]", i)
+		if (l.Peer == "") == (l.Subnet == "") {
+			errs = append(errs, FieldError{Field: field, Message: "exactly one of peer and subnet is required"})
+		}
+		if l.Peer != "" {
+			if _, err := peer.Decode(l.Peer); err != nil {
+				errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("invalid peer id %q", l.Peer)})
+			}
+		}
+		if l.Subnet != "" {
+			if _, _, err := net.ParseCIDR(l.Subnet); err != nil {
+				errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("invalid subnet %q", l.Subnet)})
+			}
+		}
+		if l.Rate == 0 {
+			errs = append(errs, FieldError{Field: field, Message: "rate must be greater than 0 kbit/s"})
+		}
+	}
+	for i, c := range p.Classes {
+		field := fmt.Sprintf("qos.classes[%d]", i)
+		if c.Priority < 0 || c.Priority > MAX_PRIORITY {
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("priority %d out of range 0-%d", c.Priority, MAX_PRIORITY)})
+		}
+		for _, dscp := range c.Dscp {
+			if dscp < 0 || dscp > 63 {
+				errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("invalid DSCP %d", dscp)})
+			}
+		}
+		for _, port := range c.Ports {
+			if port <= 0 || port > 65535 {
+				errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("invalid port %d", port)})
+			}
+		}
+	}
+	return errs
+}
+
+// burst in bytes
+func (l Limit) burst() uint64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	burst := l.Rate * 1000 / 8 / BURST_DIVISOR
+	if burst < MIN_BURST {
+		burst = MIN_BURST
+	}
+	return burst
+}
+
+// priority of the IPv4 packet, the first matched class wins
+func (p Policy) priority(packet []byte) int {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return DEFAULT_PRIORITY
+	}
+	dscp := int(packet[1] >> 2)
+	src, dst := -1, -1
+	ihl := int(packet[0]&0x0f) * 4
+	// the ports are only available in the first fragment
+	first := binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0
+	if (packet[9] == protocolTCP || packet[9] == protocolUDP) && first && len(packet) >= ihl+4 {
+		src = int(binary.BigEndian.Uint16(packet[ihl:]))
+		dst = int(binary.BigEndian.Uint16(packet[ihl+2:]))
+	}
+	for _, c := range p.Classes {
+		for _, v := range c.Dscp {
+			if v == dscp {
+				return c.Priority
+			}
+		}
+		for _, port := range c.Ports {
+			if port == src || port == dst {
+				return c.Priority
+			}
+		}
+	}
+	return DEFAULT_PRIORITY
+}
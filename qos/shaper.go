@@ -0,0 +1,321 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qos
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/liloew/gvn/eventbus"
+	"github.com/liloew/gvn/route"
+	"github.com/sirupsen/logrus"
+	"github.com/songgao/water/waterutil"
+)
+
+const (
+	// packets queued per priority
+	QUEUE_SIZE = 512
+)
+
+var (
+	// the data is the Policy pushed by server
+	POLICY_TOPIC = eventbus.NewTopic("POLICY", Policy{})
+)
+
+// Stats are the counters of the shaper
+type Stats struct {
+	// dropped because larger than the burst of a matched limit, so never allowed
+	Dropped uint64 `json:"dropped"`
+	// dropped because the queue is full
+	Overflowed uint64 `json:"overflowed"`
+	Queued     int    `json:"queued"`
+}
+
+// Shaper delays the packets exceeded the rate limits in bounded queues and sends them in order of priority
+type Shaper struct {
+	// finds the peer owns the destination
+	routes   *route.RouteTable
+	self     string
+	send     func([]byte)
+	policy   Policy
+	limiters []*limiter
+	queues   [MAX_PRIORITY + 1][]queued
+	stats    Stats
+	stopped  bool
+	mu       sync.Mutex
+	// signaled once a packet queued
+	wake chan struct{}
+	done chan struct{}
+}
+
+type limiter struct {
+	Limit
+	network *net.IPNet
+	// bytes per second
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// queued is a packet waiting for the tokens of the matched limiters
+type queued struct {
+	packet   []byte
+	limiters []*limiter
+}
+
+// NewShaper finds the peers owning the destinations by routes and applies the policies published to bus
+func NewShaper(routes *route.RouteTable, bus *eventbus.EventBus) *Shaper {
+	s := &Shaper{routes: routes, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	// only the latest policy matters
+	events := bus.Subscribe(1, eventbus.DropOldest, POLICY_TOPIC)
+	go func() {
+		for data := range events.C {
+			s.Apply(data.Data.(Policy))
+		}
+	}()
+	return s
+}
+
+// Start sends the queued packets by send in background, self is the local peer id
+func (s *Shaper) Start(self string, send func([]byte)) {
+	s.mu.Lock()
+	s.self = self
+	s.send = send
+	s.mu.Unlock()
+	go s.run()
+}
+
+// Apply replaces the policy, the buckets of the unchanged limits are kept
+func (s *Shaper) Apply(policy Policy) {
+	if errs := policy.Validate(); len(errs) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"ERRORS": errs,
+		}).Error("Ignore the invalid QoS policy")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reflect.DeepEqual(s.policy, policy) {
+		return
+	}
+	limiters := make([]*limiter, 0, len(policy.Limits))
+	for _, l := range policy.Limits {
+		if old := s.find(l); old != nil {
+			limiters = append(limiters, old)
+			continue
+		}
+		limiter := &limiter{
+			Limit:  l,
+			rate:   float64(l.Rate) * 1000 / 8,
+			burst:  float64(l.burst()),
+			tokens: float64(l.burst()),
+			last:   time.Now(),
+		}
+		if l.Subnet != "" {
+			_, limiter.network, _ = net.ParseCIDR(l.Subnet)
+		}
+		limiters = append(limiters, limiter)
+	}
+	s.policy = policy
+	s.limiters = limiters
+	logrus.WithFields(logrus.Fields{
+		"Limits":  policy.Limits,
+		"Classes": policy.Classes,
+	}).Info("Apply QoS policy")
+}
+
+// Send queues the packet by priority until the rate limits allow it, it's sent directly if no policy applied
+func (s *Shaper) Send(packet []byte) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	if s.policy.Empty() {
+		s.mu.Unlock()
+		s.send(packet)
+		return
+	}
+	defer s.mu.Unlock()
+	limiters, ok := s.match(packet)
+	if !ok {
+		s.stats.Dropped++
+		return
+	}
+	priority := s.policy.priority(packet)
+	if len(s.queues[priority]) >= QUEUE_SIZE {
+		s.stats.Overflowed++
+		return
+	}
+	s.queues[priority] = append(s.queues[priority], queued{packet: packet, limiters: limiters})
+	s.stats.Queued++
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Shaper) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Stop discards the queued packets and stops sending, the packets sent afterwards are dropped
+func (s *Shaper) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	s.queues = [MAX_PRIORITY + 1][]queued{}
+	s.stats.Queued = 0
+	close(s.done)
+}
+
+func (s *Shaper) run() {
+	for {
+		s.mu.Lock()
+		packet, wait := s.next(time.Now())
+		s.mu.Unlock()
+		if packet != nil {
+			s.send(packet)
+			continue
+		}
+		var timer *time.Timer
+		var refilled <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			refilled = timer.C
+		}
+		select {
+		case <-s.wake:
+		case <-refilled:
+		case <-s.done:
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// next dequeues the first packet in order of priority allowed by its limiters, otherwise returns the time until
+// one is allowed, 0 if nothing queued. The packets behind a delayed one sharing a limiter stay in order, so a lower
+// priority never takes the tokens waited by a higher one. Should be called with mu locked
+func (s *Shaper) next(now time.Time) ([]byte, time.Duration) {
+	var wait time.Duration
+	delayed := make(map[*limiter]bool)
+	for i := range s.queues {
+		for j, q := range s.queues[i] {
+			if d, ok := q.delay(now, delayed); !ok {
+				for _, l := range q.limiters {
+					delayed[l] = true
+				}
+				if d > 0 && (wait == 0 || d < wait) {
+					wait = d
+				}
+				continue
+			}
+			for _, l := range q.limiters {
+				l.tokens -= float64(len(q.packet))
+			}
+			copy(s.queues[i][j:], s.queues[i][j+1:])
+			s.queues[i][len(s.queues[i])-1] = queued{}
+			s.queues[i] = s.queues[i][:len(s.queues[i])-1]
+			s.stats.Queued--
+			return q.packet, 0
+		}
+	}
+	return nil, wait
+}
+
+// delay is the time until all the limiters have tokens for the packet, false if it has to wait. A limiter delayed an
+// earlier packet delays it as well
+func (q queued) delay(now time.Time, delayed map[*limiter]bool) (time.Duration, bool) {
+	var delay time.Duration
+	ok := true
+	for _, l := range q.limiters {
+		l.refill(now)
+		if delayed[l] {
+			ok = false
+		}
+		if lack := float64(len(q.packet)) - l.tokens; lack > 0 {
+			ok = false
+			if d := time.Duration(math.Ceil(lack / l.rate * float64(time.Second))); d > delay {
+				delay = d
+			}
+		}
+	}
+	return delay, ok
+}
+
+// match returns the limiters matched the packet, false if the packet exceeds the burst of any so never allowed,
+// should be called with mu locked
+func (s *Shaper) match(packet []byte) ([]*limiter, bool) {
+	if len(s.limiters) == 0 || !waterutil.IsIPv4(packet) {
+		return nil, true
+	}
+	src, dst := waterutil.IPv4Source(packet), waterutil.IPv4Destination(packet)
+	var dstPeer string
+	matched := make([]*limiter, 0, len(s.limiters))
+	for _, l := range s.limiters {
+		switch {
+		case l.network != nil:
+			if !l.network.Contains(src) && !l.network.Contains(dst) {
+				continue
+			}
+		case l.Peer == s.self:
+		default:
+			if dstPeer == "" {
+				if entry, found := s.routes.Get(dst.String()); found {
+					dstPeer = entry.Peer
+				}
+			}
+			if l.Peer != dstPeer {
+				continue
+			}
+		}
+		if float64(len(packet)) > l.burst {
+			return nil, false
+		}
+		matched = append(matched, l)
+	}
+	return matched, true
+}
+
+func (l *limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// should be called with mu locked
+func (s *Shaper) find(limit Limit) *limiter {
+	for _, l := range s.limiters {
+		if l.Limit == limit {
+			return l
+		}
+	}
+	return nil
+}
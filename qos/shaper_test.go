@@ -0,0 +1,163 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qos
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liloew/gvn/eventbus"
+)
+
+// udp builds an IPv4 UDP packet of size bytes to the port
+func udp(src, dst string, port int, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(size))
+	packet[9] = protocolUDP
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[20:22], 40000)
+	binary.BigEndian.PutUint16(packet[22:24], uint16(port))
+	return packet
+}
+
+// sink collects the packets sent by the shaper
+type sink struct {
+	packets [][]byte
+	mu      sync.Mutex
+}
+
+func (s *sink) send(packet []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets = append(s.packets, packet)
+}
+
+func (s *sink) wait(t *testing.T, n int, timeout time.Duration) [][]byte {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		if len(s.packets) >= n {
+			defer s.mu.Unlock()
+			return s.packets
+		}
+		s.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%d packets not sent in %s", n, timeout)
+	return nil
+}
+
+func TestPriorityOrder(t *testing.T) {
+	shaper := NewShaper(nil, eventbus.New())
+	defer shaper.Stop()
+	shaper.Apply(Policy{Classes: []Class{{Name: "ssh", Priority: 0, Ports: []int{22}}, {Name: "bulk", Priority: MAX_PRIORITY, Ports: []int{873}}}})
+	// queued before started
+	ports := []int{873, 80, 22, 873, 443, 22}
+	for _, port := range ports {
+		shaper.Send(udp("10.0.0.2", "10.0.0.3", port, 100))
+	}
+	if queued := shaper.Stats().Queued; queued != len(ports) {
+		t.Fatalf("queued %d, want %d", queued, len(ports))
+	}
+	var s sink
+	shaper.Start("self", s.send)
+	packets := s.wait(t, len(ports), time.Second)
+	// in order of priority, then in order of sending
+	want := []int{22, 22, 80, 443, 873, 873}
+	for i, packet := range packets {
+		if port := int(binary.BigEndian.Uint16(packet[22:24])); port != want[i] {
+			t.Errorf("packet %d to port %d, want %d", i, port, want[i])
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	shaper := NewShaper(nil, eventbus.New())
+	defer shaper.Stop()
+	// 100 KB/s with 25 KB burst
+	shaper.Apply(Policy{Limits: []Limit{{Subnet: "10.0.1.0/24", Rate: 800}}})
+	var s sink
+	shaper.Start("self", s.send)
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		shaper.Send(udp("10.0.0.2", "10.0.1.3", 80, 1000))
+	}
+	// the other subnet isn't limited
+	shaper.Send(udp("10.0.0.2", "10.0.2.3", 80, 1000))
+	s.wait(t, 61, 3*time.Second)
+	// 35 KB beyond the burst take 350ms
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("sent in %s, want about 350ms", elapsed)
+	}
+	s.mu.Lock()
+	// the unlimited packet isn't delayed behind the limited ones
+	if index := len(s.packets) - 1; s.packets[index][18] == 2 {
+		t.Error("unlimited packet sent last")
+	}
+	s.mu.Unlock()
+	if stats := shaper.Stats(); stats.Dropped != 0 || stats.Overflowed != 0 || stats.Queued != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPriorityUnderLimit(t *testing.T) {
+	shaper := NewShaper(nil, eventbus.New())
+	defer shaper.Stop()
+	shaper.Apply(Policy{
+		Limits:  []Limit{{Subnet: "10.0.1.0/24", Rate: 800, Burst: 1000}},
+		Classes: []Class{{Name: "ssh", Priority: 0, Ports: []int{22}}},
+	})
+	// the second one waits for the tokens after the first one, the smaller one fits the tokens left but mustn't take
+	// them from the higher priority
+	shaper.Send(udp("10.0.0.2", "10.0.1.3", 80, 100))
+	shaper.Send(udp("10.0.0.2", "10.0.1.3", 22, 600))
+	shaper.Send(udp("10.0.0.2", "10.0.1.3", 22, 600))
+	var s sink
+	shaper.Start("self", s.send)
+	packets := s.wait(t, 3, 2*time.Second)
+	for i, want := range []int{22, 22, 80} {
+		if port := int(binary.BigEndian.Uint16(packets[i][22:24])); port != want {
+			t.Errorf("packet %d to port %d, want %d", i, port, want)
+		}
+	}
+}
+
+func TestDrop(t *testing.T) {
+	shaper := NewShaper(nil, eventbus.New())
+	shaper.Apply(Policy{Limits: []Limit{{Subnet: "10.0.1.0/24", Rate: 8, Burst: 500}}})
+	// never allowed
+	shaper.Send(udp("10.0.0.2", "10.0.1.3", 80, 501))
+	// not started so never sent
+	for i := 0; i < QUEUE_SIZE+1; i++ {
+		shaper.Send(udp("10.0.0.2", "10.0.1.3", 80, 100))
+	}
+	if stats := shaper.Stats(); stats.Dropped != 1 || stats.Overflowed != 1 || stats.Queued != QUEUE_SIZE {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	shaper.Stop()
+	shaper.Send(udp("10.0.0.2", "10.0.2.3", 80, 100))
+	if stats := shaper.Stats(); stats.Queued != 0 {
+		t.Errorf("queued %d after stopped", stats.Queued)
+	}
+	// stopped twice
+	shaper.Stop()
+}
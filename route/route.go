@@ -16,9 +16,15 @@ limitations under the License.
 package route
 
 import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/liloew/gvn/eventbus"
+	"github.com/liloew/gvn/internal/strslice"
 	"github.com/liloew/gvn/tun"
 	"github.com/sirupsen/logrus"
 	"github.com/zmap/go-iptree/iptree"
@@ -27,179 +33,649 @@ import (
 type RouteEvent struct {
 	Subnets []string
 	Id      string
-	Vip     string
+	// the name of the peer
+	Name string
+	Vip  string
+	// where the routes come from, DHCP for the refresh and static for the others if empty
+	Source Source
+	Metric int
+	// seconds the routes live unless refreshed, 0 if never expire
+	Ttl int64
 }
 
+// Source is where the route comes from
+type Source string
+
+const (
+	// the VIPs and subnets of the leases
+	SourceDHCP Source = "dhcp"
+	// added by config or command
+	SourceStatic Source = "static"
+	// the subnets reserved for the peers
+	SourceReservation Source = "reservation"
+)
+
+// Failback decides whether the preferred route is switched back once it recovered
+type Failback string
+
+const (
+	// switch back to the route with the lowest metric once it recovered
+	FailbackPreempt Failback = "preempt"
+	// keep the current route until it fails
+	FailbackSticky Failback = "sticky"
+)
+
+// State is the state of a route among the ones of the same subnet
+type State string
+
+const (
+	// the packets to the subnet are forwarded via the route
+	StateActive State = "active"
+	// takes over once the active route fails
+	StateStandby State = "standby"
+	// the peer fails the health checks or is offline
+	StateDown State = "down"
+)
+
 const (
-	ADD_ROUTE_TOPIC     = "ADD_ROUTE"
-	REMOVE_ROUTE_TOPIC  = "REMOVE_ROUTE"
-	REFRESH_ROUTE_TOPIC = "REFRESH_ROUTE"
-	ONLINE_TOPIC        = "ONLINE"
-	OFFLINE_TOPIC       = "OFFLINE"
+	// the expired routes are purged every
+	EXPIRE_INTERVAL = 10 * time.Second
 )
 
+// Entry is a route to the subnet via the peer
+type Entry struct {
+	Subnet string `json:"subnet"`
+	Peer   string `json:"peer"`
+	Name   string `json:"name,omitempty"`
+	Source Source `json:"source"`
+	// the entry with the lowest metric is preferred among the ones of the same subnet
+	Metric int `json:"metric"`
+	// zero if never expires
+	Expires time.Time `json:"expires,omitempty"`
+	// filled by Get and Entries only
+	State State `json:"state,omitempty"`
+}
+
+func (e Entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
 var (
-	Route = RouteTable{
-		tree: iptree.New(),
-	}
-	EventBus = &eventbus.EventBus{
-		Subscribers: map[string]eventbus.DataChannelSlice{},
-	}
-	LocalRoute = make([]string, 0)
+	ADD_ROUTE_TOPIC     = eventbus.NewTopic("ADD_ROUTE", RouteEvent{})
+	REMOVE_ROUTE_TOPIC  = eventbus.NewTopic("REMOVE_ROUTE", RouteEvent{})
+	REFRESH_ROUTE_TOPIC = eventbus.NewTopic("REFRESH_ROUTE", RouteEvent{})
+	// the data is the peer id
+	ONLINE_TOPIC  = eventbus.NewTopic("ONLINE", "")
+	OFFLINE_TOPIC = eventbus.NewTopic("OFFLINE", "")
 )
 
-func init() {
+// Router installs the routes into the system
+type Router interface {
+	AddRoute(subnets []string) error
+	RemoveRoute(subnets []string) error
+	// ConflictWithLAN returns the local network overlapped with subnet if any
+	ConflictWithLAN(subnet *net.IPNet) *net.IPNet
+	// Installed returns the subnets routed via gvn by the system
+	Installed() ([]string, error)
+}
+
+// SystemRouter changes the routes of the system through the TUN device of a network, the routes are installed via
+// that device only so that the networks never share the routes
+type SystemRouter struct {
+	dev tun.Device
+	mu  sync.RWMutex
+}
+
+func NewSystemRouter(dev tun.Device) *SystemRouter {
+	return &SystemRouter{dev: dev}
+}
+
+// SetDevice changes the device once it's created with the address assigned by server
+func (s *SystemRouter) SetDevice(dev tun.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dev = dev
+}
+
+func (s *SystemRouter) device() tun.Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dev
+}
+
+func (s *SystemRouter) AddRoute(subnets []string) error {
+	return tun.AddRoute(s.device(), subnets)
+}
+
+func (s *SystemRouter) RemoveRoute(subnets []string) error {
+	return tun.RemoveRoute(s.device(), subnets)
+}
+
+func (s *SystemRouter) ConflictWithLAN(subnet *net.IPNet) *net.IPNet {
+	return tun.ConflictWithLAN(subnet, s.device().Name)
+}
+
+func (s *SystemRouter) Installed() ([]string, error) {
+	return tun.InstalledRoutes(s.device().Name)
+}
+
+// NoopRouter keeps the routes in the table only, the packets are routed by the userspace stack rather than the system
+type NoopRouter struct{}
+
+func (NoopRouter) AddRoute(subnets []string) error {
+	return nil
+}
+
+func (NoopRouter) RemoveRoute(subnets []string) error {
+	return nil
+}
+
+func (NoopRouter) ConflictWithLAN(subnet *net.IPNet) *net.IPNet {
+	return nil
+}
+
+func (NoopRouter) Installed() ([]string, error) {
+	return []string{}, nil
+}
+
+type RouteTable struct {
+	// subnet -> subnet, the longest prefix matched is the key of entries
+	tree *iptree.IPTree
+	// subnet -> entries ordered by metric, the subnets with entries are added to the system
+	entries map[string][]Entry
+	// subnet -> the peer of the active entry
+	active map[string]string
+	// the peers failed the health checks
+	down map[string]bool
+	// the peers disconnected or timed out
+	offline  map[string]bool
+	failback Failback
+	router   Router
+	events   *eventbus.Subscription
+	rm       sync.RWMutex
+}
+
+// NewRouteTable maintains the routes by the events published to bus
+func NewRouteTable(bus *eventbus.EventBus, router Router) *RouteTable {
+	r := &RouteTable{
+		tree:     iptree.New(),
+		entries:  map[string][]Entry{},
+		active:   map[string]string{},
+		down:     map[string]bool{},
+		offline:  map[string]bool{},
+		failback: FailbackPreempt,
+		router:   router,
+	}
+	// the route events must be applied in order and never dropped
+	r.events = bus.Subscribe(0, eventbus.Block, ADD_ROUTE_TOPIC, REMOVE_ROUTE_TOPIC, REFRESH_ROUTE_TOPIC, ONLINE_TOPIC, OFFLINE_TOPIC)
 	go func() {
-		addRouteCh := make(chan eventbus.DataEvent)
-		removeRouteCh := make(chan eventbus.DataEvent)
-		refreshRouteCh := make(chan eventbus.DataEvent)
-		onlineCh := make(chan eventbus.DataEvent)
-		offlineCh := make(chan eventbus.DataEvent)
-		EventBus.Subscribe(ADD_ROUTE_TOPIC, addRouteCh)
-		EventBus.Subscribe(REMOVE_ROUTE_TOPIC, removeRouteCh)
-		EventBus.Subscribe(REFRESH_ROUTE_TOPIC, refreshRouteCh)
-		EventBus.Subscribe(ONLINE_TOPIC, onlineCh)
-		EventBus.Subscribe(OFFLINE_TOPIC, offlineCh)
+		ticker := time.NewTicker(EXPIRE_INTERVAL)
+		defer ticker.Stop()
 		for {
 			select {
-			case data := <-addRouteCh:
-				logrus.WithFields(logrus.Fields{
-					"Data":  data.Data,
-					"Topic": data.Topic,
-				}).Debug("Add Route Channel")
-				for _, subnet := range data.Data.(RouteEvent).Subnets {
-					Route.add(subnet, data.Data.(RouteEvent).Id)
-				}
-			case data := <-removeRouteCh:
-				logrus.WithFields(logrus.Fields{
-					"Data":  data.Data,
-					"Topic": data.Topic,
-				}).Debug("Remove Route Channel")
-				for _, subnet := range data.Data.(RouteEvent).Subnets {
-					Route.remove(subnet)
+			case data, ok := <-r.events.C:
+				if !ok {
+					return
 				}
-			case data := <-refreshRouteCh:
-				logrus.WithFields(logrus.Fields{
-					"Data":  data.Data,
-					"Topic": data.Topic,
-				}).Debug("Refresh Route Channel")
-				// for _, subnet := range data.Data.(RouteEvent).Subnets {
-				// 	Route.remove(subnet)
-				// 	Route.add(subnet, data.Data.(RouteEvent).Id)
-				// }
-				Route.refresh(data.Data.(RouteEvent).Subnets, data.Data.(RouteEvent).Id)
-			case data := <-onlineCh:
-				logrus.WithFields(logrus.Fields{
-					"Data":  data.Data,
-					"Topic": data.Topic,
-				}).Debug("Online Channel")
-			case data := <-offlineCh:
-				logrus.WithFields(logrus.Fields{
-					"Data":  data.Data,
-					"Topic": data.Topic,
-				}).Debug("Offline Channel")
+				r.apply(data)
+			case now := <-ticker.C:
+				r.expire(now)
 			}
 		}
 	}()
+	return r
 }
 
-type RouteTable struct {
-	tree *iptree.IPTree
-	rm   sync.RWMutex
+func (r *RouteTable) apply(data eventbus.DataEvent) {
+	logrus.WithFields(logrus.Fields{
+		"Data":  data.Data,
+		"Topic": data.Topic,
+	}).Debug("Route event")
+	switch data.Topic {
+	case ADD_ROUTE_TOPIC:
+		event := data.Data.(RouteEvent)
+		for _, entry := range entries(event, SourceStatic) {
+			r.Add(entry)
+		}
+	case REMOVE_ROUTE_TOPIC:
+		event := data.Data.(RouteEvent)
+		for _, subnet := range event.Subnets {
+			r.Remove(subnet, event.Id)
+		}
+	case REFRESH_ROUTE_TOPIC:
+		event := data.Data.(RouteEvent)
+		if event.Vip != "" {
+			// vip/mask -> vip/32
+			event.Subnets = append(append([]string{}, event.Subnets...), strings.Split(event.Vip, "/")[0]+"/32")
+		}
+		source := event.Source
+		if source == "" {
+			source = SourceDHCP
+		}
+		r.refresh(event.Id, source, entries(event, source))
+	case ONLINE_TOPIC:
+		r.SetOffline(data.Data.(string), false)
+	case OFFLINE_TOPIC:
+		r.SetOffline(data.Data.(string), true)
+	}
+}
+
+// the entries of the event, the source defaults to source
+func entries(event RouteEvent, source Source) []Entry {
+	if event.Source != "" {
+		source = event.Source
+	}
+	var expires time.Time
+	if event.Ttl > 0 {
+		expires = time.Now().Add(time.Duration(event.Ttl) * time.Second)
+	}
+	entries := make([]Entry, 0, len(event.Subnets))
+	for _, subnet := range event.Subnets {
+		entries = append(entries, Entry{Subnet: subnet, Peer: event.Id, Name: event.Name, Source: source, Metric: event.Metric, Expires: expires})
+	}
+	return entries
 }
 
-func (r *RouteTable) refresh(subnets []string, peerId string) {
-	removed := oneSideSlice(LocalRoute, subnets)
-	added := oneSideSlice(subnets, LocalRoute)
+// refresh replaces the routes via peerId from source with the given entries
+func (r *RouteTable) refresh(peerId string, source Source, entries []Entry) {
+	subnets := make([]string, 0, len(entries))
+	for _, e := range entries {
+		subnets = append(subnets, canonical(e.Subnet))
+	}
+	owned := r.owned(peerId, source)
+	removed := oneSideSlice(owned, subnets)
 	logrus.WithFields(logrus.Fields{
-		"Removed":    removed,
-		"Added":      added,
-		"LocalRoute": LocalRoute,
-		"Subnets":    subnets,
+		"Removed": removed,
+		"Owned":   owned,
+		"Subnets": subnets,
+		"Peer":    peerId,
 	}).Debug("Remove and Added subnets")
 	for _, v := range removed {
-		r.remove(v)
+		r.remove(v, peerId, source)
 	}
-	// for _, v := range mergeSlice(LocalRoute, subnets) {
-	for _, v := range added {
-		r.add(v, peerId)
+	for _, e := range entries {
+		r.Add(e)
 	}
 }
 
-func (r *RouteTable) remove(subnet string) {
+// Add adds the route or updates the one of the same subnet and peer, the subnet is added to the system once it has
+// the first route. The static and reservation routes are never updated by DHCP
+func (r *RouteTable) Add(entry Entry) error {
+	_, network, err := net.ParseCIDR(entry.Subnet)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR":  err,
+			"Subnet": entry.Subnet,
+		}).Error("Ignore the invalid subnet")
+		return err
+	}
+	entry.Subnet = network.String()
+	entry.State = ""
+	if entry.Source == "" {
+		entry.Source = SourceStatic
+	}
 	r.rm.Lock()
-	if err := tun.RemoveRoute([]string{subnet}); err == nil {
-		r.tree.DeleteByString(subnet)
-		LocalRoute = remove(LocalRoute, subnet)
-	} else {
+	defer r.rm.Unlock()
+	entries, ok := r.entries[entry.Subnet]
+	if !ok {
+		if lan := r.router.ConflictWithLAN(network); lan != nil {
+			logrus.WithFields(logrus.Fields{
+				"Subnet": entry.Subnet,
+				"LAN":    lan.String(),
+				"Peer":   entry.Peer,
+			}).Error("Ignore the subnet becuase of conflict with LAN, change the subnets of the peer")
+			return fmt.Errorf("subnet %s conflicts with LAN %s", entry.Subnet, lan)
+		}
+		if err := r.router.AddRoute([]string{entry.Subnet}); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ERROR": err,
+			}).Error("Add route error")
+			return err
+		}
+		r.tree.AddByString(entry.Subnet, entry.Subnet)
+	}
+	for i, e := range entries {
+		if e.Peer == entry.Peer {
+			if entry.Source == SourceDHCP && e.Source != SourceDHCP {
+				logrus.WithFields(logrus.Fields{
+					"Subnet": entry.Subnet,
+					"Peer":   entry.Peer,
+					"Source": e.Source,
+				}).Debug("Keep the route not from DHCP")
+				return nil
+			}
+			entries = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	entries = append(entries, entry)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Metric < entries[j].Metric
+	})
+	r.entries[entry.Subnet] = entries
+	r.elect(entry.Subnet, time.Now())
+	return nil
+}
+
+// Remove removes the route to the subnet via the peer, the subnet is removed from the system once it has no route
+func (r *RouteTable) Remove(subnet string, peerId string) bool {
+	return r.remove(subnet, peerId, "")
+}
+
+// remove the route to the subnet via the peer from source, any source if empty
+func (r *RouteTable) remove(subnet string, peerId string, source Source) bool {
+	subnet = canonical(subnet)
+	r.rm.Lock()
+	defer r.rm.Unlock()
+	entries := r.entries[subnet]
+	for i, e := range entries {
+		if e.Peer == peerId && (source == "" || e.Source == source) {
+			r.drop(subnet, append(entries[:i:i], entries[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+// replace the entries of the subnet, should be called with rm locked
+func (r *RouteTable) drop(subnet string, entries []Entry) {
+	if len(entries) > 0 {
+		r.entries[subnet] = entries
+		r.elect(subnet, time.Now())
+		return
+	}
+	if err := r.router.RemoveRoute([]string{subnet}); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
 		}).Error("Remove route error")
 	}
-	r.rm.Unlock()
+	r.tree.DeleteByString(subnet)
+	delete(r.entries, subnet)
+	delete(r.active, subnet)
 }
 
-func (r *RouteTable) add(subnet string, peerId string) {
-	r.rm.Lock()
-	if contains(LocalRoute, subnet) {
+// elect the active entry of the subnet, the first alive one by metric unless the current one is kept by sticky
+// failback, should be called with rm locked
+func (r *RouteTable) elect(subnet string, now time.Time) {
+	entries := r.entries[subnet]
+	if len(entries) == 0 {
+		return
+	}
+	current := r.active[subnet]
+	elected := ""
+	for _, e := range entries {
+		if !r.alive(e.Peer) || e.Expired(now) {
+			continue
+		}
+		if elected == "" {
+			elected = e.Peer
+		}
+		if r.failback == FailbackSticky && e.Peer == current {
+			elected = current
+			break
+		}
+	}
+	if elected == "" {
+		// all down, try the preferred one anyway
+		elected = entries[0].Peer
+	}
+	if elected == current {
+		return
+	}
+	r.active[subnet] = elected
+	if current != "" && len(entries) > 1 {
 		logrus.WithFields(logrus.Fields{
-			"LocalRoute": LocalRoute,
-			"Subnet":     subnet,
-		}).Debug("Ignore the subnet becuase of existence")
-		r.rm.Unlock()
+			"Subnet": subnet,
+			"From":   current,
+			"To":     elected,
+		}).Info("Switch route")
+	}
+}
+
+// SetDown marks the peer failed the health checks or recovered, the routes via it are switched accordingly
+func (r *RouteTable) SetDown(peerId string, down bool) {
+	r.rm.Lock()
+	defer r.rm.Unlock()
+	if r.down[peerId] == down {
 		return
 	}
-	if err := tun.AddRoute([]string{subnet}); err == nil {
-		r.tree.AddByString(subnet, peerId)
-		LocalRoute = append(LocalRoute, subnet)
+	if down {
+		r.down[peerId] = true
 	} else {
-		logrus.WithFields(logrus.Fields{
-			"ERROR": err,
-		}).Error("Add route error")
+		delete(r.down, peerId)
+	}
+	logrus.WithFields(logrus.Fields{
+		"Peer": peerId,
+		"Down": down,
+	}).Info("Peer health changed")
+	now := time.Now()
+	for subnet := range r.entries {
+		r.elect(subnet, now)
 	}
-	r.rm.Unlock()
 }
 
-func (r *RouteTable) Get(ip string) (interface{}, bool, error) {
-	return r.tree.GetByString(ip)
+// SetOffline marks the peer disconnected or connected again, the routes via it are switched like SetDown
+func (r *RouteTable) SetOffline(peerId string, offline bool) {
+	r.rm.Lock()
+	defer r.rm.Unlock()
+	if r.offline[peerId] == offline {
+		return
+	}
+	if offline {
+		r.offline[peerId] = true
+	} else {
+		delete(r.offline, peerId)
+	}
+	now := time.Now()
+	for subnet := range r.entries {
+		r.elect(subnet, now)
+	}
 }
 
-func (r *RouteTable) Clean() {
-	// TODO:
-	r.tree = iptree.New()
+// the peer passes the health checks and is connected, should be called with rm locked
+func (r *RouteTable) alive(peerId string) bool {
+	return !r.down[peerId] && !r.offline[peerId]
 }
 
-////////////////////////////////////////////////////////////////////////////////
+// SetFailback changes the failback policy, preempt if empty
+func (r *RouteTable) SetFailback(policy Failback) {
+	if policy == "" {
+		policy = FailbackPreempt
+	}
+	r.rm.Lock()
+	defer r.rm.Unlock()
+	r.failback = policy
+	now := time.Now()
+	for subnet := range r.entries {
+		r.elect(subnet, now)
+	}
+}
 
-func contains(elems []string, v string) bool {
-	for _, s := range elems {
-		if v == s {
-			return true
+// Redundant returns the peers advertise the subnets together with others, they are health checked for failover
+func (r *RouteTable) Redundant() []string {
+	r.rm.RLock()
+	defer r.rm.RUnlock()
+	peers := make([]string, 0)
+	for _, entries := range r.entries {
+		if len(entries) < 2 {
+			continue
+		}
+		for _, e := range entries {
+			if !strslice.Contains(peers, e.Peer) {
+				peers = append(peers, e.Peer)
+			}
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// the state of the entry, should be called with rm locked
+func (r *RouteTable) state(e Entry) State {
+	if !r.alive(e.Peer) {
+		// even if it's active because all the others are down as well
+		return StateDown
+	}
+	if r.active[e.Subnet] == e.Peer {
+		return StateActive
+	}
+	return StateStandby
+}
+
+// remove the expired routes
+func (r *RouteTable) expire(now time.Time) {
+	r.rm.Lock()
+	defer r.rm.Unlock()
+	for subnet, entries := range r.entries {
+		alive := make([]Entry, 0, len(entries))
+		for _, e := range entries {
+			if !e.Expired(now) {
+				alive = append(alive, e)
+			}
+		}
+		if len(alive) != len(entries) {
+			logrus.WithFields(logrus.Fields{
+				"Subnet":  subnet,
+				"Expired": len(entries) - len(alive),
+			}).Debug("Remove the expired routes")
+			r.drop(subnet, alive)
+		}
+	}
+}
+
+// return the subnets routed via peerId from source
+func (r *RouteTable) owned(peerId string, source Source) []string {
+	r.rm.RLock()
+	defer r.rm.RUnlock()
+	subnets := make([]string, 0)
+	for subnet, entries := range r.entries {
+		for _, e := range entries {
+			if e.Peer == peerId && e.Source == source {
+				subnets = append(subnets, subnet)
+			}
+		}
+	}
+	return subnets
+}
+
+// Get returns the active route of the longest prefix matched ip, the first alive one if the active one expired
+func (r *RouteTable) Get(ip string) (Entry, bool) {
+	r.rm.RLock()
+	defer r.rm.RUnlock()
+	subnet, found, err := r.tree.GetByString(ip)
+	if err != nil || !found {
+		return Entry{}, false
+	}
+	now := time.Now()
+	entries := r.entries[subnet.(string)]
+	for _, e := range entries {
+		if e.Peer == r.active[e.Subnet] && !e.Expired(now) {
+			e.State = r.state(e)
+			return e, true
+		}
+	}
+	for _, e := range entries {
+		if r.alive(e.Peer) && !e.Expired(now) {
+			e.State = StateStandby
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Known reports whether any route is via the peer
+func (r *RouteTable) Known(peerId string) bool {
+	r.rm.RLock()
+	defer r.rm.RUnlock()
+	for _, entries := range r.entries {
+		for _, e := range entries {
+			if e.Peer == peerId {
+				return true
+			}
 		}
 	}
 	return false
 }
 
-func remove(items []string, item string) []string {
-	newitems := []string{}
-	for _, i := range items {
-		if i != item {
-			newitems = append(newitems, i)
+// Peers returns the peers owning any unexpired route and passing the health checks, the frames flooded by the
+// virtual switch are sent to them. The offline peers are included since the idle connections are closed, they are
+// dialed on demand
+func (r *RouteTable) Peers() []string {
+	r.rm.RLock()
+	defer r.rm.RUnlock()
+	now := time.Now()
+	peers := make([]string, 0)
+	for _, entries := range r.entries {
+		for _, e := range entries {
+			if !r.down[e.Peer] && !e.Expired(now) && !strslice.Contains(peers, e.Peer) {
+				peers = append(peers, e.Peer)
+			}
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Entries returns all the routes ordered by subnet and metric
+func (r *RouteTable) Entries() []Entry {
+	r.rm.RLock()
+	defer r.rm.RUnlock()
+	subnets := make([]string, 0, len(r.entries))
+	for subnet := range r.entries {
+		subnets = append(subnets, subnet)
+	}
+	sort.Strings(subnets)
+	all := make([]Entry, 0, len(subnets))
+	for _, subnet := range subnets {
+		for _, e := range r.entries[subnet] {
+			e.State = r.state(e)
+			all = append(all, e)
 		}
 	}
-	return newitems
+	return all
+}
+
+// Installed returns the subnets routed via gvn by the system
+func (r *RouteTable) Installed() ([]string, error) {
+	return r.router.Installed()
+}
+
+// Close stops applying the route events
+func (r *RouteTable) Close() {
+	r.events.Unsubscribe()
+}
+
+func (r *RouteTable) Clean() {
+	// TODO:
+	r.rm.Lock()
+	r.tree = iptree.New()
+	r.entries = map[string][]Entry{}
+	r.active = map[string]string{}
+	r.down = map[string]bool{}
+	r.offline = map[string]bool{}
+	r.rm.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// the network of the subnet, the subnet itself if invalid
+func canonical(subnet string) string {
+	if _, network, err := net.ParseCIDR(subnet); err == nil {
+		return network.String()
+	}
+	return subnet
 }
 
 // return the items co-exists in left and right
 func mergeSlice(left, right []string) []string {
 	tmp := make([]string, 0)
 	for _, v := range left {
-		if contains(right, v) && !contains(tmp, v) {
+		if strslice.Contains(right, v) && !strslice.Contains(tmp, v) {
 			tmp = append(tmp, v)
 		}
 	}
 	for _, v := range right {
-		if contains(left, v) && !contains(tmp, v) {
+		if strslice.Contains(left, v) && !strslice.Contains(tmp, v) {
 			tmp = append(tmp, v)
 		}
 	}
@@ -213,7 +689,7 @@ func mergeSlice(left, right []string) []string {
 func oneSideSlice(left, right []string) []string {
 	tmp := make([]string, 0)
 	for _, v := range left {
-		if !contains(right, v) {
+		if !strslice.Contains(right, v) {
 			tmp = append(tmp, v)
 		}
 	}
@@ -0,0 +1,226 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package route
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/liloew/gvn/eventbus"
+)
+
+// fakeRouter records the subnets added to the system
+type fakeRouter struct {
+	added map[string]bool
+}
+
+func (f *fakeRouter) AddRoute(subnets []string) error {
+	for _, s := range subnets {
+		f.added[s] = true
+	}
+	return nil
+}
+
+func (f *fakeRouter) RemoveRoute(subnets []string) error {
+	for _, s := range subnets {
+		delete(f.added, s)
+	}
+	return nil
+}
+
+func (f *fakeRouter) ConflictWithLAN(subnet *net.IPNet) *net.IPNet {
+	return nil
+}
+
+func (f *fakeRouter) Installed() ([]string, error) {
+	installed := make([]string, 0, len(f.added))
+	for s := range f.added {
+		installed = append(installed, s)
+	}
+	return installed, nil
+}
+
+func newTable() (*RouteTable, *fakeRouter, *eventbus.EventBus) {
+	router := &fakeRouter{added: map[string]bool{}}
+	bus := eventbus.New()
+	return NewRouteTable(bus, router), router, bus
+}
+
+func TestMetric(t *testing.T) {
+	r, router, _ := newTable()
+	defer r.Close()
+	r.Add(Entry{Subnet: "192.168.1.1/24", Peer: "a", Metric: 10})
+	r.Add(Entry{Subnet: "192.168.1.0/24", Peer: "b", Metric: 5})
+	if e, _ := r.Get("192.168.1.7"); e.Peer != "b" || e.Subnet != "192.168.1.0/24" {
+		t.Errorf("route %+v, the one via b expected", e)
+	}
+	if !r.Remove("192.168.1.0/24", "b") {
+		t.Error("route via b not removed")
+	}
+	if e, _ := r.Get("192.168.1.7"); e.Peer != "a" {
+		t.Errorf("route %+v, the one via a expected", e)
+	}
+	if !router.added["192.168.1.0/24"] {
+		t.Error("subnet removed from system with route left")
+	}
+	r.Remove("192.168.1.0/24", "a")
+	if _, found := r.Get("192.168.1.7"); found || len(router.added) != 0 {
+		t.Errorf("subnet left after all the routes removed: %v", router.added)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	r, _, _ := newTable()
+	defer r.Close()
+	r.Add(Entry{Subnet: "10.30.20.0/24", Peer: "a", Metric: 10})
+	r.Add(Entry{Subnet: "10.30.20.0/24", Peer: "b", Metric: 20})
+	r.Add(Entry{Subnet: "10.40.0.0/16", Peer: "c"})
+	if peers := r.Redundant(); !reflect.DeepEqual(peers, []string{"a", "b"}) {
+		t.Errorf("redundant peers %v", peers)
+	}
+	r.SetDown("a", true)
+	if e, _ := r.Get("10.30.20.1"); e.Peer != "b" || e.State != StateActive {
+		t.Errorf("route %+v, the one via b expected after a failed", e)
+	}
+	if states := []State{r.Entries()[0].State, r.Entries()[1].State}; states[0] != StateDown || states[1] != StateActive {
+		t.Errorf("unexpected states %v", states)
+	}
+	r.SetDown("a", false)
+	if e, _ := r.Get("10.30.20.1"); e.Peer != "a" {
+		t.Errorf("route %+v, preempted by a expected", e)
+	}
+	// all down, the preferred one is tried anyway
+	r.SetDown("a", true)
+	r.SetDown("b", true)
+	if e, found := r.Get("10.30.20.1"); !found || e.Peer != "a" {
+		t.Errorf("route %+v, the one via a expected after all failed", e)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	r, _, _ := newTable()
+	defer r.Close()
+	r.Add(Entry{Subnet: "10.0.0.2/32", Peer: "a"})
+	r.Add(Entry{Subnet: "10.0.0.3/32", Peer: "b"})
+	r.Add(Entry{Subnet: "10.0.0.4/32", Peer: "c"})
+	r.Add(Entry{Subnet: "10.0.0.5/32", Peer: "d", Expires: time.Now().Add(-time.Second)})
+	// the idle connection closed
+	r.SetOffline("b", true)
+	r.SetDown("c", true)
+	if peers := r.Peers(); !reflect.DeepEqual(peers, []string{"a", "b"}) {
+		t.Errorf("peers %v, the offline one expected but not the down or expired ones", peers)
+	}
+}
+
+func TestStickyFailback(t *testing.T) {
+	r, _, _ := newTable()
+	defer r.Close()
+	r.SetFailback(FailbackSticky)
+	r.Add(Entry{Subnet: "10.30.20.0/24", Peer: "a", Metric: 10})
+	r.Add(Entry{Subnet: "10.30.20.0/24", Peer: "b", Metric: 20})
+	r.SetDown("a", true)
+	r.SetDown("a", false)
+	if e, _ := r.Get("10.30.20.1"); e.Peer != "b" {
+		t.Errorf("route %+v, the one via b kept expected", e)
+	}
+	r.Remove("10.30.20.0/24", "b")
+	if e, _ := r.Get("10.30.20.1"); e.Peer != "a" {
+		t.Errorf("route %+v, the one via a expected after b removed", e)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	r, router, _ := newTable()
+	defer r.Close()
+	r.Add(Entry{Subnet: "10.1.0.0/16", Peer: "a", Expires: time.Now().Add(-time.Second)})
+	r.Add(Entry{Subnet: "10.2.0.0/16", Peer: "a"})
+	if _, found := r.Get("10.1.0.1"); found {
+		t.Error("expired route found")
+	}
+	r.expire(time.Now())
+	if len(r.Entries()) != 1 || router.added["10.1.0.0/16"] {
+		t.Errorf("expired route not purged: %+v", r.Entries())
+	}
+}
+
+func TestRefreshKeepsStaticRoutes(t *testing.T) {
+	r, _, bus := newTable()
+	defer r.Close()
+	bus.Publish(ADD_ROUTE_TOPIC, RouteEvent{Id: "a", Subnets: []string{"172.16.0.0/16"}, Metric: 1})
+	bus.Publish(REFRESH_ROUTE_TOPIC, RouteEvent{Id: "a", Vip: "10.0.0.2/24", Subnets: []string{"192.168.1.0/24"}})
+	bus.Publish(REFRESH_ROUTE_TOPIC, RouteEvent{Id: "a", Vip: "10.0.0.2/24", Subnets: []string{"192.168.2.0/24"}, Ttl: 60})
+	expected := []Entry{
+		{Subnet: "10.0.0.2/32", Peer: "a", Source: SourceDHCP, State: StateActive},
+		{Subnet: "172.16.0.0/16", Peer: "a", Source: SourceStatic, Metric: 1, State: StateActive},
+		{Subnet: "192.168.2.0/24", Peer: "a", Source: SourceDHCP, State: StateActive},
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		entries := r.Entries()
+		expires := make([]time.Time, len(entries))
+		for i := range entries {
+			expires[i], entries[i].Expires = entries[i].Expires, time.Time{}
+		}
+		if reflect.DeepEqual(entries, expected) {
+			if expires[0].IsZero() || expires[2].IsZero() || !expires[1].IsZero() {
+				t.Errorf("unexpected expiry %v", expires)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entries %+v, %+v expected", entries, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRefreshKeepsReservedRoutes(t *testing.T) {
+	r, router, _ := newTable()
+	defer r.Close()
+	r.Add(Entry{Subnet: "172.16.0.0/16", Peer: "a", Metric: 1})
+	r.Add(Entry{Subnet: "10.0.0.2/32", Peer: "a", Source: SourceReservation})
+	// the lease claims the same subnets
+	r.refresh("a", SourceDHCP, []Entry{
+		{Subnet: "10.0.0.2/32", Peer: "a", Source: SourceDHCP, Expires: time.Now().Add(time.Minute)},
+		{Subnet: "172.16.0.0/16", Peer: "a", Source: SourceDHCP, Metric: 5},
+	})
+	// and drops them
+	r.refresh("a", SourceDHCP, nil)
+	expected := []Entry{
+		{Subnet: "10.0.0.2/32", Peer: "a", Source: SourceReservation, State: StateActive},
+		{Subnet: "172.16.0.0/16", Peer: "a", Source: SourceStatic, Metric: 1, State: StateActive},
+	}
+	if entries := r.Entries(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("entries %+v, %+v expected", entries, expected)
+	}
+	if !router.added["10.0.0.2/32"] || !router.added["172.16.0.0/16"] {
+		t.Errorf("system routes %v", router.added)
+	}
+}
+
+func TestClean(t *testing.T) {
+	r, _, _ := newTable()
+	defer r.Close()
+	r.Add(Entry{Subnet: "10.1.0.0/16", Peer: "a"})
+	r.SetDown("a", true)
+	r.Clean()
+	r.Add(Entry{Subnet: "10.1.0.0/16", Peer: "a"})
+	if e, found := r.Get("10.1.0.1"); !found || e.State != StateActive {
+		t.Errorf("route %+v, the peer still down after clean", e)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// InstalledRoutes returns the IPv4 routes of the kernel via the TUN device named name
+func InstalledRoutes(name string) ([]string, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	routes := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] != name {
+			continue
+		}
+		ip, err := routeAddr(fields[1], hostByteOrder)
+		if err != nil {
+			continue
+		}
+		mask, err := routeAddr(fields[7], hostByteOrder)
+		if err != nil {
+			continue
+		}
+		routes = append(routes, (&net.IPNet{IP: ip, Mask: net.IPMask(mask)}).String())
+	}
+	return routes, scanner.Err()
+}
+
+// the byte order of the host, which the kernel prints the addresses of /proc/net/route in
+var hostByteOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 0 {
+		hostByteOrder = binary.BigEndian
+	}
+}
+
+// decode the address printed as the hex of a 32 bits integer in order, which holds the address in network byte order
+func routeAddr(field string, order binary.ByteOrder) (net.IP, error) {
+	value, err := strconv.ParseUint(field, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	addr := make(net.IP, net.IPv4len)
+	order.PutUint32(addr, uint32(value))
+	return addr, nil
+}
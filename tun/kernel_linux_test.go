@@ -0,0 +1,45 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tun
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestRouteAddr(t *testing.T) {
+	cases := []struct {
+		field    string
+		order    binary.ByteOrder
+		expected string
+	}{
+		// 10.1.2.0 on the little-endian hosts
+		{"0002010A", binary.LittleEndian, "10.1.2.0"},
+		{"00FFFFFF", binary.LittleEndian, "255.255.255.0"},
+		// and on the big-endian ones
+		{"0A010200", binary.BigEndian, "10.1.2.0"},
+		{"FFFFFF00", binary.BigEndian, "255.255.255.0"},
+	}
+	for _, c := range cases {
+		addr, err := routeAddr(c.field, c.order)
+		if err != nil || addr.String() != c.expected {
+			t.Errorf("%s decoded as %v %v, %s expected", c.field, addr, err, c.expected)
+		}
+	}
+	if _, err := routeAddr("10002010A", binary.LittleEndian); err == nil {
+		t.Error("decoded the address longer than 32 bits")
+	}
+}
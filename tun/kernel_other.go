@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tun
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// InstalledRoutes returns the IPv4 routes of the kernel via the TUN device named name
+func InstalledRoutes(name string) ([]string, error) {
+	return nil, fmt.Errorf("reading the kernel routes is not supported on %s", runtime.GOOS)
+}
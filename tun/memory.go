@@ -0,0 +1,94 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tun
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// packets buffered in each direction
+	MEMORY_QUEUE_SIZE = 1024
+)
+
+// Memory is an in-memory TUN device without root, the packets injected are read by gvn as if sent by
+// the local host, and the packets written by gvn are delivered to Received
+type Memory struct {
+	mtu      int
+	inbound  chan []byte
+	outbound chan []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func NewMemory(mtu int) *Memory {
+	return &Memory{
+		mtu:      mtu,
+		inbound:  make(chan []byte, MEMORY_QUEUE_SIZE),
+		outbound: make(chan []byte, MEMORY_QUEUE_SIZE),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (m *Memory) Read(buff []byte) (int, error) {
+	select {
+	case packet := <-m.inbound:
+		return copy(buff, packet), nil
+	case <-m.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+// Write delivers the packet to Received, the packet is dropped if nobody receives in time like the real device
+func (m *Memory) Write(packet []byte) (int, error) {
+	if m.mtu > 0 && len(packet) > m.mtu {
+		return 0, fmt.Errorf("packet size %d exceeds MTU %d", len(packet), m.mtu)
+	}
+	select {
+	case <-m.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+	select {
+	case m.outbound <- append([]byte{}, packet...):
+	default:
+	}
+	return len(packet), nil
+}
+
+func (m *Memory) Close() error {
+	m.once.Do(func() {
+		close(m.closed)
+	})
+	return nil
+}
+
+// Inject queues the packet to be read by gvn
+func (m *Memory) Inject(packet []byte) error {
+	select {
+	case m.inbound <- append([]byte{}, packet...):
+		return nil
+	case <-m.closed:
+		return os.ErrClosed
+	}
+}
+
+// Received returns the packets written by gvn
+func (m *Memory) Received() <-chan []byte {
+	return m.outbound
+}
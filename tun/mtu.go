@@ -0,0 +1,258 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	IPV4_HEADER_LEN = 20
+	IPV6_HEADER_LEN = 40
+	TCP_HEADER_LEN  = 20
+	// IPv6 requires every link to carry 1280 bytes
+	IPV6_MIN_MTU = 1280
+
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolICMPv6 = 58
+	flagDF         = 0x4000
+	flagMF         = 0x2000
+	tcpFlagSYN     = 0x02
+	tcpOptionEnd   = 0
+	tcpOptionNop   = 1
+	tcpOptionMSS   = 2
+)
+
+// DontFragment reports whether the packet can't be fragmented on the path, IPv6 packets are never fragmented by routers
+func DontFragment(packet []byte) bool {
+	if len(packet) < IPV4_HEADER_LEN {
+		return false
+	}
+	if packet[0]>>4 == 6 {
+		return true
+	}
+	return binary.BigEndian.Uint16(packet[6:8])&flagDF != 0
+}
+
+// Fragment splits the IPv4 packet into fragments fit in mtu, the packet is returned as is if it fits already
+func Fragment(packet []byte, mtu int) [][]byte {
+	if len(packet) <= mtu || len(packet) < IPV4_HEADER_LEN || packet[0]>>4 != 4 {
+		return [][]byte{packet}
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	// the fragment offset is measured in 8 bytes
+	size := (mtu - ihl) &^ 7
+	if ihl < IPV4_HEADER_LEN || len(packet) < ihl || size <= 0 {
+		return nil
+	}
+	field := binary.BigEndian.Uint16(packet[6:8])
+	offset := int(field&0x1fff) * 8
+	payload := packet[ihl:]
+	fragments := make([][]byte, 0, len(payload)/size+1)
+	for start := 0; start < len(payload); start += size {
+		end := start + size
+		more := field & flagMF
+		if end < len(payload) {
+			more = flagMF
+		} else {
+			end = len(payload)
+		}
+		fragment := make([]byte, ihl+end-start)
+		copy(fragment, packet[:ihl])
+		copy(fragment[ihl:], payload[start:end])
+		binary.BigEndian.PutUint16(fragment[2:4], uint16(len(fragment)))
+		binary.BigEndian.PutUint16(fragment[6:8], more|uint16((offset+start)/8))
+		binary.BigEndian.PutUint16(fragment[10:12], 0)
+		binary.BigEndian.PutUint16(fragment[10:12], checksum(fragment[:ihl], 0))
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+// PacketTooBig builds the ICMP "fragmentation needed" or ICMPv6 "packet too big" message sent from src back to the
+// source of packet, nil is returned if no message should be generated for the packet
+func PacketTooBig(packet []byte, mtu int, src net.IP) []byte {
+	if len(packet) < IPV4_HEADER_LEN {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		return fragmentationNeeded(packet, mtu, src.To4())
+	case 6:
+		return packetTooBig6(packet, mtu, src.To16())
+	}
+	return nil
+}
+
+func fragmentationNeeded(packet []byte, mtu int, src net.IP) []byte {
+	ihl := int(packet[0]&0x0f) * 4
+	if src == nil || ihl < IPV4_HEADER_LEN || len(packet) < ihl {
+		return nil
+	}
+	// never reply to the non-first fragments and the ICMP errors
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return nil
+	}
+	if packet[9] == protocolICMP && len(packet) > ihl && isICMPError(packet[ihl]) {
+		return nil
+	}
+	// the original header and the first 8 bytes of its payload
+	quote := packet[:minInt(len(packet), ihl+8)]
+	message := make([]byte, IPV4_HEADER_LEN+8+len(quote))
+	message[0] = 0x45
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)))
+	message[8] = 64
+	message[9] = protocolICMP
+	copy(message[12:16], src)
+	copy(message[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(message[10:12], checksum(message[:IPV4_HEADER_LEN], 0))
+	icmp := message[IPV4_HEADER_LEN:]
+	// destination unreachable, fragmentation needed and DF set
+	icmp[0] = 3
+	icmp[1] = 4
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[8:], quote)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+	return message
+}
+
+func packetTooBig6(packet []byte, mtu int, src net.IP) []byte {
+	if src == nil || len(packet) < IPV6_HEADER_LEN {
+		return nil
+	}
+	if packet[6] == protocolICMPv6 && len(packet) > IPV6_HEADER_LEN && packet[IPV6_HEADER_LEN] < 128 {
+		// ICMPv6 error messages
+		return nil
+	}
+	// as much of the original packet as possible without exceeding the minimum MTU
+	quote := packet[:minInt(len(packet), IPV6_MIN_MTU-IPV6_HEADER_LEN-8)]
+	message := make([]byte, IPV6_HEADER_LEN+8+len(quote))
+	message[0] = 0x60
+	binary.BigEndian.PutUint16(message[4:6], uint16(8+len(quote)))
+	message[6] = protocolICMPv6
+	message[7] = 64
+	copy(message[8:24], src)
+	copy(message[24:40], packet[8:24])
+	icmp := message[IPV6_HEADER_LEN:]
+	icmp[0] = 2
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[8:], quote)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, pseudoHeaderSum6(message[8:24], message[24:40], len(icmp), protocolICMPv6)))
+	return message
+}
+
+// ClampMSS lowers the MSS option of the TCP SYN packet to fit in mtu, reports whether the packet changed
+func ClampMSS(packet []byte, mtu int) bool {
+	if len(packet) < IPV4_HEADER_LEN {
+		return false
+	}
+	var tcp []byte
+	var mss int
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[9] != protocolTCP || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 || len(packet) < ihl {
+			return false
+		}
+		tcp = packet[ihl:]
+		mss = mtu - IPV4_HEADER_LEN - TCP_HEADER_LEN
+	case 6:
+		// the extension headers are not supported
+		if len(packet) < IPV6_HEADER_LEN || packet[6] != protocolTCP {
+			return false
+		}
+		tcp = packet[IPV6_HEADER_LEN:]
+		mss = mtu - IPV6_HEADER_LEN - TCP_HEADER_LEN
+	default:
+		return false
+	}
+	if len(tcp) < TCP_HEADER_LEN || tcp[13]&tcpFlagSYN == 0 || mss <= 0 {
+		return false
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < TCP_HEADER_LEN || len(tcp) < offset {
+		return false
+	}
+	options := tcp[TCP_HEADER_LEN:offset]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNop:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return false
+		}
+		if options[i] == tcpOptionMSS && options[i+1] == 4 {
+			old := binary.BigEndian.Uint16(options[i+2 : i+4])
+			if int(old) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(options[i+2:i+4], uint16(mss))
+			// update the checksum incrementally as RFC 1624
+			sum := uint32(^binary.BigEndian.Uint16(tcp[16:18])) + uint32(^old) + uint32(mss)
+			binary.BigEndian.PutUint16(tcp[16:18], ^fold(sum))
+			return true
+		}
+		i += int(options[i+1])
+	}
+	return false
+}
+
+func isICMPError(typ byte) bool {
+	switch typ {
+	case 3, 4, 5, 11, 12:
+		return true
+	}
+	return false
+}
+
+func pseudoHeaderSum6(src, dst []byte, length int, protocol byte) uint32 {
+	var sum uint32
+	for i := 0; i < 16; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(src[i:])) + uint32(binary.BigEndian.Uint16(dst[i:]))
+	}
+	return sum + uint32(length>>16) + uint32(length&0xffff) + uint32(protocol)
+}
+
+// the internet checksum of data plus the initial sum
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return ^fold(sum)
+}
+
+func fold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,187 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// golden packets, the checksums were computed independently of this package
+const (
+	syn4      = "4500003012344000400614900a0000020a0000039c40001600000001000000007002ffffd2c30000020405b401010402"
+	clamped4  = "4500003012344000400614900a0000020a0000039c40001600000001000000007002ffffd32700000204055001010402"
+	syn6      = "60000000001c0640fd000000000000000000000000000002fd0000000000000000000000000000039c40001600000001000000007002ffffecd50000020405a001010402"
+	clamped6  = "60000000001c0640fd000000000000000000000000000002fd0000000000000000000000000000039c40001600000001000000007002ffffed3900000204053c01010402"
+	udp4      = "45000046123400004011546f0a0000020a000003000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f3031"
+	fragment0 = "4500002c12342000401134890a0000020a000003000102030405060708090a0b0c0d0e0f1011121314151617"
+	fragment1 = "4500002c12342003401134860a0000020a00000318191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f"
+	fragment2 = "4500001612340006401154990a0000020a0000033031"
+	tooBig4   = "4500003800000000400166c30a0000010a00000203045b2c000005784500003012344000400614900a0000020a0000039c40001600000001"
+	tooBig6   = "60000000004c3a40fd000000000000000000000000000001fd000000000000000000000000000002020097c20000057860000000001c0640fd000000000000000000000000000002fd0000000000000000000000000000039c40001600000001000000007002ffffecd50000020405a001010402"
+)
+
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFragment(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		mtu    int
+		want   []string
+	}{
+		{"fits", udp4, 1400, []string{udp4}},
+		{"exact", udp4, 70, []string{udp4}},
+		{"split", udp4, 44, []string{fragment0, fragment1, fragment2}},
+		// the size is rounded down to 8 bytes
+		{"unaligned", udp4, 47, []string{fragment0, fragment1, fragment2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Fragment(decode(t, tt.packet), tt.mtu)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d fragments, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if want := decode(t, tt.want[i]); !bytes.Equal(got[i], want) {
+					t.Errorf("fragment %d = %x, want %x", i, got[i], want)
+				}
+				if len(got[i]) > tt.mtu {
+					t.Errorf("fragment %d has %d bytes, exceeds %d", i, len(got[i]), tt.mtu)
+				}
+				if sum := checksum(got[i][:IPV4_HEADER_LEN], 0); sum != 0 {
+					t.Errorf("fragment %d has a bad header checksum", i)
+				}
+			}
+		})
+	}
+	// IPv6 packets are never fragmented
+	if got := Fragment(decode(t, syn6), 40); len(got) != 1 || !bytes.Equal(got[0], decode(t, syn6)) {
+		t.Errorf("got %x for an IPv6 packet", got)
+	}
+	// the header doesn't fit in mtu
+	if got := Fragment(decode(t, udp4), 24); got != nil {
+		t.Errorf("got %d fragments for a too small mtu", len(got))
+	}
+}
+
+func TestFragmentOfFragment(t *testing.T) {
+	// refragmenting keeps the offsets and the last fragment keeps MF clear
+	var got [][]byte
+	for _, fragment := range Fragment(decode(t, udp4), 44) {
+		got = append(got, Fragment(fragment, 36)...)
+	}
+	var payload []byte
+	for i, fragment := range got {
+		offset := int(fragment[6]&0x1f)<<8 | int(fragment[7])
+		if offset*8 != len(payload) {
+			t.Fatalf("fragment %d at offset %d, want %d", i, offset*8, len(payload))
+		}
+		if more := fragment[6]&0x20 != 0; more != (i < len(got)-1) {
+			t.Errorf("fragment %d has MF %v", i, more)
+		}
+		payload = append(payload, fragment[IPV4_HEADER_LEN:]...)
+	}
+	if want := decode(t, udp4)[IPV4_HEADER_LEN:]; !bytes.Equal(payload, want) {
+		t.Errorf("reassembled %x, want %x", payload, want)
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	// a non-first fragment
+	fragment := decode(t, fragment1)
+	// an ICMP fragmentation needed message
+	icmp := decode(t, tooBig4)
+	tests := []struct {
+		name   string
+		packet []byte
+		src    string
+		want   string
+	}{
+		{"ipv4", decode(t, syn4), "10.0.0.1", tooBig4},
+		{"ipv6", decode(t, syn6), "fd00::1", tooBig6},
+		{"fragment", fragment, "10.0.0.1", ""},
+		{"icmp error", icmp, "10.0.0.3", ""},
+		{"icmpv6 error", decode(t, tooBig6), "fd00::2", ""},
+		{"no ipv4 source", decode(t, syn4), "fd00::1", ""},
+		{"short", []byte{0x45, 0}, "10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PacketTooBig(tt.packet, 1400, net.ParseIP(tt.src))
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("got %x, want nil", got)
+				}
+				return
+			}
+			if want := decode(t, tt.want); !bytes.Equal(got, want) {
+				t.Fatalf("got %x, want %x", got, want)
+			}
+			switch got[0] >> 4 {
+			case 4:
+				if checksum(got[:IPV4_HEADER_LEN], 0) != 0 || checksum(got[IPV4_HEADER_LEN:], 0) != 0 {
+					t.Error("bad checksum")
+				}
+			case 6:
+				body := got[IPV6_HEADER_LEN:]
+				if checksum(body, pseudoHeaderSum6(got[8:24], got[24:40], len(body), protocolICMPv6)) != 0 {
+					t.Error("bad checksum")
+				}
+			}
+		})
+	}
+}
+
+func TestClampMSS(t *testing.T) {
+	// not a SYN
+	ack := decode(t, syn4)
+	ack[IPV4_HEADER_LEN+13] = 0x10
+	tests := []struct {
+		name    string
+		packet  []byte
+		mtu     int
+		changed bool
+		want    string
+	}{
+		{"ipv4", decode(t, syn4), 1400, true, clamped4},
+		{"ipv6", decode(t, syn6), 1400, true, clamped6},
+		{"smaller", decode(t, clamped4), 1400, false, clamped4},
+		{"fits", decode(t, syn4), 1500, false, syn4},
+		{"not syn", ack, 1400, false, hex.EncodeToString(ack)},
+		{"not tcp", decode(t, udp4), 40, false, udp4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := append([]byte(nil), tt.packet...)
+			if changed := ClampMSS(packet, tt.mtu); changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if want := decode(t, tt.want); !bytes.Equal(packet, want) {
+				t.Errorf("got %x, want %x", packet, want)
+			}
+		})
+	}
+}
@@ -29,14 +29,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	VIP     string
-	devName string
-)
-
 func ConfigAddr(dev Device) error {
-	VIP = dev.Ip
-	devName = dev.Name
+	vip := dev.Ip
 	tmpfile, err := ioutil.TempFile("", "ConfigureAddr-*.sh")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -48,7 +42,7 @@ func ConfigAddr(dev Device) error {
 	}).Info("shell script to be executed")
 	// cidr -> 10.30.20.0/24,172.16.1.1/23 and etc
 	// ipv4Addr, ipv4Net, err := net.ParseCIDR(VIP)
-	_, ipv4Net, err := net.ParseCIDR(VIP)
+	_, ipv4Net, err := net.ParseCIDR(vip)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
@@ -71,7 +65,7 @@ then
     echo "${IPOPR} addr add ${GVN_VIP} dev $INTERFACE" >> "${LOGFILE}"
     "${IPOPR}" route add ${GVN_VIP} dev $INTERFACE
     echo "${IPOPR} route add ${GVN_VIP} dev $INTERFACE" >> "${LOGFILE}"
-    # TODO: check whether conflict with LAN
+    # conflict with LAN has been checked before
     for ROU in ${ROUTES}
     do
        "${IPOPR}" route add ${ROU} dev $INTERFACE
@@ -113,8 +107,15 @@ then
     export ROUTE="$(which route)"
     #"${IPOPR}" $INTERFACE 192.168.123.222 192.168.123.223 up netmask 255.255.255.0
     #"${ROUTE}" add -net 192.168.123.0 192.168.123.223 255.255.255.0
-    sudo "${IPOPR}" $INTERFACE "${GVN_VIP}" "${SERVER_VIP}" up netmask "${MASK}"
-    echo "sudo ${IPOPR} $INTERFACE ${GVN_VIP} ${SERVER_VIP} up netmask ${MASK}" >> "${LOGFILE}"
+    if [ "${TAP}" == "true" ]
+    then
+        # the TAP device is not point to point
+        sudo "${IPOPR}" $INTERFACE inet "${GVN_VIP}" up netmask "${MASK}"
+        echo "sudo ${IPOPR} $INTERFACE inet ${GVN_VIP} up netmask ${MASK}" >> "${LOGFILE}"
+    else
+        sudo "${IPOPR}" $INTERFACE "${GVN_VIP}" "${SERVER_VIP}" up netmask "${MASK}"
+        echo "sudo ${IPOPR} $INTERFACE ${GVN_VIP} ${SERVER_VIP} up netmask ${MASK}" >> "${LOGFILE}"
+    fi
     #"${ROUTE}" add -net 192.168.123.0 192.168.123.223 255.255.255.0
     sudo "${ROUTE}" add ${GVN_VIP} -interface "${INTERFACE}"
     echo "sudo ${ROUTE} add ${GVN_VIP} -interface ${INTERFACE}" >> "${LOGFILE}"
@@ -140,12 +141,13 @@ fi`
 	}).Debug("Execute command")
 
 	envs := make([]string, 0)
-	envs = append(envs, fmt.Sprintf("GVN_VIP=%s", VIP))
+	envs = append(envs, fmt.Sprintf("GVN_VIP=%s", vip))
 	envs = append(envs, fmt.Sprintf("SERVER_VIP=%s", serverVIP))
 	envs = append(envs, fmt.Sprintf("MASK=%s", mask))
 	envs = append(envs, fmt.Sprintf("ROUTES=%s", strings.Join(dev.Subnets, " ")))
 	envs = append(envs, fmt.Sprintf("INTERFACE=%s", dev.Name))
 	envs = append(envs, fmt.Sprintf("SERVER_PORT=%d", dev.Port))
+	envs = append(envs, fmt.Sprintf("TAP=%t", dev.Tap))
 
 	if err := RunCommand(tmpfile.Name(), envs...); err != nil {
 		return err
@@ -157,7 +159,7 @@ fi`
 
 func UnloadFirewall(dev Device) error {
 	// TODO:
-	VIP = dev.Ip
+	vip := dev.Ip
 	tmpfile, err := ioutil.TempFile("", "UnloadFirewall-*.sh")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -169,7 +171,7 @@ func UnloadFirewall(dev Device) error {
 	}).Info("shell script to be executed")
 	// cidr -> 10.30.20.0/24,172.16.1.1/23 and etc
 	// ipv4Addr, ipv4Net, err := net.ParseCIDR(VIP)
-	_, ipv4Net, err := net.ParseCIDR(VIP)
+	_, ipv4Net, err := net.ParseCIDR(vip)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
@@ -252,7 +254,7 @@ fi`
 	}).Debug("Execute command")
 
 	envs := make([]string, 0)
-	envs = append(envs, fmt.Sprintf("GVN_VIP=%s", VIP))
+	envs = append(envs, fmt.Sprintf("GVN_VIP=%s", vip))
 	envs = append(envs, fmt.Sprintf("SERVER_VIP=%s", serverVIP))
 	envs = append(envs, fmt.Sprintf("MASK=%s", mask))
 	envs = append(envs, fmt.Sprintf("ROUTES=%s", strings.Join(dev.Subnets, " ")))
@@ -267,8 +269,8 @@ fi`
 	return nil
 }
 
-// TODO: should provide TUN device name
-func AddRoute(subnets []string) error {
+// AddRoute routes the subnets via the TUN device dev
+func AddRoute(dev Device, subnets []string) error {
 	tmpfile, err := ioutil.TempFile("", "AddRoute-*.sh")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -296,7 +298,7 @@ then
     export IPOPR="$(which ip)"
     export IPTABLES="$(which iptables)"
 
-    # TODO: check whether conflict with LAN
+    # conflict with LAN has been checked before
     for ROU in ${ROUTES}
     do
        echo "${IPOPR} route add ${ROU} dev $INTERFACE" >> "${LOGFILE}"
@@ -329,8 +331,7 @@ fi`
 
 	envs := make([]string, 0)
 	envs = append(envs, fmt.Sprintf("ROUTES=%s", strings.Join(subnets, " ")))
-	// TODO:
-	envs = append(envs, fmt.Sprintf("INTERFACE=%s", devName))
+	envs = append(envs, fmt.Sprintf("INTERFACE=%s", dev.Name))
 
 	if err := RunCommand(tmpfile.Name(), envs...); err != nil {
 		return err
@@ -340,7 +341,8 @@ fi`
 	return nil
 }
 
-func RemoveRoute(subnets []string) error {
+// RemoveRoute removes the routes of the subnets via the TUN device dev only
+func RemoveRoute(dev Device, subnets []string) error {
 	tmpfile, err := ioutil.TempFile("", "RemoveRoute-*.sh")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -371,8 +373,8 @@ then
     # TODO: check whether conflict with LAN
     for ROU in ${ROUTES}
     do
-       echo "${IPOPR} route del ${ROU}" >> "${LOGFILE}"
-       "${IPOPR}" route del ${ROU}
+       echo "${IPOPR} route del ${ROU} dev $INTERFACE" >> "${LOGFILE}"
+       "${IPOPR}" route del ${ROU} dev $INTERFACE
     done
 elif [ "${OS}" == "Darwin" ]
 then
@@ -380,8 +382,8 @@ then
     export ROUTE="$(which route)"
     for ROU in ${ROUTES}
     do
-        echo "sudo ${ROUTE} delete ${ROU}" >> "${LOGFILE}"
-        sudo "${ROUTE}" delete ${ROU}
+        echo "sudo ${ROUTE} delete ${ROU} -interface ${INTERFACE}" >> "${LOGFILE}"
+        sudo "${ROUTE}" delete ${ROU} -interface "${INTERFACE}"
     done
 fi`
 	if _, err := tmpfile.Write([]byte(content)); err != nil {
@@ -401,8 +403,7 @@ fi`
 
 	envs := make([]string, 0)
 	envs = append(envs, fmt.Sprintf("ROUTES=%s", strings.Join(subnets, " ")))
-	// TODO:
-	envs = append(envs, fmt.Sprintf("INTERFACE=%s", devName))
+	envs = append(envs, fmt.Sprintf("INTERFACE=%s", dev.Name))
 
 	if err := RunCommand(tmpfile.Name(), envs...); err != nil {
 		return err
@@ -412,7 +413,7 @@ fi`
 	return nil
 }
 
-func RefreshRoute(subnets []string) {
-	RemoveRoute(subnets)
-	AddRoute(subnets)
+func RefreshRoute(dev Device, subnets []string) {
+	RemoveRoute(dev, subnets)
+	AddRoute(dev, subnets)
 }
@@ -24,12 +24,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	VIP string
-)
-
 func ConfigAddr(dev Device) error {
-	VIP = dev.Ip
 	tmpfile, err := ioutil.TempFile("", "ConfigureAddr-*.bat")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -40,7 +35,7 @@ func ConfigAddr(dev Device) error {
 		"File": tmpfile.Name(),
 	}).Info("bat file to be executed")
 	// cidr -> 10.30.20.0/24,172.16.1.1/23 and etc
-	ipv4Addr, ipv4Net, err := net.ParseCIDR(VIP)
+	ipv4Addr, ipv4Net, err := net.ParseCIDR(dev.Ip)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
@@ -78,13 +73,13 @@ func ConfigAddr(dev Device) error {
 }
 
 func UnloadFirewall(dev Device) error {
-	return RemoveRoute(dev.Subnets)
+	return RemoveRoute(dev, dev.Subnets)
 }
 
-func RemoveRoute(subnets []string) error {
+func RemoveRoute(dev Device, subnets []string) error {
 	logrus.WithFields(logrus.Fields{
 		"subnets": subnets,
-		"VIP":     VIP,
+		"VIP":     dev.Ip,
 	}).Debug("Subnets to be removed")
 	tmpfile, err := ioutil.TempFile("", "RemoveRoute-*.bat")
 	if err != nil {
@@ -119,10 +114,10 @@ func RemoveRoute(subnets []string) error {
 	return nil
 }
 
-func AddRoute(subnets []string) error {
+func AddRoute(dev Device, subnets []string) error {
 	logrus.WithFields(logrus.Fields{
 		"subnets": subnets,
-		"VIP":     VIP,
+		"VIP":     dev.Ip,
 	}).Debug("Subnets to be added")
 	tmpfile, err := ioutil.TempFile("", "AddRoute-*.bat")
 	if err != nil {
@@ -131,7 +126,7 @@ func AddRoute(subnets []string) error {
 		}).Error("AddRoute error when create tmp file")
 	}
 	// cidr -> 10.30.20.0/24,172.16.1.1/23 and etc
-	ipv4Addr, _, err := net.ParseCIDR(VIP)
+	ipv4Addr, _, err := net.ParseCIDR(dev.Ip)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
@@ -166,7 +161,7 @@ func AddRoute(subnets []string) error {
 	return nil
 }
 
-func RefreshRoute(subnets []string) {
-	RemoveRoute(subnets)
-	AddRoute(subnets)
+func RefreshRoute(dev Device, subnets []string) {
+	RemoveRoute(dev, subnets)
+	AddRoute(dev, subnets)
 }
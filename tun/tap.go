@@ -0,0 +1,35 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tun
+
+import (
+	"github.com/songgao/water"
+)
+
+// NewTap creates and configures the TAP device of the system, it reads and writes the Ethernet frames
+func NewTap(dev Device) (Interface, error) {
+	ifce, err := water.New(water.Config{DeviceType: water.TAP, PlatformSpecificParams: tapParams(dev)})
+	if err != nil {
+		return nil, err
+	}
+	// the name may be chosen by the system
+	dev.Name = ifce.Name()
+	if err := ConfigAddr(dev); err != nil {
+		ifce.Close()
+		return nil, err
+	}
+	return ifce, nil
+}
@@ -0,0 +1,25 @@
+/*
+Copyright © 2022 lilo <luolee.me@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tun
+
+import (
+	"github.com/songgao/water"
+)
+
+// the TAP devices are created by tuntaposx, the name must be tapN
+func tapParams(dev Device) water.PlatformSpecificParams {
+	return water.PlatformSpecificParams{Name: dev.Name, Driver: water.MacOSDriverTunTapOSX}
+}
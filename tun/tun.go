@@ -17,11 +17,11 @@ package tun
 
 import (
 	"fmt"
+	"net"
 	"runtime"
 
 	tun "github.com/liloew/wireguard-go/tun"
 	"github.com/sirupsen/logrus"
-	"github.com/songgao/packets/ethernet"
 )
 
 type Device struct {
@@ -34,48 +34,76 @@ type Device struct {
 	ServerVIP string
 	// iptables
 	Port uint
+	// the TAP device bridged with the peers rather than the TUN device
+	Tap bool
 }
 
-var (
+// Interface is the TUN device gvn reads the packets from and writes the packets to
+type Interface interface {
+	// Read reads an IP packet into buff
+	Read(buff []byte) (int, error)
+	// Write writes an IP packet
+	Write(packet []byte) (int, error)
+	Close() error
+}
+
+// native wraps the TUN device of the system
+type native struct {
 	device tun.Device
-)
+	// the bytes reserved before the packet, 4 for the utun header on darwin
+	offset int
+}
 
-func NewTun(dev Device) {
+// NewTun creates and configures the TUN device of the system
+func NewTun(dev Device) (Interface, error) {
 	ifce, err := tun.CreateTUN(dev.Name, dev.Mtu, true)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"ERROR": err,
-		}).Panic("Create TUN error")
+		return nil, err
 	}
 	if err := ConfigAddr(dev); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"ERROR": err,
-		}).Panic("Configure TUN error")
+		ifce.Close()
+		return nil, err
 	}
-	device = ifce
+	device := &native{device: ifce}
+	if runtime.GOOS == "darwin" {
+		device.offset = 4
+	}
+	return device, nil
 }
 
-func Read(frame []byte) (int, error) {
-	if runtime.GOOS == "darwin" {
-		return device.Read(frame, 4)
+func (n *native) Read(buff []byte) (int, error) {
+	if n.offset == 0 {
+		return n.device.Read(buff, 0)
 	}
-	return device.Read(frame, 0)
+	frame := make([]byte, n.offset+len(buff))
+	size, err := n.device.Read(frame, n.offset)
+	return copy(buff, frame[n.offset:n.offset+size]), err
 }
 
-func Write(frame ethernet.Frame) (int, error) {
-	if runtime.GOOS == "darwin" {
-		return device.Write(frame, 4)
+func (n *native) Write(packet []byte) (int, error) {
+	if n.offset == 0 {
+		return n.device.Write(packet, 0)
 	}
-	return device.Write(frame, 0)
+	frame := make([]byte, n.offset+len(packet))
+	copy(frame[n.offset:], packet)
+	return n.device.Write(frame, n.offset)
 }
 
-func Close(dev Device) error {
+func (n *native) Close() error {
+	return n.device.Close()
+}
+
+// Close unloads the firewall rules of dev and closes the device if created
+func Close(dev Device, device Interface) error {
 	if err := UnloadFirewall(dev); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
 		}).Error("Unload ip/firewall rules error")
 		return err
 	}
+	if device == nil {
+		return nil
+	}
 	if err := device.Close(); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"ERROR": err,
@@ -85,6 +113,53 @@ func Close(dev Device) error {
 	return nil
 }
 
+// LocalNetworks returns the networks of all the up interfaces except the TUN device named exclude
+func LocalNetworks(exclude string) ([]*net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	networks := make([]*net.IPNet, 0)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || (exclude != "" && iface.Name == exclude) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				_, network, _ := net.ParseCIDR(ipNet.String())
+				networks = append(networks, network)
+			}
+		}
+	}
+	return networks, nil
+}
+
+// ConflictWithLAN returns the local network overlapped with subnet if any, the TUN device named exclude is not LAN
+func ConflictWithLAN(subnet *net.IPNet, exclude string) *net.IPNet {
+	networks, err := LocalNetworks(exclude)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"ERROR": err,
+		}).Error("List local networks error")
+		return nil
+	}
+	for _, network := range networks {
+		if Overlap(network, subnet) {
+			return network
+		}
+	}
+	return nil
+}
+
+// Overlap reports whether the two networks share any address
+func Overlap(left, right *net.IPNet) bool {
+	return left.Contains(right.IP) || right.Contains(left.IP)
+}
+
 func ipv4MaskString(m []byte) string {
 	if len(m) != 4 {
 		logrus.Panic("ipv4Mask: len must be 4 bytes")